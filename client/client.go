@@ -18,6 +18,9 @@ import (
 	"fmt"
 	"context"
 	"sync"
+	"sync/atomic"
+	"os"
+	"strconv"
 	"time"
 	"math"
 	"encoding/json"
@@ -28,7 +31,9 @@ import (
  //----- CONSTS ----------------------------------------------------------------------------------------------------------//
 //-----------------------------------------------------------------------------------------------------------------------//
 
-
+var ErrQueueFull	= errors.New("k8mq: client message queue is full")
+var ErrClosed		= errors.New("k8mq: client is closed")
+var ErrNotSupported	= errors.New("k8mq: the server is too old to support this")
 
   //-----------------------------------------------------------------------------------------------------------------------//
  //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
@@ -38,17 +43,52 @@ import (
 type Client struct {
 	serverUrl string 
 	port int 
-	reader models.ReadCallback
+	info models.ConnInfo // who we tell the server we are
+	handler models.Handler
 	ctx context.Context 
 	ctxCancel context.CancelFunc
-	conn *websocket.Conn 	// The websocket connection.
+	conn atomic.Pointer[websocket.Conn] 	// The websocket connection, nil while we're not connected
+	serverProto atomic.Int32 // protocol version the server we're connected to speaks, 0 for raw messages only
 
 	wgMessages *sync.WaitGroup
-	messages chan *models.QueMessage
+	messages *models.PriorityQueue // waiting to go out, highest priority first
+	closed chan bool // closed when we start shutting down, so blocked publishers can bail
+	closeOnce sync.Once
 	hashListeners map[string](chan *models.QueMessage)
 	hashLocker sync.RWMutex 
-	shuttingDown bool // indicates that we're shutting down
-	remoteServerShuttingDown bool // indicates that the other remote server is shutting down and we need to stop sending messages
+	shuttingDown atomic.Bool // indicates that we're shutting down
+	remoteServerShuttingDown atomic.Bool // indicates that the other remote server is shutting down and we need to stop sending messages
+
+	outbox *outbox // optional, holds messages we couldn't send
+	outboxSignal chan bool // pokes the outbox flusher when we might be able to send again
+
+	confirms map[string]*pendingConfirm // waiting on the server to ack these publishes, by ref
+	confirmLock sync.Mutex
+
+	requests map[string]chan *models.Message // waiting on a reply to these message ids
+	requestLock sync.Mutex
+
+	workers *workers // optional, runs the handler off of the read loop
+
+	inbox *inbox // optional, messages we've already handed to the reader
+	onDuplicate DuplicateCallback
+
+	deadLetters []*models.Frame // waiting to be sent to the server's dead letter topic
+	deadLetterLock sync.Mutex
+	onDeadLetter DeadLetterCallback
+
+	onPresence PresenceCallback
+
+	topics map[string]*subscription // what we're subscribed to, and how
+	offsets map[string]uint64 // last offset we've seen on each topic
+	topicLock sync.Mutex
+
+	commits map[commitKey]*commitTrack // what we've handled in each partition, for groups that commit automatically
+	commitLock sync.Mutex
+
+	credits *credits // how much more the server can send us
+
+	expired atomic.Uint64 // messages we dropped because their ttl passed
 }
 
 
@@ -59,18 +99,30 @@ func (this *Client) monitorMessages () {
 	this.wgMessages.Add(1)
 	defer this.wgMessages.Done()
 
-	for msg := range this.messages {
-		if msg == nil { break } // channel is closed
+	for {
+		msg, more := this.messages.Pop()
+		if more == false { break } // we're closed and it's empty
 
 		if this.ctx.Err() != nil { break } // we're shutting down
 
+		if this.dropExpired(msg) { continue }
+
+		if this.outbox != nil {
+			// anything already in the outbox has to go out first to keep things in order
+			// and there's no point waiting on the retries if we know we can't send right now
+			if this.outbox.Len() > 0 || this.connected() == false {
+				this.spool(msg)
+				continue 
+			}
+		}
+
 		// write this out to our server
 		// i'm pretty sure we'll be handling errors and reconnecting from the reading thread,
 		// so as long as the conn isn't nil, assume this works
 		ok := false 
 		for i := 0; i < 4; i++ {
-			if this.conn != nil && this.remoteServerShuttingDown == false { // while we have a connection and it's not shutting down
-				err := this.conn.Write(this.ctx, websocket.MessageText, msg.Msg)
+			if this.connected() { // while we have a connection and it's not shutting down
+				err := this.write(msg)
 				if err == nil {
 					ok = true 
 					break 
@@ -88,14 +140,26 @@ func (this *Client) monitorMessages () {
 		// also we're clearly not connecting to the k8mq server
 		// so just log it and move on
 		if ok == false && this.ctx.Err() == nil { // only reque if we're not exiting
-			if msg.Reques >= 1 {
+			if this.outbox != nil {
+				this.spool(msg) // we have somewhere safe to put it
+
+			} else if msg.Reques >= 1 {
 				slog.Error("QUE: Failed to write to the k8mq server: " + string(msg.Msg))
+				this.confirm(msg.Ref, 0, errors.Errorf("failed to write to the k8mq server"))
+				this.deadLetter(msg, "failed to write to the k8mq server", (msg.Reques + 1) * 4)
+
+			} else if this.shuttingDown.Load() {
+				this.confirm(msg.Ref, 0, ErrClosed) // we're not going to try again
 
-			} else if this.shuttingDown == false {
+			} else if this.dropExpired(msg) == false { // no point sending it again if it's expired
 				// only reque if we're not shutting down
 				slog.Warn("QUE: Failed to write to the k8mq server : re-quing : " + string(msg.Msg))
 				msg.Reques++ // ramp this for next time
-				this.messages <- msg
+				if err := this.publish(this.ctx, msg, false); err != nil {
+					// can't block here, we're the only thing pulling off the channel
+					slog.Error("QUE: Failed to re-que message : " + err.Error() + " : " + string(msg.Msg))
+					this.confirm(msg.Ref, 0, err)
+				}
 			}
 		}
 	}
@@ -103,53 +167,314 @@ func (this *Client) monitorMessages () {
 	slog.Info("QUE: Monitor exited")
 }
 
+// returns true if the message expired, in which case we've dropped it
+func (this *Client) dropExpired (msg *models.QueMessage) bool {
+	if msg.Expired() == false { return false }
+
+	this.expired.Add(1)
+	slog.Info("QUE: dropping expired message : " + msg.Id)
+	this.confirm(msg.Ref, 0, models.ErrExpired)
+	return true
+}
+
+// true if the server we're connected to speaks frames, otherwise all we can send are raw messages
+func (this *Client) framed () bool {
+	return this.serverProto.Load() >= models.ProtocolVersion
+}
+
+// true if we have a connection to a server that isn't shutting down
+func (this *Client) connected () bool {
+	return this.conn.Load() != nil && this.remoteServerShuttingDown.Load() == false
+}
+
+// writes the message out to the server as a publish frame
+// older servers just get the body, same as before we had frames, if that's all the message needs
+func (this *Client) write (msg *models.QueMessage) error {
+	if this.framed() == false {
+		if msg.Confirm || (len(msg.Type) > 0 && msg.Type != models.FramePublish) {
+			slog.Warn("QUE: server doesn't speak frames, dropping message : " + msg.Id)
+			this.confirm(msg.Ref, 0, ErrNotSupported)
+			return nil // there's no point trying again
+		}
+
+		conn := this.conn.Load()
+		if conn == nil { return errors.Errorf("not connected") }
+		return conn.Write(this.ctx, websocket.MessageText, msg.Msg)
+	}
+
+	frame := &models.Frame{ Type: models.FramePublish, Envelope: msg.Envelope, Confirm: msg.Confirm, Body: msg.Msg }
+	if len(msg.Type) > 0 {
+		frame.Type = msg.Type
+	}
+
+	return this.writeFrame(frame)
+}
+
+func (this *Client) writeFrame (frame *models.Frame) error {
+	if this.framed() == false { return ErrNotSupported } // they'd take it as a message for everyone
+
+	conn := this.conn.Load()
+	if conn == nil { return errors.Errorf("not connected") }
+
+	return conn.Write(this.ctx, websocket.MessageText, frame.Marshal())
+}
+
+// adds the message to our channel, safe to call during or after closing
+// when block is false we return ErrQueueFull instead of waiting for room
+func (this *Client) publish (ctx context.Context, msg *models.QueMessage, block bool) error {
+	select {
+	case <-this.closed:
+		return ErrClosed // check this first, there may be room but we're not sending anymore
+	default:
+	}
+
+	if len(msg.Id) == 0 {
+		msg.Id = models.MessageId(msg.Msg) // every message gets an id so the server can tell them apart
+	}
+
+	if msg.Published == 0 {
+		msg.Published = time.Now().UnixMilli()
+	}
+
+	switch err := this.messages.Push(ctx, msg, block); err {
+	case models.ErrPriorityFull:
+		return ErrQueueFull
+	case models.ErrPriorityClosed:
+		return ErrClosed
+	default:
+		return err
+	}
+}
+
+// writes the message to our outbox, logging if we had to drop it
+func (this *Client) spool (msg *models.QueMessage) {
+	err := this.outbox.Push(this.ctx, msg)
+	if err != nil {
+		slog.Error("QUE: Failed to spool message to the outbox : " + err.Error() + " : " + string(msg.Msg))
+		return
+	}
+
+	this.pokeOutbox() // in case we're connected now
+}
+
+// lets the outbox flusher know it should try again, never blocks
+func (this *Client) pokeOutbox () {
+	if this.outbox == nil { return }
+
+	select {
+	case this.outboxSignal <- true:
+	default: // already poked
+	}
+}
+
+// sends everything in the outbox, highest priority then oldest first, until it's empty or we can't send anymore
+func (this *Client) flushOutbox () {
+	for this.ctx.Err() == nil && this.connected() {
+		msg, seq, err := this.outbox.Peek()
+		if err != nil {
+			slog.Error("QUE: Failed to read from the outbox : " + err.Error())
+			return 
+		}
+
+		if msg == nil { return } // we're empty
+
+		if this.dropExpired(msg) {
+			this.outbox.Pop (seq)
+			continue 
+		}
+
+		err = this.write(msg)
+		if err != nil { return } // try again later, the reader handles re-connecting
+
+		this.outbox.Pop (seq) // it's out, so we can remove it, unless it was dropped to make room while we sent it
+	}
+}
+
+// monitors for signals that we can flush the outbox, with a regular check in case we missed one
+func (this *Client) monitorOutbox () {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-this.ctx.Done():
+			slog.Info("QUE: Outbox exited")
+			return 
+		case <-this.outboxSignal:
+		case <-tick.C:
+		}
+
+		if this.outbox.Len() > 0 {
+			this.flushOutbox()
+		}
+	}
+}
+
+// hands the message to our handler, skipping it if the inbox says we've already processed it
+// if the handler fails we nack it back to the server so it's redelivered
+func (this *Client) handle (msg *models.Message, nackable bool) {
+	if this.handler == nil { return } // in theory there may be a use where something only writes and never reads
+
+	key := msg.Id
+	if len(msg.ReplyTo) > 0 {
+		key = "" // replies often carry the request's IdHash, so they'd look like a repeat of it
+	}
+	if this.inbox.Reserve(key) == false {
+		slog.Info("QUE: skipping duplicate message : " + msg.Id)
+		if this.onDuplicate != nil {
+			this.onDuplicate(msg.Id, msg.Body)
+		}
+		this.autoCommit(msg) // we've handled it before, so it doesn't hold anything up
+		return
+	}
+
+	err := this.callHandler(msg)
+	if err != nil {
+		this.inbox.Release(key) // so the redelivery is handled
+		slog.Warn(fmt.Sprintf("QUE: handler failed message %s : %s", msg.Id, err.Error()))
+
+		// it's still pending, so we don't commit past it until the redelivery is handled
+		if nackable == false { return } // the server doesn't speak frames, so there's nothing more we can do
+
+		frame := &models.Frame{ Type: models.FrameNack, Envelope: msg.Envelope, Error: err.Error(), Body: msg.Body }
+		if err = this.writeFrame(frame); err != nil {
+			slog.Warn("QUE: Failed to nack message : " + err.Error())
+		}
+		return
+	}
+
+	if err = this.inbox.Add(key); err != nil {
+		slog.Warn("QUE: Failed to record message in the inbox : " + err.Error())
+	}
+
+	this.autoCommit(msg)
+}
+
+// runs the handler, turning a panic into an error so it can't take down the read loop or a worker
+func (this *Client) callHandler (msg *models.Message) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("handler panic : %v", r)
+		}
+	}()
+
+	return this.handler(this.ctx, msg)
+}
+
+// the frame if the server speaks them, older servers only send raw messages
+func (this *Client) parseFrame (data []byte) (*models.Frame, bool) {
+	if this.framed() == false { return nil, false }
+	return models.ParseFrame(data)
+}
+
+// handles a single text message from the server
+func (this *Client) received (data []byte) {
+	msg := &models.Message{ Body: data }
+	isFrame := false
+	dispatched := false // the workers give the credit back once they're done with it
+
+	if frame, ok := this.parseFrame(data); ok {
+		switch frame.Type {
+		case models.FrameAck, models.FrameError:
+			this.confirmFrame(frame)
+			return // these are just for us
+
+		case models.FrameShutdown:
+			// we don't want to send any more messages on our connection until it's reset
+			this.remoteServerShuttingDown.Store(true)
+			return
+
+		case models.FrameMessage:
+			if frame.Seq > 0 { // the server counted this against our credit
+				this.creditReceived()
+				defer func() {
+					if dispatched == false { this.creditDone() }
+				}()
+			}
+
+			if frame.Expired() {
+				this.expired.Add(1)
+				return // too late to do anything with it
+			}
+
+			// the rest of this only cares about the message itself
+			msg.Envelope = frame.Envelope
+			msg.Body = frame.Body
+			msg.Replier = this.replier(msg)
+			isFrame = true
+			this.seen(msg)
+		}
+	}
+
+	// servers that don't speak frames can only warn us they're shutting down with this message
+	// ones that do send a control frame, so a message with the same body, eg replayed from an old log, is just a message
+	if isFrame == false && this.framed() == false && string(msg.Body) == models.ShutdownMessage {
+		// this was the server sending a shutdown message
+		// this means we don't want to send any more messages on our connection until it's reset
+		this.remoteServerShuttingDown.Store(true)
+		return // on to the next message
+	}
+
+	// see if we have an idHash with a receiver channel
+	mHash := &models.MessageHashPrototype{}
+	err := json.Unmarshal(msg.Body, mHash)
+	if err == nil && len(mHash.IdHash) > 0 {
+		if len(msg.Id) == 0 { msg.Id = mHash.IdHash }
+
+		// we got an id hash, let's see if we registered a listening channel
+		this.hashLocker.Lock()
+
+		if ch, ok := this.hashListeners[mHash.IdHash]; ok {
+			ch <- &models.QueMessage{ Msg: msg.Body }
+			close(ch) // now close this channel, we don't need it anymore
+			delete(this.hashListeners, mHash.IdHash) // remove it from our map as well
+			this.hashLocker.Unlock() // unlock the hash locker
+			return // don't do the regular reader
+		}
+
+		this.hashLocker.Unlock() // unlock the hash locker
+	}
+
+	if this.replied(msg) { return } // someone is waiting on this in Request
+
+	if isFrame && msg.Topic == models.PresenceTopic {
+		this.presence(msg) // these are for us, not the handler
+		return
+	}
+
+	this.commitStart(msg) // nothing after it is committed until it's handled
+
+	if this.workers == nil {
+		this.handle(msg, isFrame)
+		return
+	}
+
+	dispatched = this.workers.Dispatch(msg, isFrame)
+	if dispatched == false {
+		slog.Warn("QUE: closing, message not handled : " + msg.Id)
+	}
+}
+
 // handles monitoring the read channel as well as re-connecting to the main service when the connection is invalid
 func (this *Client) read () {
 	for this.ctx.Err() == nil {
-		if this.conn == nil {
+		conn := this.conn.Load()
+		if conn == nil {
 			slog.Warn("QUE: no connection to primary service : reconnecting")
 			this.connect()
 			continue 
 		}
 
 		// now that we have a connection that isn't nil 
-		mType, data, err := this.conn.Read(this.ctx)
+		mType, data, err := conn.Read(this.ctx)
 		if err == nil {
 			slog.Info(fmt.Sprintf("RAW QUE: Found message to read : %v : %s", mType, string(data)))
 
 			if mType == websocket.MessageText {
-				// see if our message was a warning that the server is shutting down
-				if string(data) == models.ShutdownMessage {
-					// this was the server sending a shutdown message
-					// this means we don't want to send any more messages on our connection until it's reset
-					this.remoteServerShuttingDown = true
-					continue // on to the next message
-				}
-
-				// see if we have an idHash with a receiver channel
-				mHash := &models.MessageHashPrototype{}
-				err = json.Unmarshal(data, mHash)
-				if err == nil && len(mHash.IdHash) > 0 {
-					// we got an id hash, let's see if we registered a listening channel
-					this.hashLocker.Lock()
-
-					if ch, ok := this.hashListeners[mHash.IdHash]; ok {
-						ch <- &models.QueMessage{ Msg: data }
-						close(ch) // now close this channel, we don't need it anymore
-						delete(this.hashListeners, mHash.IdHash) // remove it from our map as well
-						this.hashLocker.Unlock() // unlock the hash locker
-						continue // don't do the regular reader
-					}
-
-					this.hashLocker.Unlock() // unlock the hash locker
-				}
-
-				if this.reader != nil { // in theory there may be a use where something only writes and never reads
-					this.reader(data)
-				}
+				this.received(data)
 			}
 		} else {
-			this.conn = nil // this connection is no longer valid
+			this.conn.Store(nil) // this connection is no longer valid
 			slog.Warn(fmt.Sprintf("QUE: Read error : %v : reconnecting", err))
 			this.connect()
 		}
@@ -165,11 +490,22 @@ func (this *Client) connect () {
 	ctx, cancel := context.WithTimeout(this.ctx, time.Second * 3)
 	defer cancel()
 
-	conn, _, err := websocket.Dial (ctx, fmt.Sprintf("ws://%s:%d/que", this.serverUrl, this.port), nil)
+	conn, resp, err := websocket.Dial (ctx, fmt.Sprintf("ws://%s:%d/que?%s", this.serverUrl, this.port, this.info.Query().Encode()), nil)
 	if err == nil {
-		this.conn = conn // we're good, copy this over
+		proto := 0 // older servers don't tell us, and only understand raw messages
+		if resp != nil {
+			proto, _ = strconv.Atoi(resp.Header.Get(models.ProtocolHeader))
+		}
+		this.serverProto.Store(int32(min(proto, models.ProtocolVersion)))
+
+		this.conn.Store(conn) // we're good, copy this over
 		slog.Info(fmt.Sprintf("QUE: connected to %s:%d", this.serverUrl, this.port))
-		this.remoteServerShuttingDown = false // clear this flag if it was set, we've connected to a new remote server and we haven't heard anything about it shutting down
+		this.remoteServerShuttingDown.Store(false) // clear this flag if it was set, we've connected to a new remote server and we haven't heard anything about it shutting down
+		this.creditConnected() // before subscribing, so any replay counts against it
+		this.resubscribe() // before anything else goes out, so we don't miss what we're expecting back
+		this.pokeOutbox() // we might have things waiting to go out
+		this.flushDeadLetters()
+		this.flushCommits()
 		return
 	}
 	
@@ -181,16 +517,20 @@ func (this *Client) connect () {
 
 // closes things and waits in its own thread
 func (this *Client) closeAndWait (ch chan bool) {
-	this.shuttingDown = true // flag this
+	this.shuttingDown.Store(true) // flag this
 
 	// close all the channels
-	if this.messages != nil {
-		close(this.messages)
-	}
+	this.closeOnce.Do(func() {
+		close(this.closed)
+		this.messages.Close() // wakes up anything blocked publishing
+	})
 
 	if this.wgMessages != nil {
 		this.wgMessages.Wait() // wait for the threads to finish
 	}
+
+	this.workers.Close() // let the handlers finish what they have
+	this.flushCommits() // and commit what they finished
 	
 	// they fininshed, so set the channel
 	ch <- true 
@@ -211,8 +551,12 @@ func (this *Client) Close (tm time.Duration) error {
 	case <- done:
 		// we finished normally and expectidly 
 		this.ctxCancel() // shut it down
-		if this.conn != nil {
-			this.conn.Close(websocket.StatusNormalClosure, "")
+		this.failConfirms(ErrClosed) // nothing left to hear back from
+		if err := this.inbox.Close(); err != nil {
+			slog.Warn("QUE: Failed to close the inbox : " + err.Error())
+		}
+		if conn := this.conn.Load(); conn != nil {
+			conn.Close(websocket.StatusNormalClosure, "")
 		}
 
 	case <-ctx.Done():
@@ -224,13 +568,48 @@ func (this *Client) Close (tm time.Duration) error {
 }
 
 // adds a new message to go to our server connection
-// this is thread safe
+// this is thread safe, it blocks while our channel is full and logs if we're already closed
 func (this *Client) NewMsg (msg []byte) {
-	this.messages <- &models.QueMessage {
-		Msg: msg,
+	err := this.Publish (context.Background(), msg)
+	if err != nil {
+		slog.Warn("QUE: Unable to publish message : " + err.Error() + " : " + string(msg))
 	}
 }
 
+// adds a new message to go to our server connection, waiting for room until the context is done
+// returns ErrClosed once the client has been closed
+func (this *Client) Publish (ctx context.Context, msg []byte, opts ...PublishOption) error {
+	return this.publish (ctx, newMessage (msg, opts), true)
+}
+
+// same as Publish but returns ErrQueueFull right away instead of waiting for room
+func (this *Client) TryPublish (msg []byte, opts ...PublishOption) error {
+	return this.publish (this.ctx, newMessage (msg, opts), false)
+}
+
+// the id we gave the server, empty if we let the server make one up
+func (this *Client) Id () string {
+	return this.info.Id
+}
+
+// sends the message to just the client with this id
+// if they're not connected the server sends back an error, which PublishSync or PublishAsync with WithTo will see
+func (this *Client) SendTo (ctx context.Context, clientId string, msg []byte, opts ...PublishOption) error {
+	return this.Publish (ctx, msg, append(opts, WithTo (clientId))...)
+}
+
+// publishes an empty message for the key, on a compacted topic this deletes it once the server's tombstone grace has passed
+// pass WithTopic for anything but our default topic
+func (this *Client) Tombstone (ctx context.Context, key string, opts ...PublishOption) error {
+	if len(key) == 0 { return errors.Errorf("a key is required for a tombstone") }
+	return this.Publish (ctx, nil, append(opts, WithKey (key))...)
+}
+
+// number of messages we've dropped because their ttl passed before we could send or handle them
+func (this *Client) Expired () uint64 {
+	return this.expired.Load()
+}
+
 // registers a one-time channel to pass the data to anytime the id hash matches
 func (this *Client) RegisterOneTime (idHash string, ch chan *models.QueMessage) {
 	if len(idHash) == 0 { return } // bail
@@ -246,18 +625,75 @@ func (this *Client) RegisterOneTime (idHash string, ch chan *models.QueMessage)
 
 // creates a new client object to connect, send and receive messages from our server
 func NewClient (serverUrl string, port int, reader models.ReadCallback) (*Client, error) {
+	return NewClientWithOptions (serverUrl, port, reader, nil)
+}
+
+// same as NewClient but with any of our optional settings, opts can be nil
+// pass a nil reader if you're setting the Handler in the options
+func NewClientWithOptions (serverUrl string, port int, reader models.ReadCallback, opts *Options) (*Client, error) {
 	if len(serverUrl) == 0 { return nil, errors.Errorf("remote K8MQ server url required, eg 'k8mq.default.svc'")}
 	if port == 0 { port = models.DefaultPort } // default port
+	if opts == nil { opts = &Options{} }
+	if reader != nil && opts.Handler != nil { return nil, errors.Errorf("set either the reader or the Handler option, not both") }
+
+	handler := opts.Handler
+	if handler == nil {
+		handler = models.ReadCallbackHandler(reader)
+	}
+
+	pod := opts.Pod
+	if len(pod) == 0 {
+		pod, _ = os.Hostname()
+	}
 
 	ret := &Client{
 		serverUrl: serverUrl,
 		port: port,
-		reader: reader,
-		messages: make (chan *models.QueMessage, 100), // this should be happening real quick, but there is a concern if the server is unreachable
+		info: models.ConnInfo{ Proto: models.ProtocolVersion, Id: opts.ClientId, Pod: pod, Service: opts.Service, Labels: opts.Labels, Presence: opts.OnPresence != nil, NoEcho: opts.NoEcho },
+		onPresence: opts.OnPresence,
+		handler: handler,
+		messages: models.NewPriorityQueue (100, opts.PriorityStarve), // this should be happening real quick, but there is a concern if the server is unreachable
+		closed: make (chan bool),
 		wgMessages: new(sync.WaitGroup),
 	}
 
 	ret.hashListeners = make(map[string](chan *models.QueMessage))
+	ret.confirms = make(map[string]*pendingConfirm)
+	ret.requests = make(map[string]chan *models.Message)
+	ret.topics = make(map[string]*subscription)
+	ret.offsets = make(map[string]uint64)
+	ret.commits = make(map[commitKey]*commitTrack)
+
+	if len(opts.OutboxDir) > 0 {
+		var err error
+		ret.outbox, err = newOutbox(opts.OutboxDir, opts.OutboxMaxBytes, opts.OutboxMaxAge, opts.OutboxPolicy)
+		if err != nil { return nil, err }
+
+		ret.outboxSignal = make(chan bool, 1)
+	}
+
+	if opts.InboxSize > 0 {
+		var err error
+		ret.inbox, err = newInbox(opts.InboxSize, opts.InboxFile)
+		if err != nil { return nil, err }
+
+		ret.onDuplicate = opts.OnDuplicate
+	}
+
+	ret.onDeadLetter = opts.OnDeadLetter
+
+	if opts.Workers > 0 && handler != nil {
+		ret.workers = newWorkers(opts.Workers, opts.MaxInFlight, opts.WorkerOrder, func(msg *models.Message, nackable bool) {
+			ret.handle(msg, nackable)
+			if msg.Seq > 0 && nackable { ret.creditDone() } // it came in against our credit
+		})
+	}
+
+	// the server can send us as many messages as our workers can have in flight, unless we say otherwise
+	ret.credits = &credits{ window: opts.Credit }
+	if ret.credits.window == 0 && ret.workers != nil {
+		ret.credits.window = cap(ret.workers.slots)
+	}
 
 	// using context to coordinate closing things
 	ret.ctx, ret.ctxCancel = context.WithCancel(context.Background())
@@ -265,5 +701,15 @@ func NewClient (serverUrl string, port int, reader models.ReadCallback) (*Client
 	go ret.monitorMessages() // monitor this channel as well
 	go ret.read() // fire off the reader
 
+	interval := opts.CommitInterval
+	if interval <= 0 {
+		interval = DefaultCommitInterval
+	}
+	go ret.monitorCommits(interval)
+
+	if ret.outbox != nil {
+		go ret.monitorOutbox() // flushes anything left from before as soon as we connect
+	}
+
 	return ret, nil 
 }
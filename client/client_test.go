@@ -4,45 +4,120 @@ package client
 import (
 	
 	//"github.com/stretchr/testify/assert"
+	"github.com/NathanRThomas/k8mq/models"
+	"github.com/NathanRThomas/k8mq/server"
+
+	"github.com/pkg/errors"
 	
+	"context"
+	"net"
+	"sync"
 	"testing"
 	"time"
-	"log"
 )
 
-func clientReadCallback (b []byte) {
-	log.Printf("clientReadCallback: %s", string(b))
+// a client with everything set up, but no connection or go routines, so tests can poke at it directly
+func newTestClient (queSize int) *Client {
+	ret := &Client{
+		messages: models.NewPriorityQueue(queSize, 0),
+		closed: make(chan bool),
+		wgMessages: new(sync.WaitGroup),
+		hashListeners: make(map[string](chan *models.QueMessage)),
+		confirms: make(map[string]*pendingConfirm),
+		requests: make(map[string]chan *models.Message),
+		topics: make(map[string]*subscription),
+		offsets: make(map[string]uint64),
+		commits: make(map[commitKey]*commitTrack),
+		credits: &credits{},
+	}
+	ret.ctx, ret.ctxCancel = context.WithTimeout(context.Background(), time.Minute)
+	return ret
+}
+
+// starts a server in process on a free port, and collects what it reads
+func newTestServer (t *testing.T, port int) (*server.Server, chan string) {
+	got := make(chan string, 10)
+	svr, err := server.NewServer (port, func(b []byte) { got <- string(b) })
+	models.TestingStackTrace (t, err)
+	t.Cleanup (func() { svr.Close (time.Second) })
+
+	return svr, got
 }
 
+// a port nothing's listening on
+func freeTestPort (t *testing.T) int {
+	l, err := net.Listen ("tcp", "localhost:0")
+	models.TestingStackTrace (t, err)
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
 
 func TestClient1 (t *testing.T) {
-	verbose := make([]bool, 2)
-	verbose[0], verbose[1] = true, true 
+	port := freeTestPort (t)
+	_, got := newTestServer (t, port)
 
-	client, err := NewClient ("localhost", 8088, clientReadCallback, verbose)
+	client, err := NewClient ("localhost", port, nil)
 	if err != nil { t.Fatal(err) }
 
 	client.NewMsg([]byte("{\"type\": \"Hello World\"}"))
 
-	time.Sleep(time.Second * 10)
+	select {
+	case msg := <-got:
+		if msg != "{\"type\": \"Hello World\"}" { t.Fatalf("unexpected message : %s", msg) }
+	case <-time.After(time.Second * 10):
+		t.Fatal("server never got the message")
+	}
 
 	err = client.Close(time.Second)
 	if err != nil { t.Fatal(err) }
 }
 
 // this one is designed to test the reconnecting to the server
-// so start this without the server, and then start the server on the same machine
+// so the client starts without the server, and then we start the server on the same port
 func TestClient2 (t *testing.T) {
-	verbose := make([]bool, 2)
-	verbose[0], verbose[1] = true, true 
-	
-	client, err := NewClient ("localhost", 8088, clientReadCallback, verbose)
+	port := freeTestPort (t)
+
+	client, err := NewClient ("localhost", port, nil)
 	if err != nil { t.Fatal(err) }
 
 	client.NewMsg([]byte("{\"type\": \"Hello World\"}"))
 
-	time.Sleep(time.Second * 60)
+	time.Sleep(time.Second)
+	_, got := newTestServer (t, port)
+
+	select {
+	case msg := <-got:
+		if msg != "{\"type\": \"Hello World\"}" { t.Fatalf("unexpected message : %s", msg) }
+	case <-time.After(time.Second * 20):
+		t.Fatal("server never got the message once it came up")
+	}
 
 	err = client.Close(time.Second)
 	if err != nil { t.Fatal(err) }
 }
+
+func TestQAPublish (t *testing.T) {
+	// no go routines pulling messages off, so we can fill things up
+	client := newTestClient (1)
+
+	if err := client.TryPublish([]byte("one")); err != nil { t.Fatal(err) }
+	if err := client.TryPublish([]byte("two")); err != ErrQueueFull { t.Fatalf("expected ErrQueueFull, got %v", err) }
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+	defer cancel()
+	if err := client.Publish(ctx, []byte("two")); errors.Is(err, context.DeadlineExceeded) == false {
+		t.Fatalf("expected the context to time out, got %v", err)
+	}
+
+	// a blocked publish should get kicked out by closing
+	go func() {
+		time.Sleep(time.Millisecond * 50)
+		client.Close(time.Second)
+	}()
+
+	if err := client.Publish(context.Background(), []byte("two")); err != ErrClosed { t.Fatalf("expected ErrClosed, got %v", err) }
+	if err := client.TryPublish([]byte("three")); err != ErrClosed { t.Fatalf("expected ErrClosed, got %v", err) }
+
+	client.NewMsg([]byte("four")) // this used to panic
+}
@@ -0,0 +1,189 @@
+/** ****************************************************************************************************************** **
+	Committing offsets for consumer groups
+	By default we commit what our handler finishes without an error, batched up and sent every so often
+	Only up to the oldest message in the partition that's still being handled, or failed, so nothing unfinished is skipped
+	Subscribing WithManualCommit leaves it to Commit instead, and Lag shows how far behind each group is
+
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+	"fmt"
+	"math"
+	"time"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+const DefaultCommitInterval = time.Second
+const commitWindow = 10000 // messages handled past a failed one before we stop holding commits back for it
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type commitKey struct {
+	topic string
+	partition int
+}
+
+// what we've handled in a partition
+type commitTrack struct {
+	pending map[uint64]bool // received but not handled yet, or failed and waiting on its redelivery
+	done map[uint64]bool // handled, but after something that's still pending
+	ready uint64 // everything we've had up to here is handled, so it's what we commit
+	sent uint64 // what we last committed
+}
+
+//----- commitTrack -----------------------------------------------------------------------------------------------------//
+
+// moves ready up to just before the oldest pending offset
+func (this *commitTrack) advance () {
+	for {
+		low := uint64(math.MaxUint64)
+		for offset := range this.pending {
+			low = min(low, offset)
+		}
+
+		for offset := range this.done {
+			if offset < low {
+				this.ready = max(this.ready, offset)
+				delete(this.done, offset)
+			}
+		}
+
+		// a failed one's redelivery is with the server, so we don't hold everything up for it forever
+		if len(this.done) <= commitWindow { return }
+
+		slog.Warn(fmt.Sprintf("QUE: offset %d still isn't handled after %d others, committing past it", low, len(this.done)))
+		delete(this.pending, low)
+	}
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// the group we're in for the topic, and if we commit automatically
+func (this *Client) group (topic string) (string, bool) {
+	this.topicLock.Lock()
+	defer this.topicLock.Unlock()
+
+	sub, ok := this.topics[models.TopicName (topic)]
+	if ok == false { return "", false }
+	return sub.group, sub.manual == false
+}
+
+// what we're tracking for the message's partition, nil if we're not in a group that commits automatically
+// expects the commit lock to be held
+func (this *Client) commitTrack (msg *models.Message) *commitTrack {
+	if msg.Offset == 0 { return nil }
+	if group, auto := this.group (msg.Topic); len(group) == 0 || auto == false { return nil }
+
+	key := commitKey{ topic: models.TopicName (msg.Topic), partition: msg.Partition }
+	ret, ok := this.commits[key]
+	if ok == false {
+		ret = &commitTrack{ pending: make(map[uint64]bool), done: make(map[uint64]bool) }
+		this.commits[key] = ret
+	}
+	return ret
+}
+
+// holds back commits past this message until it's handled, called as it comes in so they're in order
+func (this *Client) commitStart (msg *models.Message) {
+	if this.handler == nil { return } // nothing's going to handle it
+	this.commitLock.Lock()
+	defer this.commitLock.Unlock()
+
+	if track := this.commitTrack (msg); track != nil {
+		track.pending[msg.Offset] = true
+	}
+}
+
+// remembers to commit the message once everything before it is handled too, if we're in a group that commits automatically
+func (this *Client) autoCommit (msg *models.Message) {
+	this.commitLock.Lock()
+	defer this.commitLock.Unlock()
+
+	track := this.commitTrack (msg)
+	if track == nil { return }
+
+	delete(track.pending, msg.Offset)
+	track.done[msg.Offset] = true
+	track.advance()
+}
+
+// sends what we've handled since last time, keeps whatever we couldn't send
+func (this *Client) flushCommits () {
+	this.commitLock.Lock()
+	defer this.commitLock.Unlock()
+
+	for key, track := range this.commits {
+		if this.connected() == false { return } // we'll try again later
+
+		group, _ := this.group (key.topic)
+		if len(group) == 0 { // we're not in it anymore
+			delete(this.commits, key)
+			continue
+		}
+		if track.ready <= track.sent { continue } // nothing new
+
+		frame := &models.Frame{ Type: models.FrameCommit }
+		frame.Id = models.MessageId (nil)
+		frame.Topic, frame.Group, frame.Partition, frame.Offset = key.topic, group, key.partition, track.ready
+
+		if err := this.writeFrame (frame); err != nil {
+			slog.Warn("QUE: Unable to commit offsets : " + err.Error())
+			return
+		}
+		track.sent = track.ready
+	}
+}
+
+// sends our commits every so often
+func (this *Client) monitorCommits (interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-this.ctx.Done():
+			return
+		case <-tick.C:
+			this.flushCommits()
+		}
+	}
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// tells the server our group has handled everything in the message's partition up to and including it
+// for topics subscribed to WithManualCommit. this doesn't wait to hear back, so it's safe to call from the handler
+func (this *Client) Commit (ctx context.Context, msg *models.Message) error {
+	group, _ := this.group (msg.Topic)
+	if len(group) == 0 { return errors.Errorf("not subscribed to %s in a group", models.TopicName (msg.Topic)) }
+	if msg.Offset == 0 { return errors.Errorf("message %s doesn't have an offset", msg.Id) }
+
+	commit := &models.QueMessage{ Type: models.FrameCommit }
+	commit.Topic, commit.Group, commit.Partition, commit.Offset = models.TopicName (msg.Topic), group, msg.Partition, msg.Offset
+
+	return this.publish (ctx, commit, true)
+}
+
+// how far behind each consumer group is on each partition, in messages and how long the oldest has been waiting
+func (this *Client) Lag (ctx context.Context) ([]models.PartitionLag, error) {
+	reply, err := this.request (ctx, &models.QueMessage{ Type: models.FrameLag })
+	if err != nil { return nil, err }
+
+	ret := make([]models.PartitionLag, 0)
+	if err = json.Unmarshal(reply.Body, &ret); err != nil { return nil, errors.WithStack(err) }
+	return ret, nil
+}
@@ -0,0 +1,54 @@
+package client
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+	"testing"
+)
+
+func TestQACommitPrefix (t *testing.T) {
+	c := newTestClient (0)
+	c.handler = func(ctx context.Context, msg *models.Message) error { return nil }
+	c.topics["jobs"] = &subscription{ group: "workers" }
+
+	newMsg := func (offset uint64) *models.Message {
+		msg := &models.Message{}
+		msg.Topic, msg.Offset = "jobs", offset
+		return msg
+	}
+	ready := func () uint64 {
+		return c.commits[commitKey{ topic: "jobs" }].ready
+	}
+
+	// the workers finish them out of order, so we only commit what's handled all the way up
+	for _, offset := range []uint64{ 1, 3, 5 } {
+		c.commitStart (newMsg (offset))
+	}
+	c.autoCommit (newMsg (5))
+	if ready() != 0 { t.Fatalf("expected nothing to commit while 1 is still going, got %d", ready()) }
+	c.autoCommit (newMsg (1))
+	if ready() != 1 { t.Fatalf("expected to commit 1, got %d", ready()) }
+	c.autoCommit (newMsg (3))
+	if ready() != 5 { t.Fatalf("expected to commit 5, got %d", ready()) }
+
+	// a failed one holds things up until its redelivery is handled
+	c.commitStart (newMsg (7))
+	c.commitStart (newMsg (8))
+	c.autoCommit (newMsg (8))
+	if ready() != 5 { t.Fatalf("expected to wait on 7, got %d", ready()) }
+
+	// but not forever
+	offset := uint64(9)
+	for ; offset < 9 + commitWindow + 1; offset++ {
+		c.commitStart (newMsg (offset))
+		c.autoCommit (newMsg (offset))
+	}
+	if ready() != offset - 1 { t.Fatalf("expected to give up on 7 eventually, got %d", ready()) }
+
+	// topics we're not in a group for aren't tracked
+	other := newMsg (1)
+	other.Topic = "other"
+	c.commitStart (other)
+	if len(c.commits) != 1 { t.Fatalf("expected just the one partition tracked, got %d", len(c.commits)) }
+}
@@ -0,0 +1,146 @@
+/** ****************************************************************************************************************** **
+	Publisher confirms
+	The server sends back an ack or error frame for each message we publish with confirm set,
+	so producers know their message was accepted and not just written to the socket
+
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// result of a confirmed publish
+type Confirm struct {
+	Id string // id of the message we published
+	Seq uint64 // sequence number the server gave it, only set when Err is nil
+	Err error // nil if the server accepted the message
+}
+
+type ConfirmCallback = func(*Confirm)
+
+// waiting on the server to confirm a publish
+type pendingConfirm struct {
+	id string // of the message
+	cb ConfirmCallback
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// remembers who wants to know about this publish, by its ref so two publishes with the same id don't collide
+func (this *Client) registerConfirm (ref, id string, cb ConfirmCallback) {
+	this.confirmLock.Lock()
+	defer this.confirmLock.Unlock()
+
+	this.confirms[ref] = &pendingConfirm{ id: id, cb: cb }
+}
+
+// removes the callback without calling it
+func (this *Client) forgetConfirm (ref string) {
+	this.confirmLock.Lock()
+	defer this.confirmLock.Unlock()
+
+	delete(this.confirms, ref)
+}
+
+// calls the callback for this publish, if there is one
+func (this *Client) confirm (ref string, seq uint64, err error) {
+	this.confirmLock.Lock()
+	pending, ok := this.confirms[ref]
+	delete(this.confirms, ref)
+	this.confirmLock.Unlock()
+
+	if ok {
+		pending.cb (&Confirm{ Id: pending.id, Seq: seq, Err: err })
+	} else if err != nil {
+		slog.Warn("QUE: message rejected : " + ref + " : " + err.Error()) // nobody was waiting to hear about it
+	}
+}
+
+// handles an ack or error frame from the server
+func (this *Client) confirmFrame (frame *models.Frame) {
+	if frame.Type == models.FrameAck {
+		this.confirm (frame.Ref, frame.Seq, nil)
+	} else {
+		this.confirm (frame.Ref, 0, errors.New(frame.Error))
+	}
+}
+
+// fails everything still waiting, used when we're shutting down
+func (this *Client) failConfirms (err error) {
+	this.confirmLock.Lock()
+	list := this.confirms
+	this.confirms = make(map[string]*pendingConfirm)
+	this.confirmLock.Unlock()
+
+	for _, pending := range list {
+		pending.cb (&Confirm{ Id: pending.id, Err: err })
+	}
+}
+
+// publishes the message with confirm set, the callback is called once the server has confirmed it
+func (this *Client) publishConfirm (ctx context.Context, msg *models.QueMessage, cb ConfirmCallback) error {
+	msg.Confirm = true
+	if len(msg.Id) == 0 {
+		msg.Id = models.MessageId (msg.Msg)
+	}
+	msg.Ref = models.MessageId (nil) // unique to this call, it's how we match up what the server sends back
+
+	this.registerConfirm (msg.Ref, msg.Id, cb)
+
+	err := this.publish (ctx, msg, true)
+	if err != nil {
+		this.forgetConfirm (msg.Ref) // it never made it in, so nothing will confirm it
+	}
+	return err
+}
+
+// publishes the message and waits until the server has confirmed it
+func (this *Client) publishSync (ctx context.Context, msg *models.QueMessage) (uint64, error) {
+	ch := make(chan *Confirm, 1)
+
+	if err := this.publishConfirm (ctx, msg, func(c *Confirm) { ch <- c }); err != nil { return 0, err }
+
+	select {
+	case c := <-ch:
+		return c.Seq, c.Err
+
+	case <-ctx.Done():
+		this.forgetConfirm (msg.Ref)
+		return 0, errors.WithStack(ctx.Err())
+	}
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// publishes the message and calls the callback once the server has confirmed or rejected it
+// the callback is called from the reader, so don't block in it
+// an error here means the message never made it into our que and the callback won't be called
+func (this *Client) PublishAsync (ctx context.Context, msg []byte, cb ConfirmCallback, opts ...PublishOption) error {
+	return this.publishConfirm (ctx, newMessage (msg, opts), cb)
+}
+
+// publishes the message and waits until the server has confirmed it, returning the sequence number it was given
+func (this *Client) PublishSync (ctx context.Context, msg []byte, opts ...PublishOption) (uint64, error) {
+	return this.publishSync (ctx, newMessage (msg, opts))
+}
+
+// cancels any messages scheduled with WithDelay or WithDeliverAt that have this id and haven't gone out yet
+// returns an error if the server didn't have any
+func (this *Client) Cancel (ctx context.Context, id string) error {
+	msg := &models.QueMessage{ Type: models.FrameCancel, Msg: []byte(id) }
+	msg.Id = models.MessageId (nil) // the cancel is its own request, not the message it's cancelling
+
+	_, err := this.publishSync (ctx, msg)
+	return err
+}
@@ -0,0 +1,24 @@
+package client
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"testing"
+)
+
+func TestQAConfirmRefs (t *testing.T) {
+	client := newTestClient (0)
+
+	// two publishes of the same body get the same id, but each waits on its own ref
+	got := make(map[string]uint64)
+	client.registerConfirm ("ref-1", "same-id", func(c *Confirm) { got["ref-1"] = c.Seq })
+	client.registerConfirm ("ref-2", "same-id", func(c *Confirm) { got["ref-2"] = c.Seq })
+
+	for i, ref := range []string{ "ref-2", "ref-1" } {
+		frame := &models.Frame{ Type: models.FrameAck }
+		frame.Id, frame.Ref, frame.Seq = "same-id", ref, uint64(i + 1)
+		client.confirmFrame (frame)
+	}
+
+	if got["ref-1"] != 2 || got["ref-2"] != 1 || len(client.confirms) != 0 { t.Fatalf("expected each publish to hear back : %v", got) }
+}
@@ -0,0 +1,124 @@
+/** ****************************************************************************************************************** **
+	Credit based flow control, so the server doesn't send us more than we can handle
+	We grant the server credit for so many messages, and give it back as our handler finishes them
+	With workers that's tied to how many messages they can have in flight, Pause and Resume stop and start it by hand
+
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"sync"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type credits struct {
+	window int // messages the server can send ahead of our handler, 0 for no limit
+	lock sync.Mutex
+	paused bool
+	inFlight int // received but our handler isn't done with them yet
+	remaining int // credit the server has left for us
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// sends the server a credit or pause frame, false if we couldn't
+func (this *Client) sendCredit (frameType models.FrameType, credit int) bool {
+	frame := &models.Frame{ Type: frameType }
+	frame.Id = models.MessageId (nil)
+	frame.Credit = credit
+
+	if err := this.writeFrame (frame); err != nil {
+		slog.Warn("QUE: Unable to send credit : " + err.Error())
+		return false
+	}
+	return true
+}
+
+// grants the server enough credit to fill our window again
+// unless force is set we wait until it's worth sending, expects the lock to be held
+func (this *Client) topUp (force bool) {
+	c := this.credits
+	if c.paused || c.window <= 0 { return }
+
+	want := c.window - c.inFlight - c.remaining
+	if want <= 0 { return }
+
+	// batch them up so we're not sending one for every message
+	if force == false && c.remaining > 0 && want < max(1, c.window / 4) { return }
+
+	if this.sendCredit (models.FrameCredit, want) {
+		c.remaining += want
+	}
+}
+
+// a message the server counted against our credit has come in
+func (this *Client) creditReceived () {
+	this.credits.lock.Lock()
+	defer this.credits.lock.Unlock()
+
+	this.credits.inFlight++
+	if this.credits.remaining > 0 {
+		this.credits.remaining--
+	}
+}
+
+// we're done with a message that came in against our credit, so we can take another
+func (this *Client) creditDone () {
+	this.credits.lock.Lock()
+	defer this.credits.lock.Unlock()
+
+	if this.credits.inFlight > 0 {
+		this.credits.inFlight--
+	}
+	this.topUp (false)
+}
+
+// new connections start without any limit, so tell them where we're at
+func (this *Client) creditConnected () {
+	this.credits.lock.Lock()
+	defer this.credits.lock.Unlock()
+
+	this.credits.remaining = 0
+	if this.credits.paused {
+		this.sendCredit (models.FramePause, 0)
+		return
+	}
+	this.topUp (true)
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// the server stops sending us messages until we Resume, it holds on to them for us until then
+// anything we already have still goes to the handler
+func (this *Client) Pause () {
+	this.credits.lock.Lock()
+	defer this.credits.lock.Unlock()
+
+	this.credits.paused = true
+	this.credits.remaining = 0
+	if this.conn.Load() != nil {
+		this.sendCredit (models.FramePause, 0) // if not, we'll let them know when we connect
+	}
+}
+
+// starts the server sending us messages again, with our usual credit or no limit if we don't have one
+func (this *Client) Resume () {
+	this.credits.lock.Lock()
+	defer this.credits.lock.Unlock()
+
+	this.credits.paused = false
+	if this.conn.Load() == nil { return } // we'll sort it out when we connect
+
+	if this.credits.window > 0 {
+		this.topUp (true)
+	} else {
+		this.sendCredit (models.FrameCredit, -1)
+	}
+}
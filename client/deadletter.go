@@ -0,0 +1,67 @@
+/** ****************************************************************************************************************** **
+	Messages we gave up on
+	They're handed to the optional callback and sent to the server's dead letter topic once we can reach it
+
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"fmt"
+	"time"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+const maxPendingDeadLetters = 100 // we hold these in memory, so don't let it grow forever
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type DeadLetterCallback = func(*models.DeadLetter)
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// records that we gave up on the message
+func (this *Client) deadLetter (msg *models.QueMessage, reason string, attempts int) {
+	if this.onDeadLetter != nil {
+		this.onDeadLetter (&models.DeadLetter{
+			Topic: models.DeadLetterTopic (msg.Topic),
+			Message: msg,
+			Reason: reason,
+			Attempts: attempts,
+			FirstAttempt: msg.PublishedAt(),
+			LastAttempt: time.Now(),
+		})
+	}
+
+	frame := &models.Frame{ Type: models.FrameDeadLetter, Envelope: msg.Envelope, Error: reason, Body: msg.Msg }
+	frame.Attempts = attempts
+
+	this.deadLetterLock.Lock()
+	this.deadLetters = append (this.deadLetters, frame)
+	if len(this.deadLetters) > maxPendingDeadLetters {
+		slog.Warn(fmt.Sprintf("QUE: too many pending dead letters, dropping %s", this.deadLetters[0].Id))
+		this.deadLetters = this.deadLetters[1:]
+	}
+	this.deadLetterLock.Unlock()
+
+	this.flushDeadLetters() // in case we're connected
+}
+
+// sends any pending dead letters to the server, keeps whatever we couldn't send
+func (this *Client) flushDeadLetters () {
+	this.deadLetterLock.Lock()
+	defer this.deadLetterLock.Unlock()
+
+	for len(this.deadLetters) > 0 && this.connected() {
+		if err := this.writeFrame (this.deadLetters[0]); err != nil { return } // we'll try again when we re-connect
+		this.deadLetters = this.deadLetters[1:]
+	}
+}
@@ -0,0 +1,198 @@
+/** ****************************************************************************************************************** **
+	Remembers the messages we've already handed to the reader, so redeliveries and reconnect replays get skipped
+	A key is reserved while its handler runs, so a copy arriving at the same time on another worker is skipped too
+
+	The optional file is append only, one key per line, and gets re-written with just what we're remembering
+	once it grows to twice the size of the inbox
+
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/NathanRThomas/k8mq/models"
+
+	"bufio"
+	"container/list"
+	"os"
+	"strings"
+	"sync"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// called with the id and body of a message we skipped because we'd already processed it
+type DuplicateCallback = func(id string, data []byte)
+
+type inbox struct {
+	size int // most keys we'll remember
+
+	lock sync.Mutex
+	keys map[string]*list.Element
+	order *list.List // most recently used first
+	pending map[string]bool // reserved, the handler is still working on them
+
+	path string
+	file *os.File // nil if we're only keeping things in memory
+	lines int // keys written to the file since it was last compacted
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// remembers the key, dropping the least recently used if we're full, expects the lock to be held
+func (this *inbox) add (key string) {
+	if el, ok := this.keys[key]; ok {
+		this.order.MoveToFront(el)
+		return
+	}
+
+	this.keys[key] = this.order.PushFront(key)
+
+	for this.order.Len() > this.size {
+		el := this.order.Back()
+		delete(this.keys, el.Value.(string))
+		this.order.Remove(el)
+	}
+}
+
+// reads in the keys from the file, the newest are at the end
+func (this *inbox) load () error {
+	f, err := os.Open(this.path)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return errors.WithStack(err) }
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); len(key) > 0 {
+			this.add(key)
+		}
+	}
+
+	return errors.WithStack(scanner.Err())
+}
+
+// re-writes the file with only the keys we're remembering, expects the lock to be held
+func (this *inbox) compact () error {
+	if this.file != nil {
+		this.file.Close()
+	}
+
+	var sb strings.Builder
+	for el := this.order.Back(); el != nil; el = el.Prev() { // oldest first, so they load back in the same order
+		sb.WriteString(el.Value.(string) + "\n")
+	}
+
+	if err := models.WriteFileAtomic(this.path, []byte(sb.String())); err != nil { return errors.WithStack(err) }
+
+	var err error
+	this.file, err = os.OpenFile(this.path, os.O_APPEND | os.O_WRONLY, 0600)
+	this.lines = this.order.Len()
+	return errors.WithStack(err)
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// true if we've already processed this key, empty keys are never seen
+func (this *inbox) Has (key string) bool {
+	if this == nil || len(key) == 0 { return false }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	el, ok := this.keys[key]
+	if ok {
+		this.order.MoveToFront(el)
+	}
+	return ok
+}
+
+// checks and claims the key in one go, false if it's already been processed or is being processed right now
+// follow it with Add once it's handled, or Release if it failed and should be tried again
+// empty keys can always be reserved
+func (this *inbox) Reserve (key string) bool {
+	if this == nil || len(key) == 0 { return true }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.pending[key] { return false }
+
+	if el, ok := this.keys[key]; ok {
+		this.order.MoveToFront(el)
+		return false
+	}
+
+	this.pending[key] = true
+	return true
+}
+
+// gives up a reserved key without recording it, so the next copy of the message gets handled
+func (this *inbox) Release (key string) {
+	if this == nil || len(key) == 0 { return }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.pending, key)
+}
+
+// records that we've processed this key, and lets go of its reservation
+func (this *inbox) Add (key string) error {
+	if this == nil || len(key) == 0 { return nil }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.pending, key)
+	this.add(key)
+
+	if this.file == nil { return nil } // memory only
+
+	if this.lines >= this.size * 2 {
+		return this.compact()
+	}
+
+	this.lines++
+	_, err := this.file.WriteString(key + "\n")
+	return errors.WithStack(err)
+}
+
+func (this *inbox) Close () error {
+	if this == nil || this.file == nil { return nil }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	err := this.file.Close()
+	this.file = nil
+	return errors.WithStack(err)
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// creates a new inbox remembering this many keys, the path is optional
+func newInbox (size int, path string) (*inbox, error) {
+	ret := &inbox{
+		size: size,
+		keys: make(map[string]*list.Element),
+		order: list.New(),
+		pending: make(map[string]bool),
+		path: path,
+	}
+
+	if len(path) == 0 { return ret, nil } // memory only
+
+	if err := ret.load(); err != nil { return nil, err }
+
+	ret.lock.Lock()
+	defer ret.lock.Unlock()
+
+	return ret, ret.compact() // start fresh with only what we loaded
+}
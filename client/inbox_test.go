@@ -0,0 +1,70 @@
+
+package client 
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestQAInbox (t *testing.T) {
+	path := filepath.Join (t.TempDir(), "inbox")
+
+	box, err := newInbox (2, path)
+	models.TestingStackTrace (t, err)
+
+	if box.Has ("one") { t.Fatal("haven't seen this one yet") }
+	models.TestingStackTrace (t, box.Add ("one"))
+	models.TestingStackTrace (t, box.Add ("two"))
+	if box.Has ("one") == false { t.Fatal("expected to have seen one") } // this makes two the least recently used
+
+	models.TestingStackTrace (t, box.Add ("three"))
+	if box.Has ("two") { t.Fatal("expected two to have been dropped") }
+
+	// write enough to force a compaction
+	for _, key := range []string{ "four", "five", "six" } {
+		models.TestingStackTrace (t, box.Add (key))
+	}
+	models.TestingStackTrace (t, box.Close())
+
+	// and re-open it like we restarted
+	box, err = newInbox (2, path)
+	models.TestingStackTrace (t, err)
+	if box.Has ("five") == false || box.Has ("six") == false { t.Fatal("expected the newest keys to survive a restart") }
+	if box.Has ("four") { t.Fatal("expected four to have been dropped") }
+	models.TestingStackTrace (t, box.Close())
+
+	// nil inboxes are disabled
+	var disabled *inbox
+	if disabled.Has ("one") || disabled.Add ("one") != nil { t.Fatal("expected a disabled inbox to do nothing") }
+	if disabled.Reserve ("one") == false { t.Fatal("expected a disabled inbox to let everything through") }
+}
+
+func TestQAInboxReserve (t *testing.T) {
+	box, err := newInbox (10, "")
+	models.TestingStackTrace (t, err)
+
+	// only one of the copies arriving together gets through
+	passed := make(chan bool, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if box.Reserve ("one") { passed <- true }
+		}()
+	}
+	wg.Wait()
+	if len(passed) != 1 { t.Fatalf("expected one reservation, got %d", len(passed)) }
+
+	// a failed handler lets it go, so it can be tried again
+	box.Release ("one")
+	if box.Reserve ("one") == false { t.Fatal("expected to reserve it again once released") }
+
+	// once it's handled it stays skipped
+	models.TestingStackTrace (t, box.Add ("one"))
+	if box.Reserve ("one") { t.Fatal("expected a processed key to be skipped") }
+	if box.Reserve ("") == false { t.Fatal("empty keys always go through") }
+}
@@ -0,0 +1,169 @@
+/** ****************************************************************************************************************** **
+	Optional settings for the client
+	
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"time"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// everything here is optional, the zero value gives you the same client as NewClient
+type Options struct {
+	// how we identify ourselves to the server, the server makes up an id for us if ClientId isn't set
+	// the id is what other clients use to send to just us, so it should be unique
+	ClientId string
+	Pod string // defaults to the hostname, which is the pod name in k8
+	Service string
+	Labels map[string]string
+
+	// when set, the server doesn't send our own broadcasts back to us, WithNoEcho does the same for a single message
+	NoEcho bool
+
+	// called with each client that joins or leaves the server, setting this is how we ask for the events
+	OnPresence PresenceCallback
+
+	// newer alternative to the reader, it sees everything about the message and returning an error nacks it
+	Handler models.Handler
+
+	// when set, messages we can't get to the server are spooled here and flushed in order once we reconnect
+	OutboxDir string
+	OutboxMaxBytes int64 // 0 for no limit
+	OutboxMaxAge time.Duration // spooled messages older than this are dropped, 0 for no limit
+	OutboxPolicy OutboxPolicy // what to do when we hit OutboxMaxBytes
+
+	// when set, we remember the ids of this many messages we've handed to the reader and skip them if they show up again
+	InboxSize int
+	InboxFile string // optional, so the inbox survives a restart
+	OnDuplicate DuplicateCallback // optional, called for each message we skip
+
+	// when set, this many workers run the handler so a slow one doesn't hold up reading, otherwise it's run as we read
+	Workers int
+	WorkerOrder WorkerOrder // keeps messages with the same key or topic in order
+	MaxInFlight int // most messages waiting on or running in a worker before we stop reading, defaults to Workers
+
+	// messages the server can send ahead of our handler, it holds on to the rest until we've caught up
+	// defaults to MaxInFlight when we have Workers, otherwise there's no limit. negative for no limit either way
+	Credit int
+
+	// times a lower priority message can be passed over by higher ones before it goes out anyway
+	PriorityStarve int // defaults to models.DefaultPriorityStarve
+
+	// how often we commit what our handler has finished, for consumer groups that commit automatically
+	CommitInterval time.Duration // defaults to DefaultCommitInterval
+
+	// called for each message we give up on, they're also sent to the server's dead letter topic once we can reach it
+	OnDeadLetter DeadLetterCallback
+}
+
+// optional settings for a single published message
+type PublishOption = func(*models.QueMessage)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// the message is dropped instead of delivered if it's still waiting to go out after this long
+func WithTTL (ttl time.Duration) PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.SetTTL(ttl)
+	}
+}
+
+// publishes the message on this topic instead of the default one
+func WithTopic (topic string) PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.Topic = topic
+	}
+}
+
+// sets the key of the message, used to keep related messages in order
+func WithKey (key string) PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.Key = key
+	}
+}
+
+// sends the message to just the client with this id, the server sends back an error if they're not connected
+func WithTo (clientId string) PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.To = clientId
+	}
+}
+
+// sends the message to just the clients with labels matching the selector, eg app=billing,zone in (a,b)
+func WithSelector (selector string) PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.Selector = selector
+	}
+}
+
+// the server doesn't send this message back to us
+func WithNoEcho () PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.NoEcho = true
+	}
+}
+
+// the server keeps this as the last value for the topic and sends it to anyone who subscribes later
+// publishing an empty retained message clears it
+func WithRetain () PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.Retain = true
+	}
+}
+
+// adds a header that travels with the message
+func WithHeader (key, value string) PublishOption {
+	return func(msg *models.QueMessage) {
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[key] = value
+	}
+}
+
+// sets the id of the message instead of using the IdHash from the body, or generating one
+// this is the id you'd pass to Cancel for a scheduled message
+// the server only drops a retry as a duplicate if it has the same id, and otherwise each Publish gets a new one
+func WithId (id string) PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.Id = id
+	}
+}
+
+// higher priority messages go out ahead of the rest, from our queue and the server's
+// eg PriorityUrgent for control messages that shouldn't wait behind bulk traffic
+func WithPriority (priority models.Priority) PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.Priority = priority
+	}
+}
+
+// the server holds on to the message and delivers it after this delay
+func WithDelay (delay time.Duration) PublishOption {
+	return WithDeliverAt (time.Now().Add(delay))
+}
+
+// the server holds on to the message and delivers it at this time
+func WithDeliverAt (tm time.Time) PublishOption {
+	return func(msg *models.QueMessage) {
+		msg.DeliverAt = tm.UnixMilli()
+	}
+}
+
+// creates the message with any of the options applied
+func newMessage (msg []byte, opts []PublishOption) *models.QueMessage {
+	ret := &models.QueMessage{ Msg: msg }
+	for _, opt := range opts {
+		opt(ret)
+	}
+	return ret
+}
@@ -0,0 +1,327 @@
+/** ****************************************************************************************************************** **
+	On-disk outbox for messages we couldn't get to the k8mq server
+
+	Each message is its own file in the outbox directory, named by an increasing sequence number
+	so we can always flush them back out in the order they were spooled
+	Higher priority messages are flushed ahead of the rest, lower ones still get a turn every so often
+
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/NathanRThomas/k8mq/models"
+
+	"fmt"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// what to do with a new message when the outbox is full
+type OutboxPolicy int
+
+const (
+	OutboxDropOldest	OutboxPolicy = iota // default, make room by dropping the oldest spooled messages
+	OutboxDropNewest 						// keep what we have and drop the new message
+	OutboxBlock 							// wait until there's room, or we're shutting down
+)
+
+const outboxExt = ".msg"
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// what actually gets written to disk
+type outboxRecord struct {
+	Created time.Time
+	Msg *models.QueMessage
+}
+
+type outboxEntry struct {
+	seq uint64
+	size int64
+	created time.Time
+	priority models.Priority
+	key string // its order key, the ones sharing one go out oldest first whatever their priority
+}
+
+type outbox struct {
+	dir string
+	maxBytes int64
+	maxAge time.Duration
+	policy OutboxPolicy
+
+	lock sync.Mutex
+	entries []outboxEntry // oldest first
+	bytes int64
+	seq uint64 // last sequence number used
+
+	picker models.PriorityPicker
+	peeked uint64 // sequence number of what Peek returned, so Pop removes the same one
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+func (this *outbox) fileName (seq uint64) string {
+	return filepath.Join(this.dir, fmt.Sprintf("%020d%s", seq, outboxExt))
+}
+
+// loads anything left over from a previous run
+func (this *outbox) load () error {
+	files, err := os.ReadDir(this.dir)
+	if err != nil { return errors.WithStack(err) }
+
+	for _, f := range files {
+		if f.IsDir() || strings.HasSuffix(f.Name(), outboxExt) == false { continue }
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), outboxExt), 10, 64)
+		if err != nil { continue } // not one of ours
+
+		info, err := f.Info()
+		if err != nil { return errors.WithStack(err) }
+
+		// we need the priority to know when it goes out, anything we can't read is dropped once we get to it
+		priority, key := models.PriorityNormal, ""
+		if data, err := os.ReadFile(this.fileName(seq)); err == nil {
+			rec := &outboxRecord{}
+			if json.Unmarshal(data, rec) == nil && rec.Msg != nil {
+				priority, key = rec.Msg.Priority.Clamp(), rec.Msg.OrderKey()
+			}
+		}
+
+		this.entries = append(this.entries, outboxEntry{ seq: seq, size: info.Size(), created: info.ModTime(), priority: priority, key: key })
+		this.bytes += info.Size()
+		if seq > this.seq { this.seq = seq }
+	}
+
+	sort.Slice(this.entries, func(i, j int) bool { return this.entries[i].seq < this.entries[j].seq })
+	return nil
+}
+
+// removes the entry at this index, expects the lock to be held
+func (this *outbox) drop (i int) {
+	if i < 0 || i >= len(this.entries) { return }
+
+	os.Remove(this.fileName(this.entries[i].seq))
+	this.bytes -= this.entries[i].size
+	if this.entries[i].seq == this.peeked {
+		this.peeked = 0
+	}
+
+	if i == 0 {
+		this.entries = this.entries[1:]
+	} else {
+		this.entries = append(this.entries[:i], this.entries[i + 1:]...)
+	}
+}
+
+// removes the oldest entry, expects the lock to be held
+func (this *outbox) dropOldest () {
+	this.drop (0)
+}
+
+// index of the entry that goes out next, the oldest of the highest priority unless a lower one's waited long enough
+// or an older one has the same key. sticks with the same one until it's popped. -1 if we're empty, expects the lock to be held
+func (this *outbox) next () int {
+	if this.peeked > 0 {
+		for i := range this.entries {
+			if this.entries[i].seq == this.peeked { return i }
+		}
+	}
+
+	p, ok := this.picker.Next(func(p models.Priority) bool {
+		for i := range this.entries {
+			if this.entries[i].priority == p { return true }
+		}
+		return false
+	})
+	if ok == false { return -1 }
+
+	for i := range this.entries {
+		if this.entries[i].priority == p {
+			// the oldest with the same key goes first, they're oldest first so that's the first we find
+			if len(this.entries[i].key) > 0 {
+				for j := 0; j < i; j++ {
+					if this.entries[j].key == this.entries[i].key {
+						i = j
+						break
+					}
+				}
+			}
+
+			this.peeked = this.entries[i].seq
+			return i
+		}
+	}
+	return -1
+}
+
+// drops anything that's been sitting around too long, expects the lock to be held
+func (this *outbox) expire () {
+	if this.maxAge <= 0 { return }
+
+	for len(this.entries) > 0 && time.Since(this.entries[0].created) > this.maxAge {
+		slog.Warn(fmt.Sprintf("QUE: outbox message %d expired", this.entries[0].seq))
+		this.dropOldest()
+	}
+}
+
+// writes the file and syncs it, along with the directory, so it's there after a crash
+func (this *outbox) write (name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_CREATE | os.O_WRONLY | os.O_TRUNC, 0600)
+	if err != nil { return errors.WithStack(err) }
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return errors.WithStack(err)
+	}
+
+	// the file's there either way, this just makes sure the directory knows about it
+	if dir, err := os.Open(this.dir); err == nil {
+		if err = dir.Sync(); err != nil {
+			slog.Warn("QUE: unable to sync the outbox directory : " + err.Error())
+		}
+		dir.Close()
+	}
+	return nil
+}
+
+// checks if we can fit this many bytes, expects the lock to be held
+func (this *outbox) fits (size int64) bool {
+	return this.maxBytes <= 0 || this.bytes + size <= this.maxBytes
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// number of messages spooled
+func (this *outbox) Len () int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return len(this.entries)
+}
+
+// writes the message to disk, following our policy if we're full
+// only returns an error if the message wasn't spooled
+func (this *outbox) Push (ctx context.Context, msg *models.QueMessage) error {
+	data, err := json.Marshal(&outboxRecord{ Created: time.Now(), Msg: msg })
+	if err != nil { return errors.WithStack(err) }
+
+	size := int64(len(data))
+	if this.maxBytes > 0 && size > this.maxBytes {
+		return errors.Errorf("message of %d bytes is larger than the outbox", size)
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.expire()
+
+	for this.fits(size) == false {
+		switch this.policy {
+		case OutboxDropNewest:
+			return errors.Errorf("outbox full")
+
+		case OutboxBlock:
+			// let the flusher make some room
+			this.lock.Unlock()
+			select {
+			case <-ctx.Done():
+				this.lock.Lock()
+				return errors.Errorf("outbox full")
+			case <-time.After(time.Millisecond * 100):
+			}
+			this.lock.Lock()
+			this.expire()
+
+		default:
+			slog.Warn(fmt.Sprintf("QUE: outbox full, dropping message %d", this.entries[0].seq))
+			this.dropOldest()
+		}
+	}
+
+	this.seq++
+	if err = this.write (this.fileName(this.seq), data); err != nil { return err }
+
+	this.entries = append(this.entries, outboxEntry{ seq: this.seq, size: size, created: time.Now(), priority: msg.Priority.Clamp(), key: msg.OrderKey() })
+	this.bytes += size
+	return nil
+}
+
+// returns the next message to send without removing it, and its sequence number to pop it with
+// nil if the outbox is empty
+func (this *outbox) Peek () (*models.QueMessage, uint64, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.expire()
+
+	for i := this.next(); i >= 0; i = this.next() {
+		data, err := os.ReadFile(this.fileName(this.entries[i].seq))
+		if err == nil {
+			rec := &outboxRecord{}
+			err = json.Unmarshal(data, rec)
+			if err == nil && rec.Msg != nil { return rec.Msg, this.entries[i].seq, nil }
+		}
+
+		// we can't do anything with this file, so get it out of the way
+		slog.Warn(fmt.Sprintf("QUE: dropping unreadable outbox message %d", this.entries[i].seq))
+		this.drop (i)
+	}
+
+	return nil, 0, nil // nothing here
+}
+
+// removes the message Peek returned, call this once it's been sent
+// it may have been dropped since, to make room, in which case there's nothing to do
+func (this *outbox) Pop (seq uint64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for i := range this.entries {
+		if this.entries[i].seq == seq {
+			this.drop (i)
+			return
+		}
+	}
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// opens the outbox in this directory, creating it if needed, and picks up anything left from before
+func newOutbox (dir string, maxBytes int64, maxAge time.Duration, policy OutboxPolicy) (*outbox, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil { return nil, errors.WithStack(err) }
+
+	ret := &outbox{
+		dir: dir,
+		maxBytes: maxBytes,
+		maxAge: maxAge,
+		policy: policy,
+	}
+
+	return ret, ret.load()
+}
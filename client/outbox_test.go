@@ -0,0 +1,142 @@
+
+package client 
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQAOutbox (t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	box, err := newOutbox (dir, 0, 0, OutboxDropOldest)
+	models.TestingStackTrace (t, err)
+
+	for _, m := range []string{ "one", "two", "three" } {
+		models.TestingStackTrace (t, box.Push (ctx, &models.QueMessage{ Msg: []byte(m) }))
+	}
+
+	// re-open it, like we restarted, and make sure things come back in order
+	box, err = newOutbox (dir, 0, 0, OutboxDropOldest)
+	models.TestingStackTrace (t, err)
+
+	if box.Len() != 3 { t.Fatalf("expected 3 messages, got %d", box.Len()) }
+
+	for _, m := range []string{ "one", "two", "three" } {
+		msg, seq, err := box.Peek()
+		models.TestingStackTrace (t, err)
+		if msg == nil || string(msg.Msg) != m { t.Fatalf("expected %s, got %v", m, msg) }
+		box.Pop (seq)
+	}
+
+	msg, _, err := box.Peek()
+	models.TestingStackTrace (t, err)
+	if msg != nil { t.Fatalf("expected an empty outbox") }
+}
+
+func TestQAOutboxPolicy (t *testing.T) {
+	ctx := context.Background()
+	msg := &models.QueMessage{ Msg: []byte("hello world") }
+
+	// find out how big one of our records is
+	box, err := newOutbox (t.TempDir(), 0, 0, OutboxDropOldest)
+	models.TestingStackTrace (t, err)
+	models.TestingStackTrace (t, box.Push (ctx, msg))
+	size := box.bytes 
+
+	// room for 2, with a little slack as the created time isn't always the same length
+	box, err = newOutbox (t.TempDir(), size * 2 + 16, 0, OutboxDropNewest)
+	models.TestingStackTrace (t, err)
+
+	models.TestingStackTrace (t, box.Push (ctx, msg))
+	models.TestingStackTrace (t, box.Push (ctx, msg))
+	if box.Push (ctx, msg) == nil { t.Fatal("expected the outbox to be full") }
+	if box.Len() != 2 { t.Fatalf("expected 2 messages, got %d", box.Len()) }
+
+	box.policy = OutboxDropOldest
+	first := box.entries[0].seq
+	models.TestingStackTrace (t, box.Push (ctx, msg))
+	if box.Len() != 2 || box.entries[0].seq == first { t.Fatal("expected the oldest message to be dropped") }
+
+	// dropping the one being sent doesn't mean popping takes out another
+	_, sending, err := box.Peek()
+	models.TestingStackTrace (t, err)
+	models.TestingStackTrace (t, box.Push (ctx, msg))
+	box.Pop (sending)
+	if box.Len() != 2 { t.Fatalf("expected popping a dropped message to leave the others, got %d", box.Len()) }
+
+	// blocking gives up when the context does
+	box.policy = OutboxBlock
+	ctx, cancel := context.WithTimeout (ctx, time.Millisecond * 200)
+	defer cancel()
+	if box.Push (ctx, msg) == nil { t.Fatal("expected the blocked push to time out") }
+
+	// and age
+	box, err = newOutbox (t.TempDir(), 0, time.Millisecond, OutboxDropOldest)
+	models.TestingStackTrace (t, err)
+	models.TestingStackTrace (t, box.Push (context.Background(), msg))
+	time.Sleep(time.Millisecond * 5)
+	if m, _, _ := box.Peek(); m != nil { t.Fatal("expected the message to expire") }
+}
+
+func TestQAOutboxPriority (t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	box, err := newOutbox (dir, 0, 0, OutboxDropOldest)
+	models.TestingStackTrace (t, err)
+
+	for _, m := range []string{ "bulk-1", "flush", "bulk-2", "order" } {
+		msg := &models.QueMessage{ Msg: []byte(m) }
+		switch m {
+		case "flush":
+			msg.Priority = models.PriorityUrgent
+		case "order":
+			msg.Priority = models.PriorityNormal
+		default:
+			msg.Priority = models.PriorityLow
+		}
+		models.TestingStackTrace (t, box.Push (ctx, msg))
+	}
+
+	// priorities survive a restart
+	box, err = newOutbox (dir, 0, 0, OutboxDropOldest)
+	models.TestingStackTrace (t, err)
+
+	for _, m := range []string{ "flush", "order", "bulk-1", "bulk-2" } {
+		msg, seq, err := box.Peek()
+		models.TestingStackTrace (t, err)
+		if again, _, _ := box.Peek(); msg == nil || string(msg.Msg) != m || string(again.Msg) != m { t.Fatalf("expected %s, got %v", m, msg) }
+		box.Pop (seq)
+	}
+	if box.Len() != 0 { t.Fatalf("expected an empty outbox") }
+}
+
+func TestQAOutboxKeyOrder (t *testing.T) {
+	ctx := context.Background()
+
+	box, err := newOutbox (t.TempDir(), 0, 0, OutboxDropOldest)
+	models.TestingStackTrace (t, err)
+
+	// priority only gets ahead of messages with a different key
+	push := func (body, key string, p models.Priority) {
+		msg := &models.QueMessage{ Msg: []byte(body) }
+		msg.Key, msg.Priority = key, p
+		models.TestingStackTrace (t, box.Push (ctx, msg))
+	}
+	push ("bulk-a", "a", models.PriorityLow)
+	push ("bulk-b", "b", models.PriorityLow)
+	push ("urgent-a", "a", models.PriorityUrgent)
+	push ("urgent-c", "c", models.PriorityUrgent)
+
+	for _, m := range []string{ "bulk-a", "urgent-a", "urgent-c", "bulk-b" } {
+		msg, seq, err := box.Peek()
+		models.TestingStackTrace (t, err)
+		if msg == nil || string(msg.Msg) != m { t.Fatalf("expected %s, got %v", m, msg) }
+		box.Pop (seq)
+	}
+}
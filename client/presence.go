@@ -0,0 +1,50 @@
+/** ****************************************************************************************************************** **
+	Presence, who else is connected to the server
+	
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// called with each join or leave event, from the reader so don't block in it
+type PresenceCallback = func(*models.PresenceEvent)
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// hands a join or leave event to the callback
+func (this *Client) presence (msg *models.Message) {
+	if this.onPresence == nil { return }
+
+	event := &models.PresenceEvent{}
+	if err := json.Unmarshal(msg.Body, event); err != nil {
+		slog.Warn("QUE: invalid presence event : " + err.Error())
+		return
+	}
+
+	this.onPresence(event)
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// everyone connected to the server right now, including us
+func (this *Client) Members (ctx context.Context) ([]models.Member, error) {
+	reply, err := this.request (ctx, &models.QueMessage{ Type: models.FramePresence })
+	if err != nil { return nil, err }
+
+	ret := make([]models.Member, 0)
+	if err = json.Unmarshal(reply.Body, &ret); err != nil { return nil, errors.WithStack(err) }
+	return ret, nil
+}
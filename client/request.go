@@ -0,0 +1,90 @@
+/** ****************************************************************************************************************** **
+	Request / reply
+	We publish a message and wait for the reply, which the server routes back to just us with reply_to set
+	to the id of our request
+
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/pkg/errors"
+
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+)
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// hands the reply to whoever's waiting on it, returns false if nobody is
+func (this *Client) replied (msg *models.Message) bool {
+	if len(msg.ReplyTo) == 0 { return false }
+
+	this.requestLock.Lock()
+	ch, ok := this.requests[msg.ReplyTo]
+	delete(this.requests, msg.ReplyTo)
+	this.requestLock.Unlock()
+
+	if ok {
+		ch <- msg // buffered, so this never blocks
+	}
+	return ok
+}
+
+// reply handle for a message we received, sends the reply to just whoever published it
+func (this *Client) replier (msg *models.Message) models.ReplyFunc {
+	if len(msg.Sender) == 0 { return nil }
+
+	return func(ctx context.Context, body []byte) error {
+		return this.Publish (ctx, body, WithTo (msg.Sender), func(reply *models.QueMessage) {
+			reply.Topic = msg.Topic
+			reply.ReplyTo = msg.Id
+		})
+	}
+}
+
+func (this *Client) forgetRequest (id string) {
+	this.requestLock.Lock()
+	defer this.requestLock.Unlock()
+
+	delete(this.requests, id)
+}
+
+// publishes the message and waits for the reply to it
+func (this *Client) request (ctx context.Context, req *models.QueMessage) (*models.Message, error) {
+	if len(req.Id) == 0 {
+		req.Id = models.MessageId (req.Msg) // we need the id up front so we know which reply is ours
+	}
+
+	ch := make(chan *models.Message, 1)
+	this.requestLock.Lock()
+	this.requests[req.Id] = ch
+	this.requestLock.Unlock()
+
+	if err := this.publish (ctx, req, true); err != nil {
+		this.forgetRequest (req.Id)
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		return reply, nil
+
+	case <-this.closed:
+		this.forgetRequest (req.Id)
+		return nil, ErrClosed
+
+	case <-ctx.Done():
+		this.forgetRequest (req.Id)
+		return nil, errors.WithStack(ctx.Err())
+	}
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// publishes the message and waits for a reply, eg from a server handler calling msg.Reply
+// the reply only comes back to us, so it isn't seen by anyone else
+func (this *Client) Request (ctx context.Context, msg []byte, opts ...PublishOption) (*models.Message, error) {
+	return this.request (ctx, newMessage (msg, opts))
+}
@@ -0,0 +1,179 @@
+/** ****************************************************************************************************************** **
+	Topic subscriptions
+	Until we subscribe to something the server sends us everything, after that it's only the topics we're subscribed to
+	We remember them so they can be sent again when we re-connect, and if we asked for history we pick up
+	from the last offset we saw
+
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+	"time"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// how we subscribed to a topic
+type subscription struct {
+	replay *models.Replay // any history we asked for, nil if we didn't
+	group string // consumer group, empty if we get everything
+	manual bool // we commit the group's offsets ourselves
+	partitions int // how many the topic should have, 0 to leave it to the server
+}
+
+// changes how we subscribe to a topic, eg asking the server to replay some of its history before the live messages
+type SubscribeOption = func(*subscription)
+
+//----- OPTIONS -----------------------------------------------------------------------------------------------------//
+
+// the history we're asking for, creating it if we have to
+func (this *subscription) history () *models.Replay {
+	if this.replay == nil {
+		this.replay = &models.Replay{}
+	}
+	return this.replay
+}
+
+// replays the last n messages on the topic
+func WithReplayLast (n int) SubscribeOption {
+	return func(sub *subscription) {
+		sub.history().Last = n
+	}
+}
+
+// replays everything that went out on the topic since this time
+func WithReplaySince (tm time.Time) SubscribeOption {
+	return func(sub *subscription) {
+		sub.history().Since = tm.UnixMilli()
+	}
+}
+
+// replays everything on the topic from this offset on
+func WithReplayFrom (offset uint64) SubscribeOption {
+	return func(sub *subscription) {
+		sub.history().From = offset
+	}
+}
+
+// joins the consumer group for the topic, the members share its partitions instead of each getting everything
+// each partition goes to just one member at a time, so messages with the same key come in order
+// the group's offsets are committed as our handler finishes each message, and a member picking up a partition
+// gets anything after the last commit first. different groups each get every message
+func WithGroup (name string) SubscribeOption {
+	return func(sub *subscription) {
+		sub.group = name
+	}
+}
+
+// declares how many partitions the topic has, if the server doesn't have a count for it yet
+// the subscribe fails if it already has a different one. without this, or --partitions on the server, a topic has one
+func WithPartitions (n int) SubscribeOption {
+	return func(sub *subscription) {
+		sub.partitions = n
+	}
+}
+
+// work queue mode, the same as joining the default consumer group
+func WithQueue () SubscribeOption {
+	return WithGroup (models.DefaultGroup)
+}
+
+// we commit the group's offsets ourselves with Commit, instead of as our handler finishes each message
+func WithManualCommit () SubscribeOption {
+	return func(sub *subscription) {
+		sub.manual = true
+	}
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// re-sends our subscriptions, for when we've just connected to a server that doesn't know about them
+func (this *Client) resubscribe () {
+	this.topicLock.Lock()
+	frames := make([]*models.Frame, 0, len(this.topics))
+	for topic, sub := range this.topics {
+		frame := &models.Frame{ Type: models.FrameSubscribe }
+		frame.Id = models.MessageId (nil)
+		frame.Topic = topic
+		frame.Replay = sub.replay
+		frame.Group = sub.group
+		frame.Partitions = sub.partitions
+
+		if sub.replay != nil && this.offsets[topic] > 0 {
+			frame.Replay = &models.Replay{ From: this.offsets[topic] + 1 } // pick up where we left off
+		}
+		frames = append(frames, frame)
+	}
+	this.topicLock.Unlock()
+
+	for _, frame := range frames {
+		if err := this.writeFrame (frame); err != nil {
+			slog.Warn("QUE: Unable to re-subscribe to " + frame.Topic + " : " + err.Error()) // we'll try again on the next connect
+			return
+		}
+	}
+}
+
+// remembers the last offset we've seen on the topic
+func (this *Client) seen (msg *models.Message) {
+	if msg.Offset == 0 { return }
+
+	topic := models.TopicName (msg.Topic)
+
+	this.topicLock.Lock()
+	defer this.topicLock.Unlock()
+
+	if msg.Offset > this.offsets[topic] {
+		this.offsets[topic] = msg.Offset
+	}
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// from now on the server only sends us messages on the topics we've subscribed to
+// any history we asked for comes first, otherwise the retained message for the topic if there is one
+// in a group we only get the partitions we're assigned, and they may move as other members come and go
+// this returns once all of that has been sent
+func (this *Client) Subscribe (ctx context.Context, topic string, opts ...SubscribeOption) error {
+	topic = models.TopicName (topic)
+
+	sub := &subscription{}
+	for _, opt := range opts {
+		opt(sub)
+	}
+
+	this.topicLock.Lock()
+	this.topics[topic] = sub
+	this.topicLock.Unlock()
+
+	msg := &models.QueMessage{ Type: models.FrameSubscribe }
+	msg.Topic = topic
+	msg.Replay = sub.replay
+	msg.Group = sub.group
+	msg.Partitions = sub.partitions
+
+	_, err := this.publishSync (ctx, msg)
+	return err
+}
+
+// stops the server sending us messages on this topic
+func (this *Client) Unsubscribe (ctx context.Context, topic string) error {
+	topic = models.TopicName (topic)
+
+	this.topicLock.Lock()
+	delete(this.topics, topic)
+	this.topicLock.Unlock()
+
+	msg := &models.QueMessage{ Type: models.FrameUnsubscribe }
+	msg.Topic = topic
+
+	_, err := this.publishSync (ctx, msg)
+	return err
+}
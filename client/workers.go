@@ -0,0 +1,158 @@
+/** ****************************************************************************************************************** **
+	Pool of workers that run the handler, so a slow handler doesn't stall reading from the server
+
+	Messages can keep their order per key or topic by always going to the same worker
+	The number of messages waiting on, or running in, a worker is capped so the read side backs up instead of us
+
+** ****************************************************************************************************************** **/
+
+package client
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// how messages are spread across the workers
+type WorkerOrder int
+
+const (
+	OrderNone		WorkerOrder = iota // any worker can take any message, so there's no ordering
+	OrderByKey		// messages with the same key are handled in order, one at a time
+	OrderByTopic	// messages on the same topic are handled in order, one at a time
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type workItem struct {
+	msg *models.Message
+	nackable bool
+}
+
+type workers struct {
+	handle func(*models.Message, bool)
+	order WorkerOrder
+
+	lanes []chan *workItem // one per worker when we're ordering things, otherwise a single shared one
+	next atomic.Uint64 // for spreading messages without a key
+	slots chan bool // one for each message in flight, this is what applies the backpressure
+
+	lock sync.RWMutex // write locked while we close the lanes
+	closed bool
+	done chan bool // closed once we stop taking messages, wakes anything waiting on a slot
+	wg sync.WaitGroup
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+func (this *workers) run (lane chan *workItem) {
+	defer this.wg.Done()
+
+	for item := range lane {
+		this.handle(item.msg, item.nackable)
+		<-this.slots // free up room for the next one
+	}
+}
+
+// which lane this message goes to, the same key always ends up in the same one
+func (this *workers) lane (msg *models.Message) chan *workItem {
+	if len(this.lanes) == 1 { return this.lanes[0] }
+
+	key := msg.Key
+	if this.order == OrderByTopic {
+		key = models.TopicName(msg.Topic)
+	}
+
+	if len(key) == 0 {
+		return this.lanes[this.next.Add(1) % uint64(len(this.lanes))] // nothing to keep in order with
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return this.lanes[h.Sum32() % uint32(len(this.lanes))]
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// queues the message for a worker, blocking while we're at our in flight limit
+// returns false if we've been closed and the message wasn't taken
+func (this *workers) Dispatch (msg *models.Message, nackable bool) bool {
+	select {
+	case this.slots <- true:
+	case <-this.done:
+		return false
+	}
+
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+
+	if this.closed {
+		<-this.slots
+		return false
+	}
+
+	this.lane(msg) <- &workItem{ msg: msg, nackable: nackable } // the lanes have room for every slot, so this never blocks
+	return true
+}
+
+// stops taking new messages and waits for the workers to finish what they already have
+func (this *workers) Close () {
+	if this == nil { return }
+
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return
+	}
+
+	this.closed = true
+	close(this.done)
+	for _, lane := range this.lanes {
+		close(lane)
+	}
+	this.lock.Unlock()
+
+	this.wg.Wait()
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// starts count workers calling handle, with at most maxInFlight messages waiting or running
+func newWorkers (count, maxInFlight int, order WorkerOrder, handle func(*models.Message, bool)) *workers {
+	if maxInFlight < count { maxInFlight = count } // otherwise some of the workers would never have anything to do
+
+	ret := &workers{
+		handle: handle,
+		order: order,
+		slots: make(chan bool, maxInFlight),
+		done: make(chan bool),
+	}
+
+	lanes := 1
+	if order != OrderNone {
+		lanes = count
+	}
+
+	for i := 0; i < lanes; i++ {
+		ret.lanes = append(ret.lanes, make(chan *workItem, maxInFlight))
+	}
+
+	// when we're not ordering, everyone pulls from the same lane
+	for i := 0; i < count; i++ {
+		ret.wg.Add(1)
+		go ret.run(ret.lanes[i % lanes])
+	}
+
+	return ret
+}
@@ -0,0 +1,79 @@
+package client 
+
+import (
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestQAWorkers (t *testing.T) {
+	// messages with the same key have to come out in the order they went in
+	lock := sync.Mutex{}
+	seen := make(map[string][]int)
+
+	pool := newWorkers (4, 8, OrderByKey, func(msg *models.Message, nackable bool) {
+		time.Sleep(time.Millisecond) // give the other workers a chance to get ahead
+		lock.Lock()
+		seen[msg.Key] = append(seen[msg.Key], int(msg.Seq))
+		lock.Unlock()
+	})
+
+	for i := 1; i <= 50; i++ {
+		msg := &models.Message{}
+		msg.Key = fmt.Sprintf("key-%d", i % 3)
+		msg.Seq = uint64(i)
+		if pool.Dispatch (msg, true) == false { t.Fatal("expected the message to be taken") }
+	}
+	pool.Close()
+
+	total := 0
+	for key, list := range seen {
+		total += len(list)
+		for i := 1; i < len(list); i++ {
+			if list[i] < list[i - 1] { t.Fatalf("%s out of order : %v", key, list) }
+		}
+	}
+	if total != 50 { t.Fatalf("expected every message to be handled : %d", total) }
+
+	if pool.Dispatch (&models.Message{}, true) { t.Fatal("expected a closed pool to refuse messages") }
+
+	// we stop taking messages once we're at our in flight limit
+	release := make(chan bool)
+	var running atomic.Int32
+	pool = newWorkers (2, 3, OrderNone, func(msg *models.Message, nackable bool) {
+		running.Add(1)
+		<-release
+	})
+
+	for i := 0; i < 3; i++ {
+		pool.Dispatch (&models.Message{}, true)
+	}
+
+	taken := make(chan bool)
+	go func() { taken <- pool.Dispatch (&models.Message{}, true) }()
+
+	select {
+	case <-taken:
+		t.Fatal("expected the dispatch to block while we're full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	if <-taken == false { t.Fatal("expected the dispatch to go through once there was room") }
+	pool.Close()
+	if running.Load() != 4 { t.Fatalf("expected 4 messages to be handled : %d", running.Load()) }
+}
+
+func TestQAHandlerPanic (t *testing.T) {
+	c := newTestClient (0)
+	c.handler = func(ctx context.Context, msg *models.Message) error {
+		panic("boom")
+	}
+
+	if err := c.callHandler (&models.Message{}); err == nil { t.Fatal("expected the panic to come back as an error") }
+}
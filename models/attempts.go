@@ -0,0 +1,101 @@
+/** ****************************************************************************************************************** **
+	Counts the times clients have failed each message, so a client can't reset it by what it sends back in the nack
+	Messages we haven't heard about in a while are forgotten, most are handled fine on their next try
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type attempt struct {
+	count int
+	last time.Time
+}
+
+type Attempts struct {
+	window time.Duration // how long after its last failure we remember a message
+
+	lock sync.Mutex
+	counts map[string]*attempt
+	pruned time.Time
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// forgets anything we haven't heard about within our window, expects the lock to be held
+func (this *Attempts) prune (now time.Time) {
+	if now.Sub(this.pruned) < this.window { return } // no need to walk the map every time
+	this.pruned = now
+
+	for key, a := range this.counts {
+		if now.Sub(a.last) > this.window {
+			delete(this.counts, key)
+		}
+	}
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// records another failure for the message, returning how many times it's failed now
+func (this *Attempts) Fail (msg *QueMessage) int {
+	now := time.Now()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.prune(now)
+
+	key := AttemptKey(msg)
+	a, ok := this.counts[key]
+	if ok == false {
+		a = &attempt{}
+		this.counts[key] = a
+	}
+
+	a.count++
+	a.last = now
+	return a.count
+}
+
+// forgets the message, eg once it's dead lettered
+func (this *Attempts) Done (msg *QueMessage) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.counts, AttemptKey(msg))
+}
+
+func (this *Attempts) Len () int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return len(this.counts)
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// what we count a message's failures under, its sequence number if it has one as ids can repeat
+func AttemptKey (msg *QueMessage) string {
+	if msg.Seq > 0 { return fmt.Sprint(msg.Seq) }
+	return "id:" + msg.Id
+}
+
+// window is how long after its last failure we remember a message
+func NewAttempts (window time.Duration) *Attempts {
+	return &Attempts{
+		window: window,
+		counts: make(map[string]*attempt),
+		pruned: time.Now(),
+	}
+}
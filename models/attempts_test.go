@@ -0,0 +1,31 @@
+package models 
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQAAttempts (t *testing.T) {
+	attempts := NewAttempts (time.Millisecond * 50)
+
+	msg := &QueMessage{}
+	msg.Id, msg.Seq, msg.Attempts = "one", 10, 0
+
+	if n := attempts.Fail (msg); n != 1 { t.Fatalf("expected the first failure, got %d", n) }
+
+	// what the client says doesn't matter
+	msg.Attempts = 0
+	if n := attempts.Fail (msg); n != 2 { t.Fatalf("expected the second failure, got %d", n) }
+
+	// the same id with another sequence number is a different message
+	other := &QueMessage{}
+	other.Id, other.Seq = "one", 11
+	if n := attempts.Fail (other); n != 1 { t.Fatalf("expected a new count, got %d", n) }
+
+	attempts.Done (other)
+	if attempts.Len() != 1 { t.Fatalf("expected one message left, got %d", attempts.Len()) }
+
+	// and ones we haven't heard about in a while are forgotten
+	time.Sleep (time.Millisecond * 60)
+	if n := attempts.Fail (other); n != 1 || attempts.Len() != 1 { t.Fatalf("expected the old count to be pruned : %d : %d", n, attempts.Len()) }
+}
@@ -0,0 +1,120 @@
+/** ****************************************************************************************************************** **
+	Compaction of the log by message key
+	Once a newer message for a key exists, the older ones are removed from the closed segments
+	Tombstones, empty messages with a key, are kept for a grace period so subscribers see the delete, then removed too
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"bytes"
+	"os"
+	"time"
+	"encoding/json"
+)
+
+//----- topicLog ----------------------------------------------------------------------------------------------------//
+
+// re-writes the segment with only the records we're keeping, returns how many were removed
+// the segment is emptied, count of 0, if nothing is kept. expects the lock to be held
+func (this *topicLog) rewrite (seg *segment, keep func(*logRecord) bool) (int, error) {
+	var buf bytes.Buffer
+	kept := &segment{ path: seg.path }
+
+	err := seg.scan(func(rec *logRecord) bool {
+		if keep(rec) == false { return true }
+
+		data, err := json.Marshal(rec)
+		if err != nil { return true } // it was just unmarshalled, so this won't happen
+
+		buf.Write(data)
+		buf.WriteByte('\n')
+
+		if kept.count == 0 {
+			kept.first, kept.firstTime = rec.Message.Offset, rec.Time
+		}
+		kept.last, kept.lastTime = rec.Message.Offset, rec.Time
+		kept.count++
+		return true
+	})
+	if err != nil { return 0, err }
+
+	removed := seg.count - kept.count
+	if removed == 0 { return 0, nil } // nothing to do
+
+	if kept.count == 0 {
+		if err := os.Remove(seg.path); err != nil { return 0, errors.WithStack(err) }
+	} else if err := WriteFileAtomic(seg.path, buf.Bytes()); err != nil {
+		return 0, errors.WithStack(err)
+	}
+
+	kept.bytes = int64(buf.Len())
+	*seg = *kept
+	return removed, nil
+}
+
+// the segments we're allowed to change, everything but the newest
+// it's either being appended to, or it has our last offset which we need to carry on from after a restart
+// expects the lock to be held
+func (this *topicLog) closed () []*segment {
+	if len(this.segments) == 0 { return nil }
+	return this.segments[:len(this.segments) - 1]
+}
+
+// drops any segments that were emptied out, expects the lock to be held
+func (this *topicLog) prune () {
+	list := make([]*segment, 0, len(this.segments))
+	for i, seg := range this.segments {
+		if seg.count > 0 || i == len(this.segments) - 1 { // the newest one stays even if it's empty
+			list = append(list, seg)
+		}
+	}
+	this.segments = list
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// removes the messages in the topic that have a newer one with the same key, and tombstones older than the grace
+// messages without a key are always kept, returns how many messages were removed
+func (this *Log) Compact (topic string, grace time.Duration) (int, error) {
+	t, _ := this.topic(topic, false)
+	if t == nil { return 0, nil }
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// the newest offset for each key, including what's in the active segment
+	latest := make(map[string]uint64)
+	for _, seg := range t.segments {
+		err := seg.scan(func(rec *logRecord) bool {
+			if len(rec.Message.Key) > 0 {
+				latest[rec.Message.Key] = rec.Message.Offset
+			}
+			return true
+		})
+		if err != nil { return 0, err }
+	}
+
+	cutoff := time.Now().Add(-grace).UnixMilli()
+	keep := func(rec *logRecord) bool {
+		if len(rec.Message.Key) == 0 { return true }
+		if latest[rec.Message.Key] != rec.Message.Offset { return false } // there's a newer one
+		return rec.Message.Tombstone() == false || rec.Time >= cutoff
+	}
+
+	removed := 0
+	for _, seg := range t.closed() {
+		n, err := t.rewrite(seg, keep)
+		removed += n
+		if err != nil {
+			t.prune()
+			return removed, err
+		}
+	}
+
+	t.prune()
+	return removed, nil
+}
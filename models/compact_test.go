@@ -0,0 +1,52 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQACompact (t *testing.T) {
+	log, err := NewLog (t.TempDir(), 1) // every message gets its own segment
+	TestingStackTrace (t, err)
+	defer log.Close()
+
+	old := time.Now().Add(-time.Hour).UnixMilli()
+	now := time.Now().UnixMilli()
+
+	for i, rec := range []struct {
+		key, body string
+		tm int64
+	}{
+		{ "a", "1", old },
+		{ "b", "1", old },
+		{ "a", "2", old },
+		{ "", "no key", old },
+		{ "b", "", old }, // tombstone past its grace
+		{ "c", "", now }, // tombstone still in its grace
+		{ "a", "3", now }, // still being appended to, so it's left alone
+	} {
+		msg := &QueMessage{ Msg: []byte(rec.body) }
+		msg.Topic, msg.Key = "config", rec.key
+		TestingStackTrace (t, log.Append (msg, rec.tm))
+		if msg.Offset != uint64(i + 1) { t.Fatalf("expected offset %d, got %d", i + 1, msg.Offset) }
+	}
+
+	removed, err := log.Compact ("config", time.Minute)
+	TestingStackTrace (t, err)
+	if removed != 4 { t.Fatalf("expected 4 removed, got %d", removed) }
+
+	list, err := log.Read ("config", 1, 100)
+	TestingStackTrace (t, err)
+	if len(list) != 3 || list[0].Offset != 4 || list[1].Offset != 6 || list[2].Offset != 7 { t.Fatalf("unexpected after compacting : %d", len(list)) }
+	if list[1].Tombstone() == false || string(list[2].Msg) != "3" { t.Fatalf("unexpected messages kept") }
+
+	// nothing left to do the second time, and appending still carries on from where we were
+	removed, err = log.Compact ("config", time.Minute)
+	TestingStackTrace (t, err)
+	if removed != 0 { t.Fatalf("expected nothing removed, got %d", removed) }
+
+	msg := &QueMessage{ Msg: []byte("4") }
+	msg.Topic, msg.Key = "config", "a"
+	TestingStackTrace (t, log.Append (msg, now))
+	if msg.Offset != 8 { t.Fatalf("expected offset 8, got %d", msg.Offset) }
+}
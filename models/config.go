@@ -6,7 +6,34 @@
 package models
 
 import (
+	"time"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// defaults for the drain phases, used when the server is embedded without parsing command line args
+const (
+	DefaultDrainNotify	= time.Millisecond * 300
+	DefaultDrainFlush	= time.Second * 10
+	DefaultDrainReady	= time.Second * 5
+
+	DefaultDedupMax		= 100000
 
+	DefaultDeadLetterMax	= 1000
+
+	DefaultMaxRedeliveries	= 5
+	DefaultRedeliveryDelay	= time.Second
+
+	DefaultHistory		= 100
+	DefaultReplayMax	= 10000
+	DefaultSegmentBytes	= 8 << 20
+	DefaultLogCheck		= time.Minute
+	DefaultTombstoneGrace	= time.Hour * 24
+	DefaultLagScan		= 100000
+	DefaultPriorityStarve	= 8
+	DefaultCreditBuffer	= 10000
 )
 
   //-----------------------------------------------------------------------------------------------------------------------//
@@ -17,6 +44,71 @@ import (
 type OPTS struct {
 	Help bool `short:"h" long:"help" description:"Shows help message"`
 	Port int `short:"p" long:"port" description:"Port you want to run the service on" default:"8080"`
+
+	// drain phases, these should add up to less than the pod's terminationGracePeriodSeconds
+	DrainNotify time.Duration `long:"drain-notify" description:"How long to give clients to process the shutdown message" default:"300ms"`
+	DrainFlush time.Duration `long:"drain-flush" description:"Max time to wait for outbound messages to flush while draining" default:"10s"`
+	DrainReady time.Duration `long:"drain-ready" description:"How long to keep running after failing readiness so k8 can pull us from the service" default:"5s"`
+
+	// persistence, nothing is written to disk unless this is set
+	DataDir string `long:"datadir" description:"Directory to persist state to, eg a mounted volume"`
+
+	// dropping repeated publishes of the same message id
+	DedupWindow time.Duration `long:"dedup-window" description:"How long to remember message ids for dropping duplicates, eg 1m, off unless it's set"`
+	DedupMax int `long:"dedup-max" description:"Max message ids to remember for dropping duplicates" default:"100000"`
+
+	DeadLetterMax int `long:"dead-letter-max" description:"Max dead letters to keep per topic, the oldest are dropped" default:"1000"`
+
+	// nacked messages are redelivered, backing off by the delay times the attempts, until they're dead lettered
+	MaxRedeliveries int `long:"max-redeliveries" description:"Times to redeliver a nacked message before it's dead lettered" default:"5"`
+	RedeliveryDelay time.Duration `long:"redelivery-delay" description:"How long to wait before the first redelivery of a nacked message" default:"1s"`
+
+	// what subscribers can ask to have replayed, the in memory history is per topic and the log is everything, on disk
+	History int `long:"history" description:"Messages to keep in memory per topic for replaying to new subscribers, negative to disable" default:"100"`
+	ReplayMax int `long:"replay-max" description:"Max messages to replay for a single subscribe" default:"10000"`
+	Durable bool `long:"durable" description:"Keep a log of every message in the data dir, for replaying more than the in memory history"`
+	SegmentBytes int64 `long:"segment-bytes" description:"Size the log files are rolled over at" default:"8388608"`
+	LogCheck time.Duration `long:"log-check" description:"How often the log is checked for compaction and retention" default:"1m"`
+
+	// how much of the log we keep, whole segments are deleted once a topic is over any of these, 0 is no limit
+	RetentionAge time.Duration `long:"retention-age" description:"Max age of messages kept in the log for each topic"`
+	RetentionBytes int64 `long:"retention-bytes" description:"Max bytes kept in the log for each topic"`
+	RetentionCount int `long:"retention-count" description:"Max messages kept in the log for each topic"`
+	Retention []string `long:"retention" description:"Limits for a single topic, eg orders:age=24h,bytes=1073741824,count=100000, can be repeated"`
+
+	// messages with the same key go to the same partition, and in work queue mode each partition goes to a single subscriber
+	Partitions []string `long:"partitions" description:"Partitions for a topic, eg orders=12, can be repeated"`
+	LagScan int `long:"lag-scan" description:"Max messages to read when working out a consumer group's lag, past that it's estimated" default:"100000"`
+
+	// higher priority messages go out first, but lower ones still get a turn after being passed over this many times
+	PriorityStarve int `long:"priority-starve" description:"Times a lower priority message can be passed over before it goes out anyway" default:"8"`
+
+	// clients that grant credit only get that many messages, the rest are held for them until they grant more
+	CreditBuffer int `long:"credit-buffer" description:"Max messages per priority to hold for a client that's out of credit, past that they're dropped" default:"10000"`
+
+	// compacted topics only keep the latest message for each key, an empty message for a key is a tombstone that deletes it
+	Compact []string `long:"compact" description:"Topic to compact by message key, can be repeated"`
+	TombstoneGrace time.Duration `long:"tombstone-grace" description:"How long tombstones are kept in a compacted topic before they're removed too" default:"24h"`
+}
+
+// fills in any zero values with our defaults
+// go-flags handles this from the command line, but embedded servers may just pass an empty struct
+func (this *OPTS) Defaults () {
+	if this.DrainNotify == 0 { this.DrainNotify = DefaultDrainNotify }
+	if this.DrainFlush == 0 { this.DrainFlush = DefaultDrainFlush }
+	if this.DrainReady == 0 { this.DrainReady = DefaultDrainReady }
+	if this.DedupMax == 0 { this.DedupMax = DefaultDedupMax }
+	if this.DeadLetterMax == 0 { this.DeadLetterMax = DefaultDeadLetterMax }
+	if this.MaxRedeliveries == 0 { this.MaxRedeliveries = DefaultMaxRedeliveries }
+	if this.RedeliveryDelay == 0 { this.RedeliveryDelay = DefaultRedeliveryDelay }
+	if this.History == 0 { this.History = DefaultHistory }
+	if this.ReplayMax == 0 { this.ReplayMax = DefaultReplayMax }
+	if this.SegmentBytes == 0 { this.SegmentBytes = DefaultSegmentBytes }
+	if this.LogCheck == 0 { this.LogCheck = DefaultLogCheck }
+	if this.TombstoneGrace == 0 { this.TombstoneGrace = DefaultTombstoneGrace }
+	if this.LagScan == 0 { this.LagScan = DefaultLagScan }
+	if this.PriorityStarve == 0 { this.PriorityStarve = DefaultPriorityStarve }
+	if this.CreditBuffer == 0 { this.CreditBuffer = DefaultCreditBuffer }
 }
 
   //-----------------------------------------------------------------------------------------------------------------------//
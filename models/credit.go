@@ -0,0 +1,160 @@
+/** ****************************************************************************************************************** **
+	Credit based flow control, so a slow consumer can tell us to back off
+	Once a client grants credit we only send it that many messages, anything past that is held until it grants more
+	Only messages with a sequence number count, those are the ones the client can tell apart from replies and events
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+var ErrCreditFull	= errors.New("k8mq: connection is out of credit and holding too many messages")
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+//----- QueConn -----------------------------------------------------------------------------------------------------//
+
+// true if the message has to wait for more credit, it's held on to until then
+// returns ErrCreditFull if we're already holding too many and it was dropped
+func (this *QueConn) charge (msg *QueMessage) (bool, error) {
+	if msg.Seq == 0 || this.info.Proto < ProtocolVersion { return false, nil } // nothing the client would count
+
+	this.flowLock.Lock()
+	defer this.flowLock.Unlock()
+
+	if this.flow == false { return false, nil } // they haven't asked for flow control
+
+	if this.credit > 0 && this.held.Len() == 0 { // anything held has to go first, to keep things in order
+		this.credit--
+		return false, nil
+	}
+
+	if err := this.held.Push (context.Background(), msg, false); err != nil { return true, ErrCreditFull }
+	return true, nil
+}
+
+// adds credit, or turns flow control off if it's negative
+// returns the held messages that can go out now
+func (this *QueConn) grant (credit int) []*QueMessage {
+	this.flowLock.Lock()
+	defer this.flowLock.Unlock()
+
+	if credit < 0 {
+		this.flow = false
+	} else {
+		this.start()
+		this.credit += credit
+	}
+
+	ret := make([]*QueMessage, 0)
+	for this.held != nil && this.held.Len() > 0 && (this.flow == false || this.credit > 0) {
+		msg, _ := this.held.Pop()
+		if this.flow {
+			this.credit--
+		}
+		ret = append(ret, msg)
+	}
+	return ret
+}
+
+// turns on flow control, expects the flow lock to be held
+func (this *QueConn) start () {
+	this.flow = true
+	if this.held == nil {
+		this.held = NewPriorityQueue (this.holdMax, 0)
+	}
+}
+
+// writes the message out if the connection has the credit for it, otherwise it's held until it does
+// this should only be called from the goroutine sending the messages, so they go out in order
+func (this *QueConn) send (msg *QueMessage, data []byte) error {
+	held, err := this.charge (msg)
+	if errors.Is (err, ErrCreditFull) && this.metrics != nil {
+		this.metrics.CreditDropped.Add(1)
+	}
+	if held { return err }
+	return this.Write (data)
+}
+
+// takes everything held off the connection, they're not getting it from us
+func (this *QueConn) release () []*QueMessage {
+	this.flowLock.Lock()
+	defer this.flowLock.Unlock()
+
+	ret := make([]*QueMessage, 0)
+	for this.held != nil && this.held.Len() > 0 {
+		msg, _ := this.held.Pop()
+		ret = append(ret, msg)
+	}
+	return ret
+}
+
+// nothing else is sent until the client grants more credit
+func (this *QueConn) Pause () {
+	this.flowLock.Lock()
+	defer this.flowLock.Unlock()
+
+	this.start()
+	this.credit = 0
+}
+
+// number of messages waiting on credit from the client
+func (this *QueConn) Held () int {
+	this.flowLock.Lock()
+	defer this.flowLock.Unlock()
+
+	if this.held == nil { return 0 }
+	return this.held.Len()
+}
+
+//----- Que -----------------------------------------------------------------------------------------------------//
+
+// gives the connection this much more credit, sending what we were holding for it
+// a negative credit turns flow control off
+// this is thread safe
+func (this *Que) Grant (conn *QueConn, credit int) error {
+	return this.Do (func() {
+		for _, msg := range conn.grant (credit) {
+			if msg.Expired() {
+				this.metrics.Expired.Add(1)
+				continue
+			}
+
+			if err := conn.WriteFrame (msg.Frame()); err != nil {
+				slog.Info (fmt.Sprintf("QUE: unable to send held messages to %s : %s", conn.id, err.Error())) // they'll get removed on the next message
+				return
+			}
+		}
+	})
+}
+
+// takes everything held for connections that are out of credit, eg so it can be dead lettered when we're shutting down
+// each one is a copy, addressed to just the connection it was held for unless it was for a consumer group
+// this is thread safe
+func (this *Que) ReleaseHeld () []*QueMessage {
+	ret := make([]*QueMessage, 0)
+	for _, conn := range this.conns() {
+		for _, msg := range conn.release() {
+			cp := *msg
+			cp.Target = nil
+			if len(cp.To) == 0 && len(conn.group (TopicName(msg.Topic))) == 0 {
+				cp.To = conn.id // everyone else already got it
+			}
+			ret = append(ret, &cp)
+		}
+	}
+	return ret
+}
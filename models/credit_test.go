@@ -0,0 +1,73 @@
+package models
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQACredit (t *testing.T) {
+	conn := &QueConn{ id: "a", info: ConnInfo{ Proto: ProtocolVersion }, holdMax: 2 }
+
+	newMsg := func (seq uint64, p Priority) *QueMessage {
+		msg := &QueMessage{}
+		msg.Seq, msg.Priority = seq, p
+		return msg
+	}
+
+	// no limit until they ask for one
+	if held, err := conn.charge (newMsg (1, PriorityNormal)); held || err != nil { t.Fatalf("expected no flow control yet") }
+
+	conn.grant (2)
+	for seq := uint64(2); seq < 4; seq++ {
+		if held, _ := conn.charge (newMsg (seq, PriorityNormal)); held { t.Fatalf("expected %d to use up credit", seq) }
+	}
+
+	// out of credit, so these wait
+	if held, err := conn.charge (newMsg (4, PriorityNormal)); held == false || err != nil { t.Fatalf("expected it to be held") }
+	if held, _ := conn.charge (newMsg (5, PriorityUrgent)); held == false { t.Fatalf("expected it to be held") }
+	if held, _ := conn.charge (&QueMessage{}); held { t.Fatalf("expected messages without a seq to go straight out") }
+	if conn.Held() != 2 { t.Fatalf("expected 2 held, got %d", conn.Held()) }
+
+	conn.charge (newMsg (6, PriorityNormal))
+	if _, err := conn.charge (newMsg (7, PriorityNormal)); err != ErrCreditFull { t.Fatalf("expected ErrCreditFull, got %v", err) }
+
+	// held ones go out highest priority first, as the credit allows
+	list := conn.grant (2)
+	if len(list) != 2 || list[0].Seq != 5 || list[1].Seq != 4 { t.Fatalf("unexpected release : %v", list) }
+
+	// the last held one uses that up, so new ones wait again
+	conn.grant (1)
+	if held, _ := conn.charge (newMsg (8, PriorityNormal)); held == false { t.Fatalf("expected it to wait its turn") }
+
+	conn.Pause()
+	if list = conn.grant (0); len(list) != 0 { t.Fatalf("expected nothing while paused") }
+
+	// turning it off sends everything
+	if list = conn.grant (-1); len(list) != 1 || list[0].Seq != 8 { t.Fatalf("unexpected release : %v", list) }
+	if held, _ := conn.charge (newMsg (9, PriorityNormal)); held { t.Fatalf("expected no limit") }
+}
+
+func TestQACreditHeld (t *testing.T) {
+	que := NewQue (&OPTS{ CreditBuffer: 1 })
+	defer que.Close (time.Second)
+
+	conn := que.NewConnection (context.Background(), nil, ConnInfo{ Id: "a", Proto: ProtocolVersion })
+	for que.Conn ("a") == nil {
+		time.Sleep(time.Millisecond)
+	}
+	conn.Pause()
+
+	msg := &QueMessage{}
+	msg.Seq, msg.Topic = 1, "jobs"
+
+	// held messages still need to go out, replayed ones past the buffer are dropped and counted
+	TestingStackTrace (t, conn.replay ([]*QueMessage{ msg, msg }, func(*QueMessage, Selector) bool { return true }))
+	if que.Pending() != 1 { t.Fatalf("expected the held message to be pending, got %d", que.Pending()) }
+	if dropped := que.Metrics().CreditDropped.Load(); dropped != 1 { t.Fatalf("expected the replayed drop to be counted, got %d", dropped) }
+
+	// and can be taken off to dead letter, just for them
+	held := que.ReleaseHeld()
+	if len(held) != 1 || held[0].To != "a" || held[0] == msg { t.Fatalf("unexpected held : %v", held) }
+	if que.Pending() != 0 || conn.Held() != 0 { t.Fatalf("expected nothing left held") }
+}
@@ -0,0 +1,240 @@
+/** ****************************************************************************************************************** **
+	Dead letters, messages we gave up on
+	Each source topic gets its own dead letter topic, holding the original message and why it failed
+	Changes are saved every second, so a burst of failures doesn't re-write the file for every message
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+const DefaultTopic			= "default" // what we call messages that didn't set a topic
+const DeadLetterPrefix		= "dlq."
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type DeadLetter struct {
+	Id uint64 // unique within the server, message ids can repeat
+	Topic string // the dead letter topic, eg dlq.default
+	Message *QueMessage // the original message
+	Reason string
+	Attempts int
+	FirstAttempt time.Time
+	LastAttempt time.Time
+}
+
+// all the dead letters for a source topic
+type DeadLetters struct {
+	max int // most we'll keep per topic, the oldest get dropped
+	path string // where we persist things, empty if we don't
+
+	lock sync.Mutex
+	topics map[string][]*DeadLetter // source topic to its dead letters, oldest first
+	lastId uint64
+	dirty bool // changed since we last saved
+
+	done chan bool
+	wg sync.WaitGroup
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+func (this *DeadLetters) run () {
+	defer this.wg.Done()
+
+	save := time.NewTicker(time.Second)
+	defer save.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-save.C:
+			if err := this.save(); err != nil {
+				slog.Warn("DLQ: failed to save : " + err.Error())
+			}
+		}
+	}
+}
+
+// writes everything out if anything changed
+func (this *DeadLetters) save () error {
+	if len(this.path) == 0 { return nil }
+
+	this.lock.Lock()
+	if this.dirty == false {
+		this.lock.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(this.topics)
+	this.dirty = false
+	this.lock.Unlock()
+
+	if err != nil { return errors.WithStack(err) }
+	return errors.WithStack(WriteFileAtomic(this.path, data))
+}
+
+// loads anything we saved before, a missing file isn't an error
+func (this *DeadLetters) load () error {
+	data, err := os.ReadFile(this.path)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return errors.WithStack(err) }
+
+	if err = json.Unmarshal(data, &this.topics); err != nil { return errors.WithStack(err) }
+
+	for _, list := range this.topics {
+		for _, dl := range list {
+			if dl.Id > this.lastId { this.lastId = dl.Id }
+		}
+	}
+	return nil
+}
+
+// removes the dead letters matching this id, or all of them for 0, returns what was removed
+// expects the lock to be held
+func (this *DeadLetters) remove (topic string, id uint64) []*DeadLetter {
+	list := this.topics[topic]
+	ret := make([]*DeadLetter, 0)
+	keep := make([]*DeadLetter, 0, len(list))
+
+	for _, dl := range list {
+		if id == 0 || dl.Id == id {
+			ret = append(ret, dl)
+		} else {
+			keep = append(keep, dl)
+		}
+	}
+
+	if len(keep) == 0 {
+		delete(this.topics, topic)
+	} else {
+		this.topics[topic] = keep
+	}
+	return ret
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// records the message as dead
+func (this *DeadLetters) Add (msg *QueMessage, reason string, attempts int, first time.Time) *DeadLetter {
+	topic := TopicName(msg.Topic)
+	if first.IsZero() { first = time.Now() }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.lastId++
+	dl := &DeadLetter{
+		Id: this.lastId,
+		Topic: DeadLetterTopic(topic),
+		Message: msg,
+		Reason: reason,
+		Attempts: attempts,
+		FirstAttempt: first,
+		LastAttempt: time.Now(),
+	}
+
+	list := append(this.topics[topic], dl)
+	if this.max > 0 && len(list) > this.max {
+		list = list[len(list) - this.max:] // drop the oldest
+	}
+	this.topics[topic] = list
+	this.dirty = true
+
+	slog.Warn(fmt.Sprintf("DLQ: %s : %s : %s", dl.Topic, msg.Id, reason))
+	return dl
+}
+
+// source topics with dead letters and how many each has
+func (this *DeadLetters) Topics () map[string]int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make(map[string]int)
+	for topic, list := range this.topics {
+		ret[topic] = len(list)
+	}
+	return ret
+}
+
+// the dead letters for the source topic, oldest first
+func (this *DeadLetters) List (topic string) []*DeadLetter {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := append([]*DeadLetter(nil), this.topics[TopicName(topic)]...)
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Id < ret[j].Id })
+	return ret
+}
+
+// removes and returns the dead letter with this id, or all of them for the topic when the id is 0
+func (this *DeadLetters) Remove (topic string, id uint64) []*DeadLetter {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := this.remove(TopicName(topic), id)
+	if len(ret) > 0 {
+		this.dirty = true
+	}
+	return ret
+}
+
+// stops saving in the background and saves what we have
+func (this *DeadLetters) Close () error {
+	close(this.done)
+	this.wg.Wait()
+
+	return this.save()
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// name of the topic, messages without one are on our default topic
+func TopicName (topic string) string {
+	if len(topic) == 0 { return DefaultTopic }
+	return topic
+}
+
+// name of the dead letter topic for this source topic
+func DeadLetterTopic (topic string) string {
+	return DeadLetterPrefix + TopicName(topic)
+}
+
+// creates the dead letters, keeping at most max per topic, path is optional and where they're persisted
+func NewDeadLetters (max int, path string) (*DeadLetters, error) {
+	ret := &DeadLetters{
+		max: max,
+		path: path,
+		topics: make(map[string][]*DeadLetter),
+		done: make(chan bool),
+	}
+
+	if len(path) > 0 {
+		if err := ret.load(); err != nil { return nil, err }
+	}
+
+	ret.wg.Add(1)
+	go ret.run()
+
+	return ret, nil
+}
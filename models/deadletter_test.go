@@ -0,0 +1,51 @@
+package models 
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQADeadLetters (t *testing.T) {
+	path := filepath.Join (t.TempDir(), "deadletters.json")
+
+	dls, err := NewDeadLetters (2, path)
+	TestingStackTrace (t, err)
+
+	for _, id := range []string{ "one", "two", "three" } {
+		msg := &QueMessage{}
+		msg.Id = id
+		dls.Add (msg, "failed " + id, 3, time.Time{})
+	}
+
+	other := &QueMessage{}
+	other.Id, other.Topic = "four", "orders"
+	dls.Add (other, "failed four", 1, time.Time{})
+
+	// only the newest are kept for each topic
+	list := dls.List ("")
+	if len(list) != 2 || list[0].Message.Id != "two" || list[1].Message.Id != "three" { t.Fatalf("unexpected dead letters : %+v", list) }
+	if list[0].Topic != DeadLetterTopic (DefaultTopic) || list[0].Attempts != 3 || list[0].FirstAttempt.IsZero() { t.Fatalf("unexpected dead letter : %+v", list[0]) }
+
+	topics := dls.Topics()
+	if len(topics) != 2 || topics[DefaultTopic] != 2 || topics["orders"] != 1 { t.Fatalf("unexpected topics : %v", topics) }
+
+	// saved in the background, without needing a clean close
+	time.Sleep (time.Millisecond * 1500)
+	crashed, err := NewDeadLetters (2, path)
+	TestingStackTrace (t, err)
+	if len(crashed.List ("orders")) != 1 { t.Fatal("expected the dead letters to be saved before we closed") }
+	TestingStackTrace (t, crashed.Close())
+
+	if removed := dls.Remove ("", list[0].Id); len(removed) != 1 || removed[0].Message.Id != "two" { t.Fatalf("unexpected removal : %+v", removed) }
+	TestingStackTrace (t, dls.Close())
+
+	// and it all survives a restart, with new ids carrying on from the old ones
+	dls, err = NewDeadLetters (2, path)
+	TestingStackTrace (t, err)
+	defer dls.Close()
+
+	list = dls.List ("")
+	if len(list) != 1 || list[0].Message.Id != "three" { t.Fatalf("expected one dead letter left : %+v", list) }
+	if dl := dls.Add (other, "again", 1, time.Time{}); dl.Id <= list[0].Id { t.Fatalf("expected a new id, got %d", dl.Id) }
+}
@@ -0,0 +1,206 @@
+/** ****************************************************************************************************************** **
+	Time windowed cache of message ids we've seen, so we can drop repeated publishes
+	Clients re-que messages after failed writes and producers retry, so the same id can show up more than once
+	It's saved every second while it's changing, so a crash only forgets the last moment of the window
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"container/list"
+	"os"
+	"sync"
+	"time"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type dedupEntry struct {
+	Key string
+	Seen time.Time
+}
+
+type Dedup struct {
+	window time.Duration
+	max int // most keys we'll remember, so we don't grow forever
+	path string // where we persist things, empty if we don't
+
+	lock sync.Mutex
+	ids map[string]*list.Element // key to its place in order
+	order *list.List // oldest first
+	dirty bool // changed since we last saved
+
+	done chan bool
+	wg sync.WaitGroup
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+func (this *Dedup) run () {
+	defer this.wg.Done()
+
+	save := time.NewTicker(time.Second)
+	defer save.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-save.C:
+			if err := this.save(); err != nil {
+				slog.Warn("DEDUP: failed to save : " + err.Error())
+			}
+		}
+	}
+}
+
+// writes the cache out if anything changed
+func (this *Dedup) save () error {
+	if len(this.path) == 0 { return nil }
+
+	this.lock.Lock()
+	if this.dirty == false {
+		this.lock.Unlock()
+		return nil
+	}
+
+	this.trim(time.Now())
+	entries := make([]*dedupEntry, 0, this.order.Len())
+	for el := this.order.Front(); el != nil; el = el.Next() {
+		entries = append(entries, el.Value.(*dedupEntry))
+	}
+	this.dirty = false
+	this.lock.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil { return errors.WithStack(err) }
+
+	return errors.WithStack(WriteFileAtomic(this.path, data))
+}
+
+// loads a cache saved from before, a missing file isn't an error
+func (this *Dedup) load () error {
+	data, err := os.ReadFile(this.path)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return errors.WithStack(err) }
+
+	entries := make([]*dedupEntry, 0)
+	if err = json.Unmarshal(data, &entries); err != nil { return errors.WithStack(err) }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for _, entry := range entries {
+		if _, ok := this.ids[entry.Key]; ok { continue }
+		this.add(entry.Key, entry.Seen)
+	}
+
+	this.trim(time.Now())
+	return nil
+}
+
+// drops anything outside our window, or over our cap, expects the lock to be held
+func (this *Dedup) trim (now time.Time) {
+	for el := this.order.Front(); el != nil; el = this.order.Front() {
+		entry := el.Value.(*dedupEntry)
+		if this.order.Len() <= this.max && now.Sub(entry.Seen) <= this.window { break }
+
+		delete(this.ids, entry.Key)
+		this.order.Remove(el)
+	}
+}
+
+// remembers the key, expects the lock to be held
+func (this *Dedup) add (key string, tm time.Time) {
+	this.ids[key] = this.order.PushBack(&dedupEntry{ Key: key, Seen: tm })
+	this.trim(tm) // in case this put us over the cap
+	this.dirty = true
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// returns true if we've already seen this message id within our window, otherwise it remembers it
+// empty ids are never duplicates
+func (this *Dedup) Seen (key string) bool {
+	if this == nil || len(key) == 0 { return false }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	this.trim(now)
+
+	if _, ok := this.ids[key]; ok { return true }
+
+	this.add(key, now)
+	return false
+}
+
+// drops the id, eg we didn't take the message after all so a retry shouldn't look like a duplicate
+func (this *Dedup) Forget (key string) {
+	if this == nil || len(key) == 0 { return }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if el, ok := this.ids[key]; ok {
+		this.order.Remove(el)
+		delete(this.ids, key)
+		this.dirty = true
+	}
+}
+
+// number of keys we're currently remembering
+func (this *Dedup) Len () int {
+	if this == nil { return 0 }
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.order.Len()
+}
+
+// stops saving in the background and saves what we have
+func (this *Dedup) Close () error {
+	if this == nil { return nil }
+
+	close(this.done)
+	this.wg.Wait()
+
+	return this.save()
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// creates a new cache, returns nil if the window is disabled, which is safe to call Seen and Close on
+// path is optional and where it's persisted, anything saved there before is loaded
+func NewDedup (window time.Duration, max int, path string) (*Dedup, error) {
+	if window <= 0 || max <= 0 { return nil, nil }
+
+	ret := &Dedup{
+		window: window,
+		max: max,
+		path: path,
+		ids: make(map[string]*list.Element),
+		order: list.New(),
+		done: make(chan bool),
+	}
+
+	if len(path) > 0 {
+		if err := ret.load(); err != nil { return nil, err }
+	}
+
+	ret.wg.Add(1)
+	go ret.run()
+
+	return ret, nil
+}
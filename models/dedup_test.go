@@ -0,0 +1,62 @@
+
+package models 
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQADedup (t *testing.T) {
+	dedup, err := NewDedup (time.Millisecond * 50, 2, "")
+	TestingStackTrace (t, err)
+	defer dedup.Close()
+
+	if dedup.Seen ("one") { t.Fatal("first time we've seen this") }
+	if dedup.Seen ("one") == false { t.Fatal("expected a duplicate") }
+	if dedup.Seen ("") { t.Fatal("empty keys are never duplicates") }
+
+	// forgetting one means it's new again
+	dedup.Forget ("one")
+	if dedup.Seen ("one") { t.Fatal("expected a forgotten key to be new again") }
+
+	// over the cap pushes the oldest out
+	dedup.Seen ("two")
+	dedup.Seen ("three")
+	if dedup.Len() != 2 { t.Fatalf("expected 2 keys, got %d", dedup.Len()) }
+	if dedup.Seen ("one") { t.Fatal("expected one to have been pushed out") }
+
+	// and the window
+	time.Sleep (time.Millisecond * 60)
+	if dedup.Seen ("three") { t.Fatal("expected three to have expired") }
+
+	// a disabled cache never finds anything
+	disabled, err := NewDedup (0, 10, "")
+	TestingStackTrace (t, err)
+	if disabled.Seen ("one") || disabled.Seen ("one") { t.Fatal("disabled cache found a duplicate") }
+	TestingStackTrace (t, disabled.Close())
+}
+
+func TestQADedupPersist (t *testing.T) {
+	path := filepath.Join (t.TempDir(), "dedup.json")
+
+	// missing files are fine
+	dedup, err := NewDedup (time.Minute, 10, path)
+	TestingStackTrace (t, err)
+	dedup.Seen ("one")
+
+	// saved in the background, without needing a clean close
+	time.Sleep (time.Millisecond * 1500)
+	crashed, err := NewDedup (time.Minute, 10, path)
+	TestingStackTrace (t, err)
+	if crashed.Seen ("one") == false { t.Fatal("expected the key to be saved before we closed") }
+	TestingStackTrace (t, crashed.Close())
+
+	dedup.Seen ("two")
+	TestingStackTrace (t, dedup.Close())
+
+	dedup, err = NewDedup (time.Minute, 10, path)
+	TestingStackTrace (t, err)
+	defer dedup.Close()
+	if dedup.Seen ("one") == false || dedup.Seen ("two") == false { t.Fatal("expected the keys to survive a restart") }
+}
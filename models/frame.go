@@ -0,0 +1,139 @@
+/** ****************************************************************************************************************** **
+	Frames are how our client and server talk to each other once the client says it speaks our protocol
+	Anything that doesn't parse as a frame is treated as a raw message, same as before we had frames
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"bytes"
+	"time"
+	"encoding/json"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+const ProtocolVersion	= 2 // clients that speak frames pass this as the proto query param when they connect
+const ProtocolParam		= "proto"
+const ProtocolHeader	= "K8mq-Proto" // the server answers the upgrade with the version it speaks, older ones don't set it
+
+// optional query params a client identifies itself with when it connects
+const ClientIdParam		= "id" // unique id for the client, the server makes one up if it's not set
+const PodParam			= "pod"
+const ServiceParam		= "service"
+const LabelParam		= "label" // can be repeated, each is key=value
+const NoEchoParam		= "noecho" // set to 1 so we don't get back our own broadcasts
+
+type FrameType string
+
+const (
+	FramePublish	FrameType = "pub" // client -> server, a new message
+	FrameMessage	FrameType = "msg" // server -> client, a message being delivered
+	FrameAck		FrameType = "ack" // server -> client, a published message was accepted
+	FrameError		FrameType = "err" // server -> client, a published message was rejected
+	FrameCancel		FrameType = "cancel" // client -> server, drop any scheduled messages with the id in the body
+	FrameDeadLetter	FrameType = "dlq" // client -> server, a message we gave up on, the reason is in the error
+	FrameNack		FrameType = "nack" // client -> server, our handler failed this message so it should be redelivered
+	FramePresence	FrameType = "presence" // client -> server, asks for who's connected, the list comes back as a reply
+	FrameSubscribe	FrameType = "sub" // client -> server, only send us messages on the topics we've subscribed to
+	FrameUnsubscribe	FrameType = "unsub" // client -> server
+	FrameCommit		FrameType = "commit" // client -> server, the group has handled everything in the partition up to the offset
+	FrameLag		FrameType = "lag" // client -> server, asks how far behind the consumer groups are, it comes back as a reply
+	FrameCredit		FrameType = "credit" // client -> server, we can take this many more messages, negative for no limit
+	FramePause		FrameType = "pause" // client -> server, don't send us anything else until we grant more credit
+	FrameShutdown	FrameType = "shutdown" // server -> client, we're going away so stop sending us messages
+)
+
+// the key every frame has, this is how we tell them apart from raw messages
+var frameMarker = []byte(`"k8mq"`)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// metadata that travels with a message
+type Envelope struct {
+	Id string `json:"id,omitempty"` // unique id for the message, the IdHash if the body had one
+	Ref string `json:"ref,omitempty"` // set by the publisher to match up the ack or error, it's unique for each publish even if the id isn't
+	Topic string `json:"topic,omitempty"` // empty for our default topic
+	Key string `json:"key,omitempty"` // optional, messages with the same key belong together, eg for ordering
+	Seq uint64 `json:"seq,omitempty"` // set by the server as it accepts messages
+	Published int64 `json:"published,omitempty"` // unix milliseconds, when the message was first published
+	Attempts int `json:"attempts,omitempty"` // times we've tried to deliver this already
+	Expires int64 `json:"expires,omitempty"` // unix milliseconds, the message is dropped instead of delivered after this
+	DeliverAt int64 `json:"deliver_at,omitempty"` // unix milliseconds, the server holds on to the message until then
+	Sender string `json:"sender,omitempty"` // id of the connection that published this, set by the server
+	ReplyTo string `json:"reply_to,omitempty"` // id of the message this is a reply to
+	To string `json:"to,omitempty"` // id of the client this is just for, empty for everyone
+	Selector string `json:"selector,omitempty"` // label selector, only clients with matching labels get this, eg app=billing,zone in (a,b)
+	NoEcho bool `json:"no_echo,omitempty"` // don't send this back to the client that published it
+	Retain bool `json:"retain,omitempty"` // the server keeps this as the last value for the topic, an empty body clears it
+	Offset uint64 `json:"offset,omitempty"` // position in the topic's history, set by the server as it goes out
+	Replay *Replay `json:"replay,omitempty"` // on a subscribe, what history to send first
+	Group string `json:"group,omitempty"` // on a subscribe or commit, the consumer group, its members share the topic's partitions instead of getting everything. on a redelivery, the group it's for
+	Partition int `json:"partition,omitempty"` // which of the topic's partitions this is in, set by the server as it goes out
+	Partitions int `json:"partitions,omitempty"` // on a subscribe, how many partitions the topic has, declaring them if it doesn't have a count yet
+	Priority Priority `json:"priority,omitempty"` // higher ones go out first, 0 is normal
+	Credit int `json:"credit,omitempty"` // on a credit frame, how many more messages we can take
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// what history a subscriber wants before any live messages, the most specific one set is used
+// it's capped by the server's replay max
+type Replay struct {
+	From uint64 `json:"from,omitempty"` // everything from this offset on
+	Since int64 `json:"since,omitempty"` // unix milliseconds, everything the server sent out since then
+	Last int `json:"last,omitempty"` // the last this many messages
+}
+
+// sets when this message expires, based on the ttl from now
+func (this *Envelope) SetTTL (ttl time.Duration) {
+	if ttl <= 0 { return }
+	this.Expires = time.Now().Add(ttl).UnixMilli()
+}
+
+// when the message was first published, the zero time if we don't know
+func (this *Envelope) PublishedAt () time.Time {
+	if this.Published == 0 { return time.Time{} }
+	return time.UnixMilli(this.Published)
+}
+
+// true if the message should be held on to by the server for later
+func (this *Envelope) Scheduled () bool {
+	return this.DeliverAt > time.Now().UnixMilli()
+}
+
+// true if the message has a ttl and it's passed
+func (this *Envelope) Expired () bool {
+	return this.Expires > 0 && time.Now().UnixMilli() > this.Expires
+}
+
+type Frame struct {
+	Type FrameType `json:"k8mq"`
+	Envelope
+	Confirm bool `json:"confirm,omitempty"` // the publisher wants an ack or error frame back
+	Error string `json:"error,omitempty"`
+	Body []byte `json:"body,omitempty"`
+}
+
+func (this *Frame) Marshal () []byte {
+	out, _ := json.Marshal(this) // nothing in here can fail to marshal
+	return out
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// returns the frame if this data is one, false means it's a raw message
+func ParseFrame (data []byte) (*Frame, bool) {
+	if len(data) == 0 || data[0] != '{' || bytes.Contains(data, frameMarker) == false { return nil, false } // quick check before we bother parsing
+
+	ret := &Frame{}
+	if err := json.Unmarshal(data, ret); err != nil || len(ret.Type) == 0 { return nil, false }
+
+	return ret, true
+}
@@ -0,0 +1,356 @@
+/** ****************************************************************************************************************** **
+	History of what went out on each topic, so new subscribers can ask for it to be replayed
+	The last few messages per topic are kept in memory, and if the durable log is on we fall back to it
+	for anything older
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"fmt"
+	"math"
+	"sync"
+	"time"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type historyEntry struct {
+	time int64 // unix milliseconds, when it went out
+	msg *QueMessage
+}
+
+// fixed size ring of the newest messages for a topic
+type ring struct {
+	entries []*historyEntry
+	next int // where the next one goes
+	full bool
+}
+
+type History struct {
+	size int // per topic, 0 keeps nothing in memory
+	max int // most we'll replay at once
+	log *Log // nil unless we're durable
+
+	compact []string // topics in the log we compact by key
+	grace time.Duration // how long tombstones are kept in them
+	retention Retention // limits for every topic in the log
+	retentions map[string]Retention // topics with their own limits
+	warned map[string]bool // topics we've warned are close to their limits, so we don't keep doing it
+	check time.Duration // how often we look after the log
+	lagScan int // most messages we'll read to work out a group's lag
+
+	lock sync.Mutex
+	topics map[string]*ring
+	offsets map[string]uint64 // last offset per topic, when we don't have a log to keep track
+
+	done chan bool
+	wg sync.WaitGroup
+}
+
+//----- ring --------------------------------------------------------------------------------------------------------//
+
+func (this *ring) add (entry *historyEntry) {
+	this.entries[this.next] = entry
+	this.next = (this.next + 1) % len(this.entries)
+	if this.next == 0 {
+		this.full = true
+	}
+}
+
+// everything in the ring, oldest first
+func (this *ring) list () []*historyEntry {
+	if this.full == false { return append([]*historyEntry(nil), this.entries[:this.next]...) }
+	return append(append([]*historyEntry(nil), this.entries[this.next:]...), this.entries[:this.next]...)
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// the newest max messages in the list
+func (this *History) newest (list []*QueMessage) []*QueMessage {
+	if len(list) > this.max {
+		return list[len(list) - this.max:]
+	}
+	return list
+}
+
+// replays from the log, for when memory doesn't go back far enough
+func (this *History) fromLog (topic string, req *Replay) ([]*QueMessage, error) {
+	switch {
+	case req.From > 0:
+		from := req.From
+		if last := this.log.Last(topic); last >= uint64(this.max) && from < last - uint64(this.max) + 1 {
+			from = last - uint64(this.max) + 1 // we only send the newest, so there's no gap before the live ones
+		}
+		return this.log.Read(topic, from, this.max)
+
+	case req.Since > 0:
+		list, err := this.log.Since(topic, req.Since, math.MaxInt)
+		return this.newest(list), err
+	}
+
+	last := this.log.Last(topic)
+	n := uint64(min(req.Last, this.max))
+	if n >= last { return this.log.Read(topic, 1, this.max) }
+	return this.log.Read(topic, last - n + 1, this.max)
+}
+
+// the retention limits for the topic
+func (this *History) limits (topic string) Retention {
+	if r, ok := this.retentions[topic]; ok { return r }
+	return this.retention
+}
+
+// warns once when a topic gets close to its limits, and again if it gets close after dropping back
+func (this *History) warn (usage *TopicUsage) {
+	used := usage.Used()
+	if used < RetentionWarn {
+		delete(this.warned, usage.Topic)
+		return
+	}
+
+	if this.warned[usage.Topic] { return }
+	this.warned[usage.Topic] = true
+
+	slog.Warn(fmt.Sprintf("HISTORY: %s is at %.0f%% of its retention : %d bytes : %d messages", usage.Topic, used * 100, usage.Bytes, usage.Count))
+}
+
+// compacts the topics we were asked to, and deletes what's past the retention limits
+func (this *History) maintain () {
+	for _, topic := range this.compact {
+		removed, err := this.log.Compact(topic, this.grace)
+		if err != nil {
+			slog.Warn("HISTORY: failed to compact " + topic + " : " + err.Error())
+		}
+		if removed > 0 {
+			slog.Info(fmt.Sprintf("HISTORY: compacted %s : removed %d messages", topic, removed))
+		}
+	}
+
+	for _, topic := range this.log.Topics() {
+		removed, err := this.log.Retain(topic, this.limits(topic))
+		if err != nil {
+			slog.Warn("HISTORY: failed to apply retention to " + topic + " : " + err.Error())
+		}
+		if removed > 0 {
+			slog.Info(fmt.Sprintf("HISTORY: retention removed %d messages from %s", removed, topic))
+		}
+
+		usage := this.Usage(topic)
+		this.warn(&usage)
+	}
+}
+
+// looks after the log in the background until we're closed
+func (this *History) run () {
+	defer this.wg.Done()
+
+	ticker := time.NewTicker(this.check)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-ticker.C:
+			this.maintain()
+		}
+	}
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// remembers the message as it goes out, setting its offset
+// the server's own notices aren't kept, they'd only confuse whoever got them replayed later
+func (this *History) Record (msg *QueMessage) {
+	if msg.control() { return }
+	topic := TopicName(msg.Topic)
+	now := time.Now().UnixMilli()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.log != nil {
+		if err := this.log.Append(msg, now); err != nil {
+			slog.Warn("HISTORY: failed to write to the log : " + err.Error())
+		}
+	} else {
+		this.offsets[topic]++
+		msg.Offset = this.offsets[topic]
+	}
+
+	if this.size <= 0 { return }
+
+	r, ok := this.topics[topic]
+	if ok == false {
+		r = &ring{ entries: make([]*historyEntry, this.size) }
+		this.topics[topic] = r
+	}
+
+	cp := *msg
+	cp.From, cp.Target, cp.Confirm = nil, nil, false
+	r.add(&historyEntry{ time: now, msg: &cp })
+}
+
+// the history the subscriber asked for, oldest first
+func (this *History) Replay (topic string, req *Replay) []*QueMessage {
+	if req == nil || (req.From == 0 && req.Since == 0 && req.Last <= 0) { return nil }
+	topic = TopicName(topic)
+
+	this.lock.Lock()
+	defer this.lock.Unlock() // held while we read so nothing new is recorded partway through
+
+	var entries []*historyEntry
+	if r, ok := this.topics[topic]; ok {
+		entries = r.list()
+	}
+
+	// see if memory goes back far enough
+	covered := len(entries) > 0
+	if covered {
+		oldest := entries[0]
+		switch {
+		case req.From > 0:
+			covered = oldest.msg.Offset <= req.From
+		case req.Since > 0:
+			covered = oldest.time <= req.Since
+		default:
+			covered = len(entries) >= req.Last
+		}
+	}
+
+	if covered == false && this.log != nil {
+		list, err := this.fromLog(topic, req)
+		if err == nil { return list }
+		slog.Warn("HISTORY: failed to read the log : " + err.Error()) // fall back to what we have in memory
+	}
+
+	ret := make([]*QueMessage, 0, len(entries))
+	for _, entry := range entries {
+		switch {
+		case req.From > 0:
+			if entry.msg.Offset < req.From { continue }
+		case req.Since > 0:
+			if entry.time < req.Since { continue }
+		}
+
+		cp := *entry.msg
+		ret = append(ret, &cp)
+	}
+
+	if req.From == 0 && req.Since == 0 && len(ret) > req.Last {
+		ret = ret[len(ret) - req.Last:]
+	}
+	return this.newest(ret)
+}
+
+// the last offset recorded for the topic, 0 if nothing has been
+func (this *History) Last (topic string) uint64 {
+	topic = TopicName(topic)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.log != nil { return this.log.Last(topic) }
+	return this.offsets[topic]
+}
+
+// carries on numbering the topic after the offset, so committed offsets still line up after a restart without a log
+func (this *History) Seed (topic string, offset uint64) {
+	topic = TopicName(topic)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.log != nil { return } // the log keeps track itself
+	if offset > this.offsets[topic] {
+		this.offsets[topic] = offset
+	}
+}
+
+// what the topic is using in the log, along with its limits
+func (this *History) Usage (topic string) TopicUsage {
+	ret := TopicUsage{ Topic: TopicName(topic) }
+	if this.log != nil {
+		ret = this.log.Usage(topic)
+	}
+	ret.Retention = this.limits(ret.Topic)
+	return ret
+}
+
+// what every topic is using in the log, empty if we're not keeping one
+func (this *History) Usages () []TopicUsage {
+	ret := make([]TopicUsage, 0)
+	if this.log == nil { return ret }
+
+	for _, topic := range this.log.Topics() {
+		ret = append(ret, this.Usage(topic))
+	}
+	return ret
+}
+
+// the durable log, nil if we're not keeping one
+func (this *History) Log () *Log {
+	return this.log
+}
+
+func (this *History) Close () error {
+	if this.log == nil { return nil }
+
+	close(this.done)
+	this.wg.Wait()
+
+	return this.log.Close()
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// creates the history from our options, logDir is only used if we're durable
+func NewHistory (opts *OPTS, logDir string) (*History, error) {
+	ret := &History{
+		size: opts.History,
+		max: opts.ReplayMax,
+		topics: make(map[string]*ring),
+		offsets: make(map[string]uint64),
+		grace: opts.TombstoneGrace,
+		retention: Retention{ Age: opts.RetentionAge, Bytes: opts.RetentionBytes, Count: opts.RetentionCount },
+		retentions: make(map[string]Retention),
+		warned: make(map[string]bool),
+		check: opts.LogCheck,
+		lagScan: opts.LagScan,
+		done: make(chan bool),
+	}
+
+	for _, str := range opts.Retention {
+		topic, r, err := ParseRetention(str)
+		if err != nil { return nil, err }
+		ret.retentions[topic] = r
+	}
+
+	for _, topic := range opts.Compact {
+		ret.compact = append(ret.compact, TopicName(topic))
+	}
+
+	if opts.Durable {
+		if len(logDir) == 0 { return nil, errors.Errorf("a data dir is required to be durable") }
+
+		var err error
+		ret.log, err = NewLog(logDir, opts.SegmentBytes)
+		if err != nil { return nil, err }
+
+		if ret.check > 0 {
+			ret.wg.Add(1)
+			go ret.run()
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,64 @@
+package models 
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQAHistory (t *testing.T) {
+	history, err := NewHistory (&OPTS{ History: 5, ReplayMax: 4 }, "")
+	TestingStackTrace (t, err)
+
+	for i := 1; i <= 8; i++ {
+		msg := &QueMessage{ Msg: []byte(fmt.Sprintf("msg-%d", i)) }
+		history.Record (msg)
+		if msg.Offset != uint64(i) { t.Fatalf("expected offset %d, got %d", i, msg.Offset) }
+	}
+
+	// the server's own notices aren't part of the history
+	notice := &QueMessage{ Msg: []byte(ShutdownMessage) }
+	history.Record (notice)
+	if notice.Offset != 0 || history.Last ("") != 8 { t.Fatalf("expected the shutdown message to be left out") }
+
+	if list := history.Replay ("", nil); len(list) != 0 { t.Fatal("nothing asked for, nothing replayed") }
+
+	list := history.Replay (DefaultTopic, &Replay{ Last: 2 })
+	if len(list) != 2 || string(list[0].Msg) != "msg-7" { t.Fatalf("unexpected last : %d", len(list)) }
+
+	list = history.Replay ("", &Replay{ Last: 10 }) // capped by the replay max, keeping the newest
+	if len(list) != 4 || string(list[3].Msg) != "msg-8" { t.Fatalf("unexpected capped : %d", len(list)) }
+
+	list = history.Replay ("", &Replay{ From: 6 })
+	if len(list) != 3 || list[0].Offset != 6 { t.Fatalf("unexpected from : %d", len(list)) }
+
+	list = history.Replay ("", &Replay{ Since: time.Now().Add(time.Minute).UnixMilli() })
+	if len(list) != 0 { t.Fatalf("nothing after now : %d", len(list)) }
+
+	// seeding carries on after what a group committed, never going backwards
+	history.Seed ("", 20)
+	history.Seed ("", 3)
+	msg := &QueMessage{}
+	history.Record (msg)
+	if msg.Offset != 21 { t.Fatalf("expected to carry on after the seed, got %d", msg.Offset) }
+
+	// durable goes back further than memory
+	opts := &OPTS{ History: 2, ReplayMax: 100, Durable: true, SegmentBytes: 1 << 20 }
+	history, err = NewHistory (opts, t.TempDir())
+	TestingStackTrace (t, err)
+
+	for i := 1; i <= 6; i++ {
+		msg := &QueMessage{ Msg: []byte(fmt.Sprintf("msg-%d", i)) }
+		msg.Topic = "orders"
+		history.Record (msg)
+	}
+
+	list = history.Replay ("orders", &Replay{ From: 2 })
+	if len(list) != 5 || string(list[0].Msg) != "msg-2" { t.Fatalf("expected the log to be used : %d", len(list)) }
+
+	list = history.Replay ("orders", &Replay{ Last: 4 })
+	if len(list) != 4 || string(list[0].Msg) != "msg-3" { t.Fatalf("unexpected last from the log : %d", len(list)) }
+	TestingStackTrace (t, history.Close())
+
+	if _, err = NewHistory (opts, ""); err == nil { t.Fatal("expected durable to need a data dir") }
+}
@@ -0,0 +1,169 @@
+/** ****************************************************************************************************************** **
+	How far behind each consumer group is, per partition
+	Worked out from what's been recorded since the group's last commit, memory first and then the log
+	A group too far behind to read everything is estimated from what we did read
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+const LagTopic = "k8mq.lag" // replies to a client asking for the lag come in on this topic
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type PartitionLag struct {
+	Group string `json:"group"`
+	Topic string `json:"topic"`
+	Partition int `json:"partition"`
+	Committed uint64 `json:"committed"` // last offset the group committed
+	Messages int `json:"messages"` // in the partition since then
+	Oldest int64 `json:"oldest,omitempty"` // unix milliseconds, when the oldest of them was published
+	Estimated bool `json:"estimated,omitempty"` // the group was too far behind to count everything
+}
+
+// how long the oldest message the group hasn't committed has been waiting, 0 if there aren't any
+func (this *PartitionLag) Age () time.Duration {
+	if this.Oldest == 0 { return 0 }
+	return time.Since(time.UnixMilli(this.Oldest))
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// what's been recorded on the topic from this offset on, at most max of them
+// false if we don't have a log and memory doesn't go back that far
+func (this *History) since (topic string, from uint64, max int) ([]*QueMessage, bool) {
+	this.lock.Lock()
+	var entries []*historyEntry
+	if r, ok := this.topics[topic]; ok {
+		entries = r.list()
+	}
+	this.lock.Unlock()
+
+	covered := len(entries) > 0 && entries[0].msg.Offset <= from
+	if covered || this.log == nil { // memory goes back far enough, or it's all we have
+		ret := make([]*QueMessage, 0, len(entries))
+		for _, entry := range entries {
+			if entry.msg.Offset >= from && len(ret) < max {
+				ret = append(ret, entry.msg)
+			}
+		}
+		return ret, covered
+	}
+
+	ret, err := this.log.Read(topic, from, max)
+	if err != nil {
+		slog.Warn("HISTORY: failed to read the log for lag : " + err.Error())
+	}
+	return ret, true
+}
+
+// the group's lag on the topic, committed has the offset for each of its partitions
+func (this *History) lag (group, topic string, committed map[int]uint64) []PartitionLag {
+	ret := make([]PartitionLag, 0, len(committed))
+	index := make(map[int]int, len(committed))
+
+	from := uint64(0)
+	for p, offset := range committed {
+		index[p] = len(ret)
+		ret = append(ret, PartitionLag{ Group: group, Topic: topic, Partition: p, Committed: offset })
+
+		if from == 0 || offset + 1 < from {
+			from = offset + 1
+		}
+	}
+
+	last := this.Last(topic)
+	if from == 0 || from > last { return ret } // they're all caught up
+
+	list, complete := this.since(topic, from, this.lagScan)
+
+	counted := 0
+	for _, msg := range list {
+		i, ok := index[msg.Partition]
+		if ok == false || msg.Offset <= ret[i].Committed { continue }
+
+		ret[i].Messages++
+		counted++
+		if ret[i].Oldest == 0 {
+			ret[i].Oldest = msg.Published
+		}
+	}
+
+	// if we couldn't read it all, the rest is split up the same as what we did read
+	if len(list) > 0 && list[len(list) - 1].Offset < last {
+		remaining := float64(last - list[len(list) - 1].Offset)
+		for i := range ret {
+			if counted > 0 {
+				ret[i].Messages += int(remaining * float64(ret[i].Messages) / float64(counted))
+			}
+			ret[i].Estimated = true
+		}
+	}
+
+	if complete == false { // memory didn't go back far enough, so there's more than we know about
+		for i := range ret {
+			ret[i].Estimated = true
+		}
+	}
+	return ret
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// how far behind each group is on each partition it's committed to, sorted by group, topic and partition
+func (this *History) Lag (offsets *Offsets) []PartitionLag {
+	ret := make([]PartitionLag, 0)
+	if offsets == nil { return ret }
+
+	// the offsets come sorted, so each group and topic is together
+	list := offsets.List()
+	for i := 0; i < len(list); {
+		group, topic := list[i].Group, list[i].Topic
+
+		committed := make(map[int]uint64)
+		for ; i < len(list) && list[i].Group == group && list[i].Topic == topic; i++ {
+			committed[list[i].Partition] = list[i].Offset
+		}
+
+		lag := this.lag(group, topic, committed)
+		sort.Slice(lag, func(a, b int) bool { return lag[a].Partition < lag[b].Partition })
+		ret = append(ret, lag...)
+	}
+	return ret
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// writes the lag for each group and partition as prometheus gauges
+func WriteLagMetrics (w io.Writer, list []PartitionLag) {
+	if len(list) == 0 { return }
+
+	for _, metric := range []struct {
+		name, help string
+		value func(*PartitionLag) any
+	}{
+		{ "k8mq_consumer_lag_messages", "Messages in the partition the group hasn't committed", func(l *PartitionLag) any { return l.Messages } },
+		{ "k8mq_consumer_lag_seconds", "How long the oldest message the group hasn't committed has been waiting", func(l *PartitionLag) any { return l.Age().Seconds() } },
+	} {
+		fmt.Fprintf (w, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for i := range list {
+			fmt.Fprintf (w, "%s{group=%q,topic=%q,partition=\"%d\"} %v\n", metric.name, list[i].Group, list[i].Topic, list[i].Partition, metric.value(&list[i]))
+		}
+	}
+}
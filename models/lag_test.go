@@ -0,0 +1,52 @@
+package models
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQALag (t *testing.T) {
+	opts := &OPTS{ Durable: true, History: 5, LagScan: 1000 }
+	opts.Defaults()
+
+	history, err := NewHistory (opts, t.TempDir())
+	TestingStackTrace (t, err)
+	defer history.Close()
+
+	offsets, err := NewOffsets ("")
+	TestingStackTrace (t, err)
+	defer offsets.Close()
+
+	offsets.Start ("billing", "orders", 2, 0)
+
+	published := time.Now().Add(-time.Minute * 2).UnixMilli()
+	for i := 0; i < 10; i++ {
+		msg := &QueMessage{ Msg: []byte("order") }
+		msg.Topic, msg.Partition, msg.Published = "orders", i % 2, published + int64(i)
+		history.Record (msg)
+	}
+
+	// more than memory has, so it comes from the log
+	offsets.Commit ("billing", "orders", 0, 3) // offsets 1, 3, 5, 7, 9 are in partition 0
+	lag := history.Lag (offsets)
+	if len(lag) != 2 || lag[0].Messages != 3 || lag[1].Messages != 5 || lag[0].Estimated { t.Fatalf("unexpected lag : %+v", lag) }
+	if lag[0].Oldest != published + 4 || lag[1].Oldest != published + 1 || lag[1].Age() < time.Minute { t.Fatalf("unexpected oldest : %+v", lag) }
+
+	// caught up
+	offsets.Commit ("billing", "orders", 0, 9)
+	offsets.Commit ("billing", "orders", 1, 10)
+	lag = history.Lag (offsets)
+	if lag[0].Messages != 0 || lag[1].Messages != 0 || lag[0].Age() != 0 { t.Fatalf("expected no lag : %+v", lag) }
+
+	// too far behind to read it all
+	history.lagScan = 2
+	offsets.Start ("audit", "orders", 2, 0)
+	lag = history.Lag (offsets)
+	if lag[0].Group != "audit" || lag[0].Estimated == false || lag[0].Messages + lag[1].Messages != 10 { t.Fatalf("unexpected estimate : %+v", lag) }
+
+	var buf bytes.Buffer
+	WriteLagMetrics (&buf, lag)
+	if strings.Contains (buf.String(), `k8mq_consumer_lag_messages{group="audit",topic="orders",partition="0"} 5`) == false { t.Fatalf("unexpected metrics : %s", buf.String()) }
+}
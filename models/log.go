@@ -0,0 +1,335 @@
+/** ****************************************************************************************************************** **
+	Durable log of every message that went out, one per topic
+	Each topic is a directory of segment files, named by the first offset in them, with one record per line
+	The newest segment is appended to until it's over the segment size, then we roll over to a new one
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+const segmentExt	= ".log"
+const maxRecordSize	= 64 << 20 // biggest line we'll read back
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// a single line in a segment
+type logRecord struct {
+	Time int64 `json:"t"` // unix milliseconds, when it was appended
+	Message *QueMessage `json:"m"`
+}
+
+type segment struct {
+	path string
+	first, last uint64 // offsets
+	firstTime, lastTime int64
+	bytes int64
+	count int
+}
+
+type topicLog struct {
+	dir string
+	lock sync.Mutex
+	segments []*segment // oldest first
+	file *os.File // the newest segment, open for appending
+	last uint64 // last offset handed out
+}
+
+type Log struct {
+	dir string
+	segmentBytes int64
+
+	lock sync.Mutex
+	topics map[string]*topicLog
+}
+
+//----- segment -----------------------------------------------------------------------------------------------------//
+
+// calls fn with each record in the segment, stops early if fn returns false
+func (this *segment) scan (fn func(*logRecord) bool) error {
+	f, err := os.Open(this.path)
+	if err != nil { return errors.WithStack(err) }
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64 << 10), maxRecordSize)
+
+	for scanner.Scan() {
+		rec := &logRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil || rec.Message == nil { continue } // a partial write from a crash, skip it
+
+		if fn(rec) == false { break }
+	}
+
+	return errors.WithStack(scanner.Err())
+}
+
+// works out what's in the segment from its contents
+func (this *segment) load () error {
+	info, err := os.Stat(this.path)
+	if err != nil { return errors.WithStack(err) }
+	this.bytes = info.Size()
+
+	return this.scan(func(rec *logRecord) bool {
+		if this.count == 0 {
+			this.first, this.firstTime = rec.Message.Offset, rec.Time
+		}
+		this.last, this.lastTime = rec.Message.Offset, rec.Time
+		this.count++
+		return true
+	})
+}
+
+//----- topicLog ----------------------------------------------------------------------------------------------------//
+
+// loads the segments already on disk, oldest first
+func (this *topicLog) load () error {
+	files, err := filepath.Glob(filepath.Join(this.dir, "*" + segmentExt))
+	if err != nil { return errors.WithStack(err) }
+	sort.Strings(files) // the names are zero padded offsets, so this is oldest first
+
+	for _, path := range files {
+		seg := &segment{ path: path }
+		if err := seg.load(); err != nil { return err }
+
+		if seg.count == 0 {
+			os.Remove(path) // nothing in it we can use
+			continue
+		}
+
+		this.segments = append(this.segments, seg)
+		this.last = seg.last
+	}
+	return nil
+}
+
+// starts a new segment for the next offset, expects the lock to be held
+func (this *topicLog) roll () error {
+	if this.file != nil {
+		this.file.Close()
+	}
+
+	seg := &segment{ path: filepath.Join(this.dir, fmt.Sprintf("%020d%s", this.last + 1, segmentExt)) }
+
+	var err error
+	this.file, err = os.OpenFile(seg.path, os.O_CREATE | os.O_APPEND | os.O_WRONLY, 0600)
+	if err != nil { return errors.WithStack(err) }
+
+	this.segments = append(this.segments, seg)
+	return nil
+}
+
+// the newest segment, nil if there isn't one or it's closed, expects the lock to be held
+func (this *topicLog) active () *segment {
+	if this.file == nil || len(this.segments) == 0 { return nil }
+	return this.segments[len(this.segments) - 1]
+}
+
+// the records from this offset on, at most max of them, expects the lock to be held
+func (this *topicLog) read (from uint64, max int, keep func(*logRecord) bool) ([]*QueMessage, error) {
+	ret := make([]*QueMessage, 0)
+
+	for _, seg := range this.segments {
+		if seg.count == 0 || seg.last < from { continue }
+
+		err := seg.scan(func(rec *logRecord) bool {
+			if rec.Message.Offset < from || keep(rec) == false { return true }
+
+			ret = append(ret, rec.Message)
+			return len(ret) < max
+		})
+		if err != nil { return nil, err }
+
+		if len(ret) >= max { break }
+	}
+
+	return ret, nil
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// the log for this topic, creating it if we have to
+func (this *Log) topic (name string, create bool) (*topicLog, error) {
+	name = TopicName(name)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if t, ok := this.topics[name]; ok || create == false { return t, nil }
+
+	t := &topicLog{ dir: filepath.Join(this.dir, url.PathEscape(name)) }
+	if err := os.MkdirAll(t.dir, 0700); err != nil { return nil, errors.WithStack(err) }
+
+	this.topics[name] = t
+	return t, nil
+}
+
+// loads every topic already on disk
+func (this *Log) load () error {
+	entries, err := os.ReadDir(this.dir)
+	if err != nil { return errors.WithStack(err) }
+
+	for _, entry := range entries {
+		if entry.IsDir() == false { continue }
+
+		name, err := url.PathUnescape(entry.Name())
+		if err != nil { continue } // not one of ours
+
+		t := &topicLog{ dir: filepath.Join(this.dir, entry.Name()) }
+		if err := t.load(); err != nil { return err }
+
+		this.topics[name] = t
+		slog.Info(fmt.Sprintf("LOG: loaded %s : %d segments : last offset %d", name, len(t.segments), t.last))
+	}
+	return nil
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// writes the message to the end of its topic, setting its offset
+func (this *Log) Append (msg *QueMessage, tm int64) error {
+	t, err := this.topic(msg.Topic, true)
+	if err != nil { return err }
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	seg := t.active()
+	if seg == nil || seg.bytes >= this.segmentBytes {
+		if err := t.roll(); err != nil { return err }
+		seg = t.active()
+	}
+
+	msg.Offset = t.last + 1
+
+	cp := *msg // what's written doesn't need to know who it was from
+	cp.From, cp.Target, cp.Confirm = nil, nil, false
+
+	data, err := json.Marshal(&logRecord{ Time: tm, Message: &cp })
+	if err != nil { return errors.WithStack(err) }
+	data = append(data, '\n')
+
+	if _, err = t.file.Write(data); err != nil { return errors.WithStack(err) }
+
+	t.last = msg.Offset
+	if seg.count == 0 {
+		seg.first, seg.firstTime = msg.Offset, tm
+	}
+	seg.last, seg.lastTime = msg.Offset, tm
+	seg.bytes += int64(len(data))
+	seg.count++
+	return nil
+}
+
+// last offset written to the topic, 0 if nothing has been
+func (this *Log) Last (topic string) uint64 {
+	t, _ := this.topic(topic, false)
+	if t == nil { return 0 }
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.last
+}
+
+// messages from this offset on, oldest first, at most max of them
+func (this *Log) Read (topic string, from uint64, max int) ([]*QueMessage, error) {
+	t, _ := this.topic(topic, false)
+	if t == nil { return nil, nil }
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.read(from, max, func(*logRecord) bool { return true })
+}
+
+// messages appended since this time, unix milliseconds, oldest first, at most max of them
+func (this *Log) Since (topic string, tm int64, max int) ([]*QueMessage, error) {
+	t, _ := this.topic(topic, false)
+	if t == nil { return nil, nil }
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// skip the segments that are all older
+	from := t.last + 1
+	for _, seg := range t.segments {
+		if seg.count > 0 && seg.lastTime >= tm {
+			from = seg.first
+			break
+		}
+	}
+
+	return t.read(from, max, func(rec *logRecord) bool { return rec.Time >= tm })
+}
+
+// names of every topic in the log
+func (this *Log) Topics () []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make([]string, 0, len(this.topics))
+	for name := range this.topics {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (this *Log) Close () error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	errs := make([]string, 0)
+	for _, t := range this.topics {
+		t.lock.Lock()
+		if t.file != nil {
+			if err := t.file.Close(); err != nil {
+				errs = append(errs, err.Error())
+			}
+			t.file = nil
+		}
+		t.lock.Unlock()
+	}
+
+	if len(errs) > 0 { return errors.Errorf("closing the log : %s", strings.Join(errs, " : ")) }
+	return nil
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// opens the log in this directory, loading anything already there
+func NewLog (dir string, segmentBytes int64) (*Log, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil { return nil, errors.WithStack(err) }
+
+	ret := &Log{
+		dir: dir,
+		segmentBytes: segmentBytes,
+		topics: make(map[string]*topicLog),
+	}
+
+	if err := ret.load(); err != nil { return nil, err }
+	return ret, nil
+}
@@ -0,0 +1,57 @@
+package models 
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQALog (t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := NewLog (dir, 200) // small so we roll over a few times
+	TestingStackTrace (t, err)
+
+	for i := 1; i <= 10; i++ {
+		msg := &QueMessage{ Msg: []byte(fmt.Sprintf("msg-%d", i)) }
+		msg.Topic = "orders/eu" // needs escaping to be a directory
+		TestingStackTrace (t, log.Append (msg, int64(i * 1000)))
+		if msg.Offset != uint64(i) { t.Fatalf("expected offset %d, got %d", i, msg.Offset) }
+	}
+
+	files, _ := filepath.Glob (filepath.Join (dir, "*", "*" + segmentExt))
+	if len(files) < 2 { t.Fatalf("expected the log to roll over : %v", files) }
+
+	list, err := log.Read ("orders/eu", 4, 3)
+	TestingStackTrace (t, err)
+	if len(list) != 3 || string(list[0].Msg) != "msg-4" || list[2].Offset != 6 { t.Fatalf("unexpected read : %d", len(list)) }
+
+	list, err = log.Since ("orders/eu", 8000, 100)
+	TestingStackTrace (t, err)
+	if len(list) != 3 || string(list[0].Msg) != "msg-8" { t.Fatalf("unexpected since : %d", len(list)) }
+
+	TestingStackTrace (t, log.Close())
+
+	// a partial write from a crash is skipped
+	f, err := os.OpenFile (files[len(files) - 1], os.O_APPEND | os.O_WRONLY, 0600)
+	TestingStackTrace (t, err)
+	f.WriteString (`{"t":11000,"m":{"Msg":`)
+	f.Close()
+
+	// re-open it like we restarted, and keep going from where we left off
+	log, err = NewLog (dir, 200)
+	TestingStackTrace (t, err)
+	if log.Last ("orders/eu") != 10 { t.Fatalf("expected to pick up at 10, got %d", log.Last ("orders/eu")) }
+	if topics := log.Topics(); len(topics) != 1 || topics[0] != "orders/eu" { t.Fatalf("unexpected topics : %v", topics) }
+
+	msg := &QueMessage{ Msg: []byte("msg-11") }
+	msg.Topic = "orders/eu"
+	TestingStackTrace (t, log.Append (msg, 11000))
+	if msg.Offset != 11 { t.Fatalf("expected offset 11, got %d", msg.Offset) }
+
+	list, err = log.Read ("orders/eu", 1, 100)
+	TestingStackTrace (t, err)
+	if len(list) != 11 { t.Fatalf("expected everything back, got %d", len(list)) }
+	TestingStackTrace (t, log.Close())
+}
@@ -0,0 +1,46 @@
+/** ****************************************************************************************************************** **
+	Counters for the /metrics endpoint, written out in the prometheus text format
+	
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type Metrics struct {
+	Published atomic.Uint64 // messages accepted from publishers
+	Duplicates atomic.Uint64 // publishes dropped because we'd already seen the id
+	Expired atomic.Uint64 // messages dropped because their ttl passed before we delivered them
+	DeadLettered atomic.Uint64 // messages moved to a dead letter topic
+	Redelivered atomic.Uint64 // nacked messages we're trying again
+	CreditDropped atomic.Uint64 // messages dropped because a connection was out of credit and already holding too many
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// writes all our counters
+func (this *Metrics) Write (w io.Writer) {
+	WriteMetric (w, "k8mq_published_total", "counter", "Messages accepted from publishers", this.Published.Load())
+	WriteMetric (w, "k8mq_duplicates_total", "counter", "Published messages dropped as duplicates", this.Duplicates.Load())
+	WriteMetric (w, "k8mq_expired_total", "counter", "Messages dropped because their ttl passed", this.Expired.Load())
+	WriteMetric (w, "k8mq_dead_lettered_total", "counter", "Messages moved to a dead letter topic", this.DeadLettered.Load())
+	WriteMetric (w, "k8mq_redelivered_total", "counter", "Nacked messages that were redelivered", this.Redelivered.Load())
+	WriteMetric (w, "k8mq_credit_dropped_total", "counter", "Messages dropped because the connection was out of credit and holding too many", this.CreditDropped.Load())
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// writes a single metric with its help and type lines
+func WriteMetric (w io.Writer, name, kind, help string, value any) {
+	fmt.Fprintf (w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, kind, name, value)
+}
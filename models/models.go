@@ -6,9 +6,14 @@
 package models
 
 import (
+	"github.com/pkg/errors"
+
 	"fmt"
+	"context"
 	"crypto/sha256"
+	"os"
 	"time"
+	"encoding/json"
 )
 
   //-----------------------------------------------------------------------------------------------------------------------//
@@ -18,10 +23,20 @@ import (
 const DefaultPort		= 8088
 const ShutdownMessage	= "SHUTTING IT DOWN"
 
+var ErrNoReply			= errors.New("k8mq: message can't be replied to")
+
 type Callback = func() error // generic callback function that returns an error
 
 type ReadCallback = func([]byte) // reader interface for getting newly received messages
 
+// newer reader interface, gets everything we know about the message and can fail it
+// returning an error nacks the message so it gets redelivered, or dead lettered once it's out of attempts
+// the context is done once we're shutting down
+type Handler = func(context.Context, *Message) error
+
+// sends the body back to just whoever published the message being handled
+type ReplyFunc = func(context.Context, []byte) error
+
 // I don't like having to check for a nil callback function so i created this 
 func EmptyCallback () error {
 	return nil 
@@ -31,6 +46,19 @@ func EmptyCallback () error {
  //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
 //-----------------------------------------------------------------------------------------------------------------------//
 
+// what a Handler gets, the message and everything that travelled with it
+type Message struct {
+	Envelope
+	Body []byte
+	Replier ReplyFunc // set when we know who to reply to
+}
+
+// answers just the publisher of this message, eg for a Client.Request
+func (this *Message) Reply (ctx context.Context, body []byte) error {
+	if this.Replier == nil { return errors.WithStack(ErrNoReply) }
+	return this.Replier (ctx, body)
+}
+
 // This is designed to be inhereted by any system making message calls
 // it allows us to register listeners based on the IdHash we receive
 type MessageHashPrototype struct {
@@ -44,3 +72,38 @@ func (this *MessageHashPrototype) SetIdHash () {
     h.Write([]byte(fmt.Sprintf("local-salt:%d:%s", time.Now().UnixNano(), this.Body)))
     this.IdHash = fmt.Sprintf("%x", h.Sum(nil))
 }
+
+// returns the IdHash from the body, empty if it doesn't have one
+func IdHash (body []byte) string {
+	if len(body) == 0 || body[0] != '{' { return "" } // not json, so it can't have one
+
+	mHash := &MessageHashPrototype{}
+	if json.Unmarshal(body, mHash) != nil { return "" }
+	return mHash.IdHash
+}
+
+// returns the IdHash from the body if it has one, otherwise generates a new one for it
+func MessageId (body []byte) string {
+	if id := IdHash(body); len(id) > 0 { return id }
+
+	mHash := &MessageHashPrototype{ Body: body }
+	mHash.SetIdHash()
+	return mHash.IdHash
+}
+
+// writes to a temp file and renames it over the original, so a crash never leaves us with half a file
+func WriteFileAtomic (path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil { return err }
+	return os.Rename(tmp, path)
+}
+
+// wraps the older reader interface so it can be used as a Handler, returns nil for a nil reader
+func ReadCallbackHandler (reader ReadCallback) Handler {
+	if reader == nil { return nil }
+
+	return func(ctx context.Context, msg *Message) error {
+		reader(msg.Body)
+		return nil
+	}
+}
@@ -0,0 +1,210 @@
+/** ****************************************************************************************************************** **
+	Committed offsets for consumer groups
+	Each group has its own offset per topic and partition, so groups read the same topic at their own pace
+	When a partition moves to another member of the group, it picks up from what was committed
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+const DefaultGroup = "queue" // the group for subscribers in work queue mode that didn't name one
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type GroupOffset struct {
+	Group string `json:"group"`
+	Topic string `json:"topic"`
+	Partition int `json:"partition"`
+	Offset uint64 `json:"offset"` // last one committed
+}
+
+type Offsets struct {
+	path string // where we persist things, empty if we don't
+
+	lock sync.Mutex
+	committed map[string]map[string]map[int]uint64 // group, topic, partition
+	dirty bool // changed since we last saved
+
+	done chan bool
+	wg sync.WaitGroup
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+func (this *Offsets) run () {
+	defer this.wg.Done()
+
+	save := time.NewTicker(time.Second)
+	defer save.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-save.C:
+			if err := this.save(); err != nil {
+				slog.Warn("OFFSETS: failed to save : " + err.Error())
+			}
+		}
+	}
+}
+
+// writes out the offsets if anything changed
+func (this *Offsets) save () error {
+	if len(this.path) == 0 { return nil }
+
+	this.lock.Lock()
+	if this.dirty == false {
+		this.lock.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(this.committed)
+	this.dirty = false
+	this.lock.Unlock()
+
+	if err != nil { return errors.WithStack(err) }
+	return errors.WithStack(WriteFileAtomic(this.path, data))
+}
+
+func (this *Offsets) load () error {
+	data, err := os.ReadFile(this.path)
+	if os.IsNotExist(err) { return nil } // nothing saved yet
+	if err != nil { return errors.WithStack(err) }
+
+	if err = json.Unmarshal(data, &this.committed); err != nil { return errors.WithStack(err) }
+
+	if this.committed == nil {
+		this.committed = make(map[string]map[string]map[int]uint64)
+	}
+	return nil
+}
+
+// the offsets for the group and topic, creating them if we have to. expects the lock to be held
+func (this *Offsets) topic (group, topic string) map[int]uint64 {
+	topics, ok := this.committed[group]
+	if ok == false {
+		topics = make(map[string]map[int]uint64)
+		this.committed[group] = topics
+	}
+
+	ret, ok := topics[topic]
+	if ok == false {
+		ret = make(map[int]uint64)
+		topics[topic] = ret
+	}
+	return ret
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// a group new to the topic starts from this offset, so it only gets what's published from here on
+// does nothing if the group already has offsets for the topic
+func (this *Offsets) Start (group, topic string, partitions int, last uint64) {
+	topic = TopicName(topic)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if _, ok := this.committed[group][topic]; ok { return }
+
+	offsets := this.topic(group, topic)
+	for p := 0; p < partitions; p++ {
+		offsets[p] = last
+	}
+	this.dirty = true
+}
+
+// records that the group has handled everything in the partition up to this offset
+// offsets only go forward, returns false if this is older than what was committed
+func (this *Offsets) Commit (group, topic string, partition int, offset uint64) bool {
+	topic = TopicName(topic)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	offsets := this.topic(group, topic)
+	if current, ok := offsets[partition]; ok && offset <= current { return false }
+
+	offsets[partition] = offset
+	this.dirty = true
+	return true
+}
+
+// the last offset the group committed for the partition, false if it hasn't
+func (this *Offsets) Committed (group, topic string, partition int) (uint64, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret, ok := this.committed[group][TopicName(topic)][partition]
+	return ret, ok
+}
+
+// every group's committed offsets, sorted by group, topic and partition
+func (this *Offsets) List () []GroupOffset {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make([]GroupOffset, 0)
+	for group, topics := range this.committed {
+		for topic, offsets := range topics {
+			for p, offset := range offsets {
+				ret = append(ret, GroupOffset{ Group: group, Topic: topic, Partition: p, Offset: offset })
+			}
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Group != ret[j].Group { return ret[i].Group < ret[j].Group }
+		if ret[i].Topic != ret[j].Topic { return ret[i].Topic < ret[j].Topic }
+		return ret[i].Partition < ret[j].Partition
+	})
+	return ret
+}
+
+// stops saving in the background and saves what we have
+func (this *Offsets) Close () error {
+	close(this.done)
+	this.wg.Wait()
+
+	return this.save()
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// creates the offsets, path is optional and where they're persisted
+func NewOffsets (path string) (*Offsets, error) {
+	ret := &Offsets{
+		path: path,
+		committed: make(map[string]map[string]map[int]uint64),
+		done: make(chan bool),
+	}
+
+	if len(path) > 0 {
+		if err := ret.load(); err != nil { return nil, err }
+	}
+
+	ret.wg.Add(1)
+	go ret.run()
+
+	return ret, nil
+}
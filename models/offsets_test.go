@@ -0,0 +1,33 @@
+package models
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestQAOffsets (t *testing.T) {
+	path := filepath.Join (t.TempDir(), "offsets.json")
+
+	offsets, err := NewOffsets (path)
+	TestingStackTrace (t, err)
+
+	offsets.Start ("billing", "orders", 2, 10)
+	offsets.Start ("billing", "orders", 2, 50) // already started, so this does nothing
+	if offset, ok := offsets.Committed ("billing", "orders", 1); ok == false || offset != 10 { t.Fatalf("expected to start at 10, got %d", offset) }
+
+	if offsets.Commit ("billing", "orders", 1, 15) == false { t.Fatalf("expected the commit to go forward") }
+	if offsets.Commit ("billing", "orders", 1, 12) { t.Fatalf("expected an older commit to be ignored") }
+	offsets.Commit ("audit", "orders", 0, 3)
+
+	if _, ok := offsets.Committed ("audit", "orders", 1); ok { t.Fatalf("expected nothing committed") }
+
+	TestingStackTrace (t, offsets.Close())
+
+	// they survive a restart
+	offsets, err = NewOffsets (path)
+	TestingStackTrace (t, err)
+	defer offsets.Close()
+
+	list := offsets.List()
+	if len(list) != 3 || list[0].Group != "audit" || list[2].Partition != 1 || list[2].Offset != 15 { t.Fatalf("unexpected offsets : %+v", list) }
+}
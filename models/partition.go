@@ -0,0 +1,291 @@
+/** ****************************************************************************************************************** **
+	Partitioned topics, so messages with the same key stay in order without the whole topic being one at a time
+	A message's key hashes to one of the topic's partitions. The members of a consumer group share the partitions,
+	each one is owned by a single member at a time, so everything for a key goes to the same place in order
+	Every group gets every message. Partitions are rebalanced as members come and go, moving as few as we can
+	A topic's count comes from the config, or is declared at runtime before any group uses it, eg on the first subscribe
+	Declared counts are saved, so keys hash to the same partitions after a restart and committed offsets still line up
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+var ErrPartitionCount	= errors.New("k8mq: topic already has a different number of partitions")
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// who owns a partition, for the admin endpoint
+type PartitionOwner struct {
+	Topic string `json:"topic"`
+	Group string `json:"group"`
+	Partition int `json:"partition"`
+	Owner string `json:"owner,omitempty"` // connection id
+}
+
+type Partitions struct {
+	path string // where we save the declared counts, empty if we don't
+
+	lock sync.Mutex
+	counts map[string]int // partitions per topic, anything not in here has just the one
+	declared map[string]int // the ones declared at runtime rather than in the config
+	owners map[string]map[string][]*QueConn // owner of each partition by topic and group, only for groups with members
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// writes out the declared counts, expects the lock to be held
+func (this *Partitions) save () error {
+	if len(this.path) == 0 { return nil }
+
+	data, err := json.Marshal(this.declared)
+	if err != nil { return errors.WithStack(err) }
+
+	return errors.WithStack(WriteFileAtomic(this.path, data))
+}
+
+// picks up the counts declared before we restarted, the config wins if it's since changed one
+func (this *Partitions) load () error {
+	data, err := os.ReadFile(this.path)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return errors.WithStack(err) }
+
+	declared := make(map[string]int)
+	if err = json.Unmarshal(data, &declared); err != nil { return errors.WithStack(err) }
+
+	for topic, n := range declared {
+		if current, ok := this.counts[topic]; ok {
+			if current != n {
+				slog.Warn(fmt.Sprintf("PARTITIONS: %s was declared with %d partitions, using the %d it's configured with", topic, n, current))
+			}
+			continue
+		}
+		this.counts[topic] = n
+		this.declared[topic] = n
+	}
+	return nil
+}
+
+// number of partitions the topic has, expects the lock to be held
+func (this *Partitions) count (topic string) int {
+	if n, ok := this.counts[TopicName(topic)]; ok { return n }
+	return 1
+}
+
+// assigns the partitions to the members, keeping what each already owns as long as it's within its share
+// members are in the order they connected, so the oldest ones pick up any extra. expects the lock to be held
+func (this *Partitions) assign (topic, group string, workers []*QueConn) {
+	if len(workers) == 0 {
+		delete(this.owners[topic], group)
+		if len(this.owners[topic]) == 0 {
+			delete(this.owners, topic)
+		}
+		return
+	}
+
+	n := this.count(topic)
+	share := func(i int) int {
+		if i < n % len(workers) { return n / len(workers) + 1 }
+		return n / len(workers)
+	}
+
+	index := make(map[*QueConn]int, len(workers))
+	for i, conn := range workers {
+		index[conn] = i
+	}
+
+	owners := make([]*QueConn, n)
+	counts := make([]int, len(workers))
+
+	for p, conn := range this.owners[topic][group] { // keep what we can
+		i, ok := index[conn]
+		if ok == false || p >= n || counts[i] >= share(i) { continue }
+
+		owners[p] = conn
+		counts[i]++
+	}
+
+	next := 0
+	for p := range owners { // and hand out the rest
+		if owners[p] != nil { continue }
+
+		for counts[next] >= share(next) {
+			next++
+		}
+		owners[p] = workers[next]
+		counts[next]++
+	}
+
+	if this.owners[topic] == nil {
+		this.owners[topic] = make(map[string][]*QueConn)
+	}
+	this.owners[topic][group] = owners
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// number of partitions the topic has
+func (this *Partitions) Count (topic string) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.count(topic)
+}
+
+// gives the topic this many partitions, if it doesn't have a count yet and no group has started using it
+// declaring the count it already has is fine, otherwise it returns ErrPartitionCount
+// it's saved before we return, so it's the same after a restart
+func (this *Partitions) Declare (topic string, n int) error {
+	if n < 1 { return errors.Errorf("partitions for %s : count has to be at least 1", topic) }
+	topic = TopicName(topic)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.count(topic) == n { return nil }
+
+	if _, ok := this.counts[topic]; ok || len(this.owners[topic]) > 0 { // a group is already sharing out the one it has
+		return errors.Wrap(ErrPartitionCount, fmt.Sprintf("%s has %d", topic, this.count(topic)))
+	}
+
+	this.counts[topic], this.declared[topic] = n, n
+	if err := this.save(); err != nil {
+		delete(this.counts, topic) // it wouldn't last, so it doesn't count
+		delete(this.declared, topic)
+		return err
+	}
+	return nil
+}
+
+// sets which partition the message goes to, by its key, or its sequence number to spread out messages without one
+func (this *Partitions) Assign (msg *QueMessage) {
+	n := this.Count(msg.Topic)
+	if n <= 1 {
+		msg.Partition = 0 // whatever the publisher set doesn't count
+		return
+	}
+
+	if len(msg.Key) == 0 {
+		msg.Partition = int(msg.Seq % uint64(n))
+		return
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(msg.Key))
+	msg.Partition = int(h.Sum32() % uint32(n))
+}
+
+// the member of the group that owns the partition, nil if the group doesn't have any
+func (this *Partitions) Owner (topic, group string, partition int) *QueConn {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	owners := this.owners[TopicName(topic)][group]
+	if partition < 0 || partition >= len(owners) { return nil }
+	return owners[partition]
+}
+
+// the owner of the partition in each group, so every group gets the message
+func (this *Partitions) Owners (topic string, partition int) []*QueConn {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make([]*QueConn, 0)
+	for _, owners := range this.owners[TopicName(topic)] {
+		if partition >= 0 && partition < len(owners) {
+			ret = append(ret, owners[partition])
+		}
+	}
+	return ret
+}
+
+// re-assigns the topic's partitions to the group's members, called as they come and go
+// members should be in the order they connected, returns the partitions each member picked up
+func (this *Partitions) Rebalance (topic, group string, members func() []*QueConn) map[*QueConn][]int {
+	topic = TopicName(topic)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	before := this.owners[topic][group]
+	this.assign(topic, group, members()) // gathered with the lock held so two rebalances can't cross
+
+	ret := make(map[*QueConn][]int)
+	for p, conn := range this.owners[topic][group] {
+		if p >= len(before) || before[p] != conn {
+			ret[conn] = append(ret[conn], p)
+		}
+	}
+	return ret
+}
+
+// who owns each partition, for every group with members
+func (this *Partitions) List () []PartitionOwner {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make([]PartitionOwner, 0)
+	for topic, groups := range this.owners {
+		for group, owners := range groups {
+			for p, conn := range owners {
+				ret = append(ret, PartitionOwner{ Topic: topic, Group: group, Partition: p, Owner: conn.Id() })
+			}
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Topic != ret[j].Topic { return ret[i].Topic < ret[j].Topic }
+		if ret[i].Group != ret[j].Group { return ret[i].Group < ret[j].Group }
+		return ret[i].Partition < ret[j].Partition
+	})
+	return ret
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// creates the partitions from a list of topic=count, eg orders=12, along with any declared before we restarted
+// path is where we save the declared ones, empty if we don't
+func NewPartitions (list []string, path string) (*Partitions, error) {
+	ret := &Partitions{
+		path: path,
+		counts: make(map[string]int),
+		declared: make(map[string]int),
+		owners: make(map[string]map[string][]*QueConn),
+	}
+
+	for _, str := range list {
+		topic, count, ok := strings.Cut(str, "=")
+		if ok == false || len(strings.TrimSpace(topic)) == 0 { return nil, errors.Errorf("partitions %q : expected topic=count", str) }
+
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n < 1 { return nil, errors.Errorf("partitions %q : count has to be at least 1", str) }
+
+		ret.counts[TopicName(strings.TrimSpace(topic))] = n
+	}
+
+	if len(path) > 0 {
+		if err := ret.load(); err != nil { return nil, err }
+	}
+	return ret, nil
+}
@@ -0,0 +1,116 @@
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestQAPartitions (t *testing.T) {
+	if _, err := NewPartitions ([]string{ "orders" }, ""); err == nil { t.Fatalf("expected a missing count to fail") }
+	if _, err := NewPartitions ([]string{ "orders=0" }, ""); err == nil { t.Fatalf("expected a 0 count to fail") }
+
+	p, err := NewPartitions ([]string{ "orders=6" }, "")
+	TestingStackTrace (t, err)
+	if p.Count ("orders") != 6 || p.Count ("other") != 1 { t.Fatalf("unexpected counts") }
+
+	// the same key always lands in the same partition
+	msg := &QueMessage{}
+	msg.Topic, msg.Key = "orders", "customer-1"
+	p.Assign (msg)
+	first := msg.Partition
+	for i := 0; i < 5; i++ {
+		msg.Seq = uint64(i)
+		p.Assign (msg)
+		if msg.Partition != first { t.Fatalf("key moved partitions : %d : %d", first, msg.Partition) }
+	}
+
+	msg.Topic, msg.Partition = "other", 3
+	p.Assign (msg)
+	if msg.Partition != 0 { t.Fatalf("expected unpartitioned topics to use 0, got %d", msg.Partition) }
+
+	// share them out as workers come and go
+	a, b, c := &QueConn{ id: "a" }, &QueConn{ id: "b" }, &QueConn{ id: "c" }
+	workers := []*QueConn{ a }
+	rebalance := func() map[*QueConn][]int { return p.Rebalance ("orders", "billing", func() []*QueConn { return workers }) }
+
+	owned := func() map[*QueConn][]int {
+		ret := make(map[*QueConn][]int)
+		for i := 0; i < 6; i++ {
+			owner := p.Owner ("orders", "billing", i)
+			ret[owner] = append(ret[owner], i)
+		}
+		return ret
+	}
+
+	if len(rebalance()[a]) != 6 || len(owned()[a]) != 6 { t.Fatalf("expected a to own everything : %v", owned()) }
+
+	workers = []*QueConn{ a, b }
+	rebalance()
+	before := owned()
+	if len(before[a]) != 3 || len(before[b]) != 3 { t.Fatalf("expected an even split : %v", before) }
+
+	workers = []*QueConn{ a, b, c }
+	if gained := rebalance(); len(gained) != 1 || len(gained[c]) != 2 { t.Fatalf("expected only c to pick up partitions : %v", gained) }
+	after := owned()
+	if len(after[a]) != 2 || len(after[b]) != 2 || len(after[c]) != 2 { t.Fatalf("expected an even split : %v", after) }
+
+	for _, i := range after[a] { // nothing moves between the ones that were already there
+		if p.Owner ("orders", "billing", i) != a || slices.Contains (before[a], i) == false { t.Fatalf("a's partition %d moved", i) }
+	}
+
+	if len(rebalance()) != 0 { t.Fatalf("expected nothing to move") }
+
+	// another group gets every message too
+	d := &QueConn{ id: "d" }
+	p.Rebalance ("orders", "audit", func() []*QueConn { return []*QueConn{ d } })
+	if list := p.Owners ("orders", 4); len(list) != 2 || slices.Contains (list, d) == false { t.Fatalf("expected an owner from each group : %v", list) }
+	if len(p.List()) != 12 { t.Fatalf("expected 12 owners, got %d", len(p.List())) }
+
+	workers = nil
+	rebalance()
+	if p.Owner ("orders", "billing", 0) != nil || len(p.List()) != 6 { t.Fatalf("expected only the audit group to have owners") }
+}
+
+func TestQAPartitionsDeclare (t *testing.T) {
+	p, err := NewPartitions ([]string{ "orders=6" }, "")
+	TestingStackTrace (t, err)
+
+	// a topic without a count can be given one, once
+	TestingStackTrace (t, p.Declare ("jobs", 4))
+	if p.Count ("jobs") != 4 { t.Fatalf("expected 4 partitions, got %d", p.Count ("jobs")) }
+	TestingStackTrace (t, p.Declare ("jobs", 4)) // the same again is fine
+	if err := p.Declare ("jobs", 2); errors.Is (err, ErrPartitionCount) == false { t.Fatalf("expected a count conflict, got %v", err) }
+
+	// the config wins
+	TestingStackTrace (t, p.Declare ("orders", 6))
+	if err := p.Declare ("orders", 3); errors.Is (err, ErrPartitionCount) == false { t.Fatalf("expected a count conflict, got %v", err) }
+	if err := p.Declare ("other", 0); err == nil { t.Fatal("expected a 0 count to fail") }
+
+	// once a group is sharing out the one partition it's too late
+	p.Rebalance ("late", "billing", func() []*QueConn { return []*QueConn{ &QueConn{ id: "a" } } })
+	if err := p.Declare ("late", 3); errors.Is (err, ErrPartitionCount) == false { t.Fatalf("expected a count conflict, got %v", err) }
+}
+
+func TestQAPartitionsPersist (t *testing.T) {
+	path := filepath.Join (t.TempDir(), "partitions.json")
+
+	p, err := NewPartitions (nil, path)
+	TestingStackTrace (t, err)
+	TestingStackTrace (t, p.Declare ("jobs", 4))
+	TestingStackTrace (t, p.Declare ("orders", 3))
+
+	// declared counts survive a restart, so keys still hash to the same partitions
+	p, err = NewPartitions ([]string{ "orders=6" }, path)
+	TestingStackTrace (t, err)
+	if p.Count ("jobs") != 4 { t.Fatalf("expected the declared count to be loaded, got %d", p.Count ("jobs")) }
+	if p.Count ("orders") != 6 { t.Fatalf("expected the config to win, got %d", p.Count ("orders")) }
+	if err = p.Declare ("jobs", 2); err == nil { t.Fatal("expected a loaded count to conflict like any other") }
+
+	// a count we couldn't save isn't kept
+	bad, err := NewPartitions (nil, filepath.Join (t.TempDir(), "missing", "partitions.json"))
+	TestingStackTrace (t, err)
+	if err = bad.Declare ("jobs", 4); err == nil || bad.Count ("jobs") != 1 { t.Fatalf("expected the declare to fail and be rolled back : %v", err) }
+}
@@ -0,0 +1,104 @@
+/** ****************************************************************************************************************** **
+	Presence, who's connected to us right now
+	Clients that ask for it get a join or leave event on the presence topic as connections come and go
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+const PresenceTopic		= "k8mq.presence" // system topic the events go out on, and member lists come back on
+const PresenceParam		= "presence" // query param a client sets to 1 if it wants the events
+
+const (
+	PresenceJoin		= "join"
+	PresenceLeave		= "leave"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// a connected client
+type Member struct {
+	Id string `json:"id"`
+	Pod string `json:"pod,omitempty"`
+	Service string `json:"service,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Connected time.Time `json:"connected"`
+	LastActive time.Time `json:"last_active"` // last time we heard from them
+	Held int `json:"held,omitempty"` // messages waiting on credit from them
+}
+
+type PresenceEvent struct {
+	Event string `json:"event"` // join or leave
+	Member Member `json:"member"`
+}
+
+//----- QueConn -----------------------------------------------------------------------------------------------------//
+
+// records that we just heard from the client
+func (this *QueConn) Touch () {
+	this.lastActive.Store(time.Now().UnixMilli())
+}
+
+func (this *QueConn) Member () Member {
+	return Member{
+		Id: this.id,
+		Pod: this.info.Pod,
+		Service: this.info.Service,
+		Labels: this.info.Labels,
+		Connected: this.connected,
+		LastActive: time.UnixMilli(this.lastActive.Load()),
+		Held: this.Held(),
+	}
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// lets everyone who asked know about the connection coming or going
+// these are written straight out so they can be sent from the goroutine that writes the messages
+func (this *Que) announce (event string, conn *QueConn) {
+	data, err := json.Marshal(&PresenceEvent{ Event: event, Member: conn.Member() })
+	if err != nil {
+		slog.Warn("QUE: unable to marshal presence event : " + err.Error())
+		return
+	}
+
+	frame := &Frame{ Type: FrameMessage, Envelope: Envelope{ Id: MessageId(nil), Topic: PresenceTopic, Published: time.Now().UnixMilli() }, Body: data }
+
+	for _, c := range this.conns() {
+		if c == conn || c.info.Presence == false || c.ctx.Err() != nil { continue }
+
+		if err := c.WriteFrame(frame); err != nil {
+			slog.Info("QUE: unable to write presence event : " + err.Error()) // they'll get removed on the next message
+		}
+	}
+
+	slog.Info(fmt.Sprintf("QUE: %s : %s", event, conn.id))
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// everyone connected, oldest connection first
+// this is thread safe
+func (this *Que) Members () []Member {
+	ret := make([]Member, 0)
+	for _, conn := range this.Conns() {
+		ret = append(ret, conn.Member())
+	}
+
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Connected.Before(ret[j].Connected) })
+	return ret
+}
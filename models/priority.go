@@ -0,0 +1,296 @@
+/** ****************************************************************************************************************** **
+	Priority levels for messages, and the queue that drains the higher ones first
+	Each level has its own room, so urgent messages never wait on bulk traffic to make space
+	A level that keeps getting passed over is let through every so often so nothing waits forever
+	Priority only reorders messages with different keys, ones with the same key always go out in the order they came in
+	Things to run in between messages are fences, everything before them goes first and nothing after them overtakes them
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"context"
+	"math"
+	"sync"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type Priority int
+
+const (
+	PriorityLow		Priority = -1 // bulk traffic, anything else goes first
+	PriorityNormal	Priority = 0 // default
+	PriorityHigh	Priority = 1
+	PriorityUrgent	Priority = 2 // control messages, eg cache flushes
+)
+
+// highest first, the order we drain them in
+var priorities = [...]Priority{ PriorityUrgent, PriorityHigh, PriorityNormal, PriorityLow }
+
+var ErrPriorityFull		= errors.New("k8mq: priority queue is full")
+var ErrPriorityClosed	= errors.New("k8mq: priority queue is closed")
+
+// where in our lists this priority goes, anything out of range is treated as the closest level
+func (this Priority) level () int {
+	switch {
+	case this <= PriorityLow:
+		return 0
+	case this >= PriorityUrgent:
+		return len(priorities) - 1
+	}
+	return int(this - PriorityLow)
+}
+
+// the closest of our levels to this priority
+func (this Priority) Clamp () Priority {
+	return priorities[len(priorities) - 1 - this.level()]
+}
+
+func (this Priority) String () string {
+	switch {
+	case this <= PriorityLow:
+		return "low"
+	case this == PriorityNormal:
+		return "normal"
+	case this == PriorityHigh:
+		return "high"
+	}
+	return "urgent"
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// decides which priority goes next, keeping track of how long the lower ones have been waiting
+type PriorityPicker struct {
+	Starve int // times a level can be passed over, DefaultPriorityStarve if it's not set
+	waits [len(priorities)]int
+}
+
+// a message waiting in the queue, seq is the order it was pushed in
+type queued struct {
+	msg *QueMessage
+	seq uint64
+}
+
+// drains queued messages highest priority first, safe to use from multiple threads
+type PriorityQueue struct {
+	size int // room for each level
+	picker PriorityPicker
+
+	lock sync.Mutex
+	levels [len(priorities)][]queued
+	fences []queued // things to run in order with the messages, they don't have a priority
+	seq uint64 // last one handed out
+	count int
+	closed bool
+	ready chan bool // closed and replaced when something's added
+	room chan bool // closed and replaced when something's taken off
+	done chan bool // closed with the queue, so anyone waiting on room bails
+}
+
+//----- PriorityPicker -----------------------------------------------------------------------------------------------------//
+
+// the priority that should go next, waiting says if there's anything at that priority
+// false if there's nothing waiting at all
+func (this *PriorityPicker) Next (waiting func(Priority) bool) (Priority, bool) {
+	starve := this.Starve
+	if starve <= 0 {
+		starve = DefaultPriorityStarve
+	}
+
+	// anything that's been passed over too many times goes first, lowest has been waiting the longest
+	pick, found := PriorityNormal, false
+	for i := len(priorities) - 1; i >= 0 && found == false; i-- {
+		if this.waits[priorities[i].level()] >= starve && waiting(priorities[i]) {
+			pick, found = priorities[i], true
+		}
+	}
+
+	for i := 0; i < len(priorities) && found == false; i++ {
+		if waiting(priorities[i]) {
+			pick, found = priorities[i], true
+		}
+	}
+	if found == false { return pick, false }
+
+	for _, p := range priorities {
+		if p == pick {
+			this.waits[p.level()] = 0
+		} else if p < pick && waiting(p) {
+			this.waits[p.level()]++ // passed over again
+		}
+	}
+	return pick, true
+}
+
+//----- PriorityQueue -----------------------------------------------------------------------------------------------------//
+
+// wakes up anyone waiting on this, expects the lock to be held
+func (this *PriorityQueue) signal (ch *chan bool) {
+	close(*ch)
+	*ch = make(chan bool)
+}
+
+// takes the one at the index off the level, expects the lock to be held
+func (this *PriorityQueue) remove (level, idx int) *QueMessage {
+	list := this.levels[level]
+	ret := list[idx].msg
+	copy(list[idx:], list[idx+1:])
+	list[len(list)-1] = queued{} // let it go
+	this.levels[level] = list[:len(list)-1]
+	return ret
+}
+
+// the next thing to go out, expects the lock to be held and something to be waiting
+func (this *PriorityQueue) next () *QueMessage {
+	// nothing pushed after the first fence can go before it
+	limit := uint64(math.MaxUint64)
+	if len(this.fences) > 0 {
+		limit = this.fences[0].seq
+	}
+
+	p, ok := this.picker.Next (func(p Priority) bool {
+		list := this.levels[p.level()]
+		return len(list) > 0 && list[0].seq < limit
+	})
+	if ok == false { // everything before the fence is gone, so it's up
+		ret := this.fences[0].msg
+		this.fences[0] = queued{}
+		this.fences = this.fences[1:]
+		return ret
+	}
+
+	// an older message with the same key goes first, whatever its priority
+	level, idx := p.level(), 0
+	head := this.levels[level][0]
+	if key := head.msg.OrderKey(); len(key) > 0 {
+		best := head.seq
+		for l := range this.levels {
+			for i, q := range this.levels[l] {
+				if q.seq >= best { break } // they're in order within a level
+				if q.msg.OrderKey() == key {
+					level, idx, best = l, i, q.seq
+					break
+				}
+			}
+		}
+	}
+
+	return this.remove (level, idx)
+}
+
+// adds the message at its priority, or as a fence if it's something to run
+// when block is false we return ErrPriorityFull instead of waiting for room
+// returns ErrPriorityClosed once the queue is closed
+func (this *PriorityQueue) Push (ctx context.Context, msg *QueMessage, block bool) error {
+	level := msg.Priority.level()
+
+	for {
+		this.lock.Lock()
+		if this.closed {
+			this.lock.Unlock()
+			return ErrPriorityClosed
+		}
+
+		if msg.do != nil { // fences don't take up any room
+			this.seq++
+			this.fences = append(this.fences, queued{ msg: msg, seq: this.seq })
+			this.count++
+			this.signal (&this.ready)
+			this.lock.Unlock()
+			return nil
+		}
+
+		if this.size <= 0 || len(this.levels[level]) < this.size {
+			this.seq++
+			this.levels[level] = append(this.levels[level], queued{ msg: msg, seq: this.seq })
+			this.count++
+			this.signal (&this.ready)
+			this.lock.Unlock()
+			return nil
+		}
+
+		room := this.room
+		this.lock.Unlock()
+
+		if block == false { return ErrPriorityFull }
+
+		select {
+		case <-room:
+		case <-this.done:
+			return ErrPriorityClosed
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		}
+	}
+}
+
+// takes the next message off, waiting for one if we're empty
+// once we're closed this returns what's left, then false
+func (this *PriorityQueue) Pop () (*QueMessage, bool) {
+	for {
+		this.lock.Lock()
+		if this.count > 0 {
+			ret := this.next()
+			this.count--
+
+			this.signal (&this.room)
+			this.lock.Unlock()
+			return ret, true
+		}
+
+		if this.closed {
+			this.lock.Unlock()
+			return nil, false
+		}
+
+		ready := this.ready
+		this.lock.Unlock()
+		<-ready
+	}
+}
+
+// number of messages waiting at any priority
+func (this *PriorityQueue) Len () int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.count
+}
+
+// nothing else can be pushed, and Pop returns false once what's left has been taken off
+// safe to call more than once
+func (this *PriorityQueue) Close () {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed { return }
+	this.closed = true
+
+	close(this.done)
+	this.signal (&this.ready)
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// size is how many messages each priority can hold before pushing blocks, 0 for no limit
+// starve is how many times a priority can be passed over before it gets a turn, 0 for the default
+func NewPriorityQueue (size, starve int) *PriorityQueue {
+	return &PriorityQueue{
+		size: size,
+		picker: PriorityPicker{ Starve: starve },
+		ready: make(chan bool),
+		room: make(chan bool),
+		done: make(chan bool),
+	}
+}
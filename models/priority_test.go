@@ -0,0 +1,113 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQAPriorityQueue (t *testing.T) {
+	ctx := context.Background()
+	q := NewPriorityQueue (2, 3)
+
+	push := func (body string, p Priority) error {
+		msg := &QueMessage{ Msg: []byte(body) }
+		msg.Priority = p
+		return q.Push (ctx, msg, false)
+	}
+
+	TestingStackTrace (t, push ("bulk-1", PriorityLow))
+	TestingStackTrace (t, push ("bulk-2", PriorityLow))
+	if push ("bulk-3", PriorityLow) != ErrPriorityFull { t.Fatalf("expected the low level to be full") }
+
+	// each level has its own room, so bulk traffic doesn't hold up anything else
+	TestingStackTrace (t, push ("flush", PriorityUrgent))
+	TestingStackTrace (t, push ("order", PriorityNormal))
+	TestingStackTrace (t, push ("way-up", Priority(10))) // treated as urgent
+
+	for _, want := range []string{ "flush", "way-up", "order", "bulk-1", "bulk-2" } {
+		msg, ok := q.Pop()
+		if ok == false || string(msg.Msg) != want { t.Fatalf("expected %s, got %v", want, msg) }
+	}
+	if q.Len() != 0 { t.Fatalf("expected it to be empty") }
+
+	// a blocked push gets room once something's taken off
+	TestingStackTrace (t, push ("bulk-1", PriorityLow))
+	TestingStackTrace (t, push ("bulk-2", PriorityLow))
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		q.Pop()
+	}()
+	TestingStackTrace (t, q.Push (ctx, &QueMessage{ Envelope: Envelope{ Priority: PriorityLow } }, true))
+
+	// and gets kicked out by closing
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		q.Close()
+	}()
+	if err := q.Push (ctx, &QueMessage{ Envelope: Envelope{ Priority: PriorityLow } }, true); err != ErrPriorityClosed { t.Fatalf("expected ErrPriorityClosed, got %v", err) }
+
+	// what's left still comes off after closing
+	for i := 0; i < 2; i++ {
+		if _, ok := q.Pop(); ok == false { t.Fatalf("expected what was left to come off") }
+	}
+	if _, ok := q.Pop(); ok { t.Fatalf("expected it to be closed") }
+}
+
+func TestQAPriorityStarve (t *testing.T) {
+	picker := &PriorityPicker{ Starve: 3 }
+	waiting := func (p Priority) bool { return p == PriorityUrgent || p == PriorityLow }
+
+	// low gets a turn after being passed over 3 times
+	list := make([]Priority, 0)
+	for i := 0; i < 8; i++ {
+		p, ok := picker.Next (waiting)
+		if ok == false { t.Fatalf("expected something to be waiting") }
+		list = append(list, p)
+	}
+
+	want := []Priority{ PriorityUrgent, PriorityUrgent, PriorityUrgent, PriorityLow, PriorityUrgent, PriorityUrgent, PriorityUrgent, PriorityLow }
+	for i := range want {
+		if list[i] != want[i] { t.Fatalf("unexpected order : %v", list) }
+	}
+
+	if _, ok := picker.Next (func(Priority) bool { return false }); ok { t.Fatalf("expected nothing to be waiting") }
+}
+
+func TestQAPriorityOrder (t *testing.T) {
+	ctx := context.Background()
+	q := NewPriorityQueue (0, 0)
+
+	order := make([]string, 0)
+	push := func (body, key string, p Priority) {
+		msg := &QueMessage{ Msg: []byte(body) }
+		msg.Topic, msg.Key, msg.Priority = "jobs", key, p
+		TestingStackTrace (t, q.Push (ctx, msg, false))
+	}
+	fence := func (body string) {
+		TestingStackTrace (t, q.Push (ctx, &QueMessage{ do: func() { order = append(order, body) } }, false))
+	}
+
+	// priority only gets ahead of messages with a different key
+	push ("low-a", "a", PriorityLow)
+	push ("low-b", "b", PriorityLow)
+	push ("urgent-a", "a", PriorityUrgent)
+	push ("urgent-c", "c", PriorityUrgent)
+
+	// nothing overtakes a fence, and it waits on everything before it
+	fence ("fence")
+	push ("urgent-d", "", PriorityUrgent)
+
+	for q.Len() > 0 {
+		msg, _ := q.Pop()
+		if msg.do != nil {
+			msg.do()
+		} else {
+			order = append(order, string(msg.Msg))
+		}
+	}
+
+	want := "low-a urgent-a urgent-c low-b fence urgent-d"
+	if got := strings.Join(order, " "); got != want { t.Fatalf("expected %s, got %s", want, got) }
+}
@@ -1,6 +1,6 @@
 /** ****************************************************************************************************************** **
 	que list object for managing open connections and sending messages
-	
+
 ** ****************************************************************************************************************** **/
 
 package models
@@ -8,9 +8,14 @@ package models
 import (
 	"github.com/pkg/errors"
 	"github.com/gorilla/websocket"
-	
+
 	"context"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"fmt"
 	"log/slog"
@@ -20,31 +25,313 @@ import (
  //----- CONSTS ----------------------------------------------------------------------------------------------------------//
 //-----------------------------------------------------------------------------------------------------------------------//
 
+var ErrQueClosed	= errors.New("k8mq: server is shutting down")
+var ErrExpired		= errors.New("k8mq: message expired")
+var ErrNotConnected	= errors.New("k8mq: connection not found")
+
+const earlyMax = 10000 // most offsets we remember sending a connection before it subscribed
+
   //-----------------------------------------------------------------------------------------------------------------------//
  //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
 //-----------------------------------------------------------------------------------------------------------------------//
 
-type queConn struct {
+// what we know about a connection when it's added
+type ConnInfo struct {
+	Proto int // protocol version the client speaks, 0 for raw messages only
+	Id string // what the client calls itself, empty if it didn't say
+	Pod string
+	Service string
+	Labels map[string]string
+	Presence bool // wants join and leave events
+	NoEcho bool // doesn't want its own broadcasts sent back to it
+}
+
+// query params for connecting with this info
+func (this ConnInfo) Query () url.Values {
+	ret := url.Values{}
+	ret.Set(ProtocolParam, strconv.Itoa(this.Proto))
+
+	if len(this.Id) > 0 { ret.Set(ClientIdParam, this.Id) }
+	if len(this.Pod) > 0 { ret.Set(PodParam, this.Pod) }
+	if len(this.Service) > 0 { ret.Set(ServiceParam, this.Service) }
+	if this.Presence { ret.Set(PresenceParam, "1") }
+	if this.NoEcho { ret.Set(NoEchoParam, "1") }
+
+	keys := make([]string, 0, len(this.Labels))
+	for key := range this.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // so we're consistent
+
+	for _, key := range keys {
+		ret.Add(LabelParam, key + "=" + this.Labels[key])
+	}
+	return ret
+}
+
+type QueConn struct {
+	id string // unique for this server
 	client *websocket.Conn
 	ctx context.Context // to check if it's still good
+	info ConnInfo
+	connected time.Time
+	lastActive atomic.Int64 // unix milliseconds
+	lock sync.Mutex // websocket connections only support one writer at a time
+
+	subLock sync.Mutex
+	subs map[string]string // topics they've subscribed to, and the consumer group if they're in one. they get everything until they subscribe to something
+	early map[string]map[uint64]bool // offsets they got live before subscribing, by topic, so a replay doesn't send them again
+	earlyCount int
+
+	flowLock sync.Mutex
+	flow bool // the client is granting us credit, there's no limit until it does
+	credit int // messages we can send before it grants more
+	held *PriorityQueue // waiting on credit
+	holdMax int // most we'll hold at each priority before dropping them, 0 for no limit
+	metrics *Metrics // the que's, for counting what we drop
 }
 
 type QueMessage struct {
 	Msg []byte 
 	Reques int // times this message has been re-queed
+	Envelope // metadata for clients that speak frames
+	Confirm bool // the publisher wants an ack once this has gone out
+	Type FrameType `json:",omitempty"` // what the client sends this as, a publish when empty
+	From *QueConn `json:"-"` // connection that published this, nil if it came from the server itself
+	Target *QueConn `json:"-"` // only send this to this connection, eg a redelivery, nil for everyone
+	do func() // not a message, just something to run in order with them
+}
+
+// an empty message with a key, in a compacted topic it deletes the key
+func (this *QueMessage) Tombstone () bool {
+	return len(this.Msg) == 0 && len(this.Key) > 0
+}
+
+// the server's own notices, eg the shutdown message for raw clients, they're not part of any topic's history
+func (this *QueMessage) control () bool {
+	return len(this.Sender) == 0 && string(this.Msg) == ShutdownMessage
+}
+
+// messages with the same order key go out in the order they came in, whatever their priority
+// empty for ones without a key, and redeliveries which are already out of order
+func (this *QueMessage) OrderKey () string {
+	if len(this.Key) == 0 || this.Target != nil { return "" }
+	return TopicName(this.Topic) + "/" + this.Key
+}
+
+// what the message looks like to clients that speak frames
+func (this *QueMessage) Frame () *Frame {
+	ret := &Frame{ Type: FrameMessage, Envelope: this.Envelope, Body: this.Msg }
+	ret.Ref = "" // that was just between us and the publisher
+	return ret
 }
 
 type Que struct {
 	opts *OPTS
-	list []*queConn
+	list []*QueConn
+	listLock sync.Mutex
 	wg *sync.WaitGroup
-	inConnection chan *queConn
-	messages chan *QueMessage
+	inConnection chan *QueConn
+	messages *PriorityQueue
+	messagesLock sync.RWMutex // write locked while we close the channels
+	closed bool
+	sending atomic.Int32 // set while a message is being written out to the connections
+	seq atomic.Uint64 // last sequence number handed out
+	connSeq atomic.Uint64 // for giving connections an id
+	metrics *Metrics
+	history *History // nil if we're not keeping one
+	partitions *Partitions
+	offsets *Offsets // committed by the consumer groups, nil if we're not keeping track
+}
+
+
+//----- QueConn -----------------------------------------------------------------------------------------------------//
+
+// writes the raw data out to the connection, this is thread safe
+func (this *QueConn) Write (data []byte) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.client.WriteMessage (websocket.TextMessage, data)
+}
+
+// writes a frame, only if the client on the other end knows what to do with them
+func (this *QueConn) WriteFrame (frame *Frame) error {
+	if this.info.Proto < ProtocolVersion { return nil } // they wouldn't understand it
+	return this.Write (frame.Marshal())
+}
+
+// lets the publisher know we've accepted their message, if they asked
+func (this *QueConn) Ack (msg *QueMessage) error {
+	if msg.Confirm == false { return nil }
+	return this.WriteFrame (&Frame{ Type: FrameAck, Envelope: Envelope{ Id: msg.Id, Ref: msg.Ref, Seq: msg.Seq } })
+}
+
+// lets the publisher know we rejected their message, if they asked
+func (this *QueConn) Nack (msg *QueMessage, reason error) error {
+	if msg.Confirm == false { return nil }
+	return this.WriteFrame (&Frame{ Type: FrameError, Envelope: Envelope{ Id: msg.Id, Ref: msg.Ref }, Error: reason.Error() })
+}
+
+func (this *QueConn) Info () ConnInfo {
+	return this.info
+}
+
+// false if this is the client that published the message and either of them asked not to get it back
+func (this *QueConn) echo (msg *QueMessage) bool {
+	if len(msg.Sender) == 0 || msg.Sender != this.id { return true }
+	return msg.NoEcho == false && this.info.NoEcho == false
+}
+
+// true if the message should go out to this connection
+func (this *QueConn) accepts (msg *QueMessage, sel Selector) bool {
+	return this.echo (msg) && this.wants (msg) && sel.Matches (this.info.Labels)
+}
+
+// writes out history to just this connection, skipping anything it wouldn't have gotten live
+// this is thread safe, but should be called from Que.Do so it's in order with everything else
+func (this *QueConn) Replay (list []*QueMessage) error {
+	return this.replay (list, this.accepts)
+}
+
+// records that a live message went out, if they haven't subscribed to anything yet
+// they get everything until they do, so the replay that comes with the subscribe would send it again
+func (this *QueConn) sentLive (msg *QueMessage) {
+	if msg.Offset == 0 { return } // not something that can be replayed
+
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	if this.subs != nil || this.earlyCount >= earlyMax { return }
+
+	if this.early == nil {
+		this.early = make(map[string]map[uint64]bool)
+	}
+
+	topic := TopicName(msg.Topic)
+	if this.early[topic] == nil {
+		this.early[topic] = make(map[uint64]bool)
+	}
+	this.early[topic][msg.Offset] = true
+	this.earlyCount++
+}
+
+// true if the message already went out live before they subscribed
+func (this *QueConn) sentEarly (msg *QueMessage) bool {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	return this.early[TopicName(msg.Topic)][msg.Offset]
+}
+
+// we only need to skip these on the first replay of each topic
+func (this *QueConn) forgetEarly (topics map[string]bool) {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	for topic := range topics {
+		this.earlyCount -= len(this.early[topic])
+		delete(this.early, topic)
+	}
+}
+
+// writes out the messages that pass the check, skipping any they already got live
+func (this *QueConn) replay (list []*QueMessage, accepts func(*QueMessage, Selector) bool) error {
+	topics := make(map[string]bool)
+	defer this.forgetEarly (topics)
+
+	for _, msg := range list {
+		topics[TopicName(msg.Topic)] = true
+		if msg.Expired() || this.sentEarly (msg) { continue }
+
+		sel, err := ParseSelector (msg.Selector)
+		if err != nil || accepts (msg, sel) == false { continue }
+
+		err = this.send (msg, msg.Frame().Marshal())
+		if errors.Is (err, ErrCreditFull) {
+			slog.Warn ("QUE: dropped replayed message for " + this.id + " : " + err.Error())
+			continue // already counted
+		}
+		if err != nil { return err }
+	}
+	return nil
+}
+
+// true if the connection wants every message on this topic, members of a group only get the partitions they own
+func (this *QueConn) wants (msg *QueMessage) bool {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	if this.subs == nil { return true }
+
+	group, ok := this.subs[TopicName(msg.Topic)]
+	return ok && len(group) == 0
+}
+
+// the consumer group the connection is in for this topic, empty if it isn't in one
+func (this *QueConn) group (topic string) string {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	return this.subs[topic]
+}
+
+// the consumer groups the connection is in, by topic
+func (this *QueConn) groups () map[string]string {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	ret := make(map[string]string)
+	for topic, group := range this.subs {
+		if len(group) > 0 {
+			ret[topic] = group
+		}
+	}
+	return ret
+}
+
+// from now on the connection only gets messages on the topics it's subscribed to
+// in a consumer group they only get the partitions they're assigned, use Que.Subscribe for that so they get some
+func (this *QueConn) Subscribe (topic, group string) {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	if this.subs == nil {
+		this.subs = make(map[string]string)
+	}
+	this.subs[TopicName(topic)] = group
+}
+
+// stops sending them messages on this topic
+func (this *QueConn) Unsubscribe (topic string) {
+	this.subLock.Lock()
+	defer this.subLock.Unlock()
+
+	delete(this.subs, TopicName(topic))
 }
 
+// the consumer group they're in for the topic, empty if they aren't in one
+func (this *QueConn) Group (topic string) string {
+	return this.group (TopicName(topic))
+}
+
+// what we call this connection, the client's id if it gave us one
+func (this *QueConn) Id () string {
+	return this.id
+}
 
 //----- PRIVATE -----------------------------------------------------------------------------------------------------//
 
+// adds to our channel unless we've closed it
+func (this *Que) enqueue (msg *QueMessage) error {
+	this.messagesLock.RLock()
+	defer this.messagesLock.RUnlock()
+
+	if this.closed { return ErrQueClosed }
+
+	return this.messages.Push (context.Background(), msg, true)
+}
+
 // adds connections to our list
 func (this *Que) monitorIn () {
 	this.wg.Add(1)
@@ -54,48 +341,226 @@ func (this *Que) monitorIn () {
 		if conn == nil { break } // channel is closed
 
 		// add it to our list
+		this.listLock.Lock()
 		this.list = append (this.list, conn)
-
 		slog.Info (fmt.Sprintf("QUE: connection added: %d", len(this.list)))
+		this.listLock.Unlock()
+
+		this.announce (PresenceJoin, conn)
+	}
+}
+
+// takes these connections out of our list
+func (this *Que) removeConns (dead []*QueConn) {
+	if len(dead) == 0 { return }
+
+	this.listLock.Lock()
+
+	newList := make([]*QueConn, 0, len(this.list))
+	removed := make([]*QueConn, 0, len(dead)) // only the ones that were still here, so nobody leaves twice
+	for _, conn := range this.list {
+		keep := true
+		for _, d := range dead {
+			if d == conn {
+				keep = false
+				break
+			}
+		}
+
+		if keep {
+			newList = append (newList, conn)
+		} else {
+			removed = append (removed, conn)
+		}
+	}
+
+	this.list = newList // copy this over
+	this.listLock.Unlock()
+
+	for _, conn := range removed {
+		for topic, group := range conn.groups() {
+			this.rebalance (topic, group) // someone else needs to pick up their partitions
+		}
+		this.announce (PresenceLeave, conn)
+	}
+}
+
+// re-assigns the topic's partitions to the members of the group
+// anyone picking up a partition gets what the group hasn't committed yet first
+func (this *Que) rebalance (topic, group string) {
+	gained := this.partitions.Rebalance (topic, group, func() []*QueConn {
+		ret := make([]*QueConn, 0)
+		for _, conn := range this.conns() {
+			if conn.ctx.Err() == nil && conn.group (topic) == group {
+				ret = append (ret, conn)
+			}
+		}
+		return ret
+	})
+
+	for conn, partitions := range gained {
+		slog.Info (fmt.Sprintf("QUE: %s : %s picked up partitions %v of %s", group, conn.id, partitions, topic))
+		this.catchUp (conn, topic, group, partitions)
+	}
+}
+
+// sends the member what's been recorded in these partitions since the group's last commit
+func (this *Que) catchUp (conn *QueConn, topic, group string, partitions []int) {
+	if this.history == nil || this.offsets == nil { return }
+
+	committed := make(map[int]uint64, len(partitions))
+	from := uint64(0)
+	for _, p := range partitions {
+		offset, ok := this.offsets.Committed (group, topic, p)
+		if ok == false { continue } // the group started after anything we have
+
+		committed[p] = offset
+		if from == 0 || offset + 1 < from {
+			from = offset + 1
+		}
+	}
+	if len(committed) == 0 { return }
+
+	list := this.history.Replay (topic, &Replay{ From: from })
+	err := conn.replay (list, func(msg *QueMessage, sel Selector) bool {
+		offset, ok := committed[msg.Partition]
+		return ok && msg.Offset > offset && conn.echo (msg) && sel.Matches (conn.info.Labels)
+	})
+	if err != nil {
+		slog.Info ("QUE: unable to catch up " + conn.id + " : " + err.Error())
 	}
 }
 
+// current list of connections, safe to loop over without the lock
+func (this *Que) conns () []*QueConn {
+	this.listLock.Lock()
+	defer this.listLock.Unlock()
+
+	return append ([]*QueConn(nil), this.list...)
+}
+
+// the connections this message goes out to
+func (this *Que) targets (msg *QueMessage) []*QueConn {
+	if msg.Target != nil {
+		return []*QueConn{ msg.Target } // this one's just for them
+	}
+
+	sel, err := ParseSelector (msg.Selector) // empty matches everyone
+	if err != nil {
+		slog.Warn("QUE: invalid selector : " + err.Error()) // the server checks these first, so this shouldn't happen
+		return nil
+	}
+
+	list := this.conns()
+	ret := make([]*QueConn, 0, len(list))
+	for _, conn := range list {
+		if conn.accepts (msg, sel) {
+			ret = append (ret, conn)
+		}
+	}
+
+	// and whoever owns its partition in each consumer group
+	for _, owner := range this.partitions.Owners (msg.Topic, msg.Partition) {
+		if owner.echo (msg) && sel.Matches (owner.info.Labels) {
+			ret = append (ret, owner)
+		}
+	}
+	return ret
+}
+
 // when a message comes in, we want to 
 func (this *Que) monitorMessages () {
 	this.wg.Add(1)
 	defer this.wg.Done()
 
-	for msg := range this.messages {
-		if msg == nil { break } // channel is closed
+	for {
+		msg, ok := this.messages.Pop()
+		if ok == false { break } // we're closed and it's empty
+
+		if msg.do != nil {
+			msg.do()
+			continue
+		}
+
+		if msg.Expired() {
+			this.metrics.Expired.Add(1)
+			slog.Info("QUE: dropping expired message : " + msg.Id)
+			if msg.From != nil {
+				msg.From.Nack (msg, ErrExpired)
+			}
+			continue
+		}
+
+		this.sending.Store(1)
+
+		if msg.Seq == 0 {
+			msg.Seq = this.NextSeq()
+		}
+
+		if msg.Target == nil {
+			this.partitions.Assign (msg) // redeliveries keep the partition they had
+		}
+
+		if this.history != nil && msg.Target == nil && len(msg.To) == 0 {
+			this.history.Record (msg) // recorded as it goes out, so a replay lines up exactly with what's live
+		}
+
+		// only bother creating the frame once
+		frame := msg.Frame().Marshal()
 
 		// writing to a bad connection is all i have, so i'm assuming things will be going away a lot
-		// so let's re-create the list we need each time
-		newList := make([]*queConn, 0, len(this.list))
+		// so keep track of the ones that failed and remove them after
+		list := this.targets (msg)
+		dead := make([]*QueConn, 0)
 
 		// we now need to send this message to all connected services
-		for _, conn := range this.list {
-			if conn.ctx.Err() == nil {
-				err := conn.client.WriteMessage (1, msg.Msg) // write it out
-				if err == nil {
-					newList = append (newList, conn) // this one is still working, so keep it
+		for _, conn := range list {
+			if conn.ctx.Err() != nil {
+				dead = append (dead, conn) // the context is gone, so don't include it anymore
+				continue
+			}
+
+			data := msg.Msg
+			if conn.info.Proto >= ProtocolVersion {
+				data = frame
+			}
+
+			err := conn.send (msg, data)
+			if errors.Is (err, ErrCreditFull) {
+				continue // they're still there, just too slow, and it's been counted
+			}
+
+			if err != nil {
+				// going to record these for now
+				slog.Info("client write failed, removing from que list")
+				dead = append (dead, conn)
+				continue
+			}
+
+			conn.sentLive (msg)
+		}
 
-				} else {
-					// going to record these for now
-					slog.Info("client write failed, removing from que list")
-				}
-			} // else the context is gone, so don't include it anymore
+		this.removeConns (dead)
+		slog.Info (fmt.Sprintf("QUE: message sent: %d", len(list) - len(dead)))
+
+		if msg.From != nil {
+			msg.From.Ack (msg) // it's gone out to everyone, so let the publisher know
 		}
 
-		this.list = newList // copy this over
-		slog.Info (fmt.Sprintf("QUE: message sent: %d", len(this.list)))
+		this.sending.Store(0)
 	}
 }
 
 // closes things and waits in its own thread
 func (this *Que) closeAndWait (ch chan bool) {
 	// close all the channels
-	close(this.inConnection)
-	close(this.messages)
+	this.messagesLock.Lock()
+	if this.closed == false {
+		this.closed = true
+		close(this.inConnection)
+		this.messages.Close()
+	}
+	this.messagesLock.Unlock()
 
 	this.wg.Wait() // wait for the threads to finish
 	// they fininshed, so set the channel
@@ -117,7 +582,7 @@ func (this *Que) Close (tm time.Duration) error {
 	select {
 	case <- done:
 		// we finished normally and expectidly 
-		
+
 	case <-ctx.Done():
 		// this is bad, means the context timed out before things finished
 		return errors.Errorf("Que timed out waiting for channels to close")
@@ -129,34 +594,235 @@ func (this *Que) Close (tm time.Duration) error {
 // adds to our channel to add a connection, uses context as a test to make sure the connection is expected to be open
 // this is thread safe
 func (this *Que) AddConnection (ctx context.Context, c *websocket.Conn) {
-	this.inConnection <- &queConn {
+	this.NewConnection (ctx, c, ConnInfo{})
+}
+
+// same as AddConnection but with what we know about the client, returns the connection so the caller can write back to it
+// this is thread safe
+func (this *Que) NewConnection (ctx context.Context, c *websocket.Conn, info ConnInfo) *QueConn {
+	id := info.Id
+	if len(id) == 0 {
+		id = fmt.Sprintf("conn-%d", this.connSeq.Add(1))
+	}
+
+	conn := &QueConn {
+		id: id,
 		client: c,
 		ctx: ctx,
+		info: info,
+		connected: time.Now(),
+		holdMax: this.opts.CreditBuffer,
+		metrics: this.metrics,
+	}
+	conn.Touch()
+
+	this.messagesLock.RLock()
+	defer this.messagesLock.RUnlock()
+
+	if this.closed == false {
+		this.inConnection <- conn
+	}
+
+	return conn
+}
+
+// returns the connection with this id, nil if it's not connected anymore
+// if a client re-connected before we noticed the old connection went away, this is the newest one
+// this is thread safe
+func (this *Que) Conn (id string) *QueConn {
+	if len(id) == 0 { return nil }
+
+	list := this.conns()
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].id == id && list[i].ctx.Err() == nil { return list[i] }
+	}
+	return nil
+}
+
+// what we know about everyone connected
+// this is thread safe
+func (this *Que) Conns () []*QueConn {
+	ret := make([]*QueConn, 0)
+	for _, conn := range this.conns() {
+		if conn.ctx.Err() == nil {
+			ret = append(ret, conn)
+		}
+	}
+	return ret
+}
+
+// takes the connection out of our list, for when it closes
+// done in order with the messages going out, so anyone picking up their partitions gets caught up before anything new
+// this is thread safe
+func (this *Que) RemoveConnection (conn *QueConn) {
+	if err := this.Do (func() { this.removeConns ([]*QueConn{ conn }) }); err != nil {
+		this.removeConns ([]*QueConn{ conn }) // we're shutting down, so there's nothing to keep in order with
+	}
+}
+
+// number of messages that haven't finished being written out to the connections yet
+// used while draining to know when our outbound buffer is empty, including what's held for connections out of credit
+func (this *Que) Pending () int {
+	ret := this.messages.Len() + int(this.sending.Load())
+	for _, conn := range this.conns() {
+		ret += conn.Held()
+	}
+	return ret
+}
+
+// runs this in order with the messages going out, eg so nothing is sent to a connection while we replay to it
+// everything queued before it goes out first, whatever the priority, and nothing queued after it gets ahead
+// returns ErrQueClosed if we're shutting down
+func (this *Que) Do (fn func()) error {
+	return this.enqueue (&QueMessage{ do: fn })
+}
+
+// subscribes the connection to the topic, if it's joining a consumer group the topic's partitions are rebalanced
+// a group new to the topic starts with what's published from here on
+// this is thread safe, but should be called from Que.Do so it's in order with everything else
+func (this *Que) Subscribe (conn *QueConn, topic, group string) {
+	topic = TopicName (topic)
+	was := conn.group (topic)
+
+	if len(group) > 0 && this.offsets != nil && this.history != nil {
+		this.offsets.Start (group, topic, this.partitions.Count (topic), this.history.Last (topic))
+	}
+
+	if len(group) > 0 && this.partitions.Count (topic) == 1 {
+		slog.Warn (fmt.Sprintf("QUE: %s joined group %s on %s, which only has the one partition so only one member gets its messages. set its partitions with --partitions or when subscribing", conn.id, group, topic))
 	}
+
+	conn.Subscribe (topic, group)
+	if len(was) > 0 && was != group {
+		this.rebalance (topic, was) // they left their old group
+	}
+	if len(group) > 0 {
+		this.rebalance (topic, group)
+	}
+}
+
+// unsubscribes the connection from the topic, if it was in a consumer group its partitions go to the others
+// this is thread safe, but should be called from Que.Do so it's in order with everything else
+func (this *Que) Unsubscribe (conn *QueConn, topic string) {
+	topic = TopicName (topic)
+	was := conn.group (topic)
+
+	conn.Unsubscribe (topic)
+	if len(was) > 0 {
+		this.rebalance (topic, was)
+	}
+}
+
+// keeps track of what the consumer groups have committed, set before any connections are added
+func (this *Que) SetOffsets (offsets *Offsets) {
+	this.offsets = offsets
+}
+
+// what the consumer groups have committed, nil if we're not keeping track
+func (this *Que) Offsets () *Offsets {
+	return this.offsets
+}
+
+// which partitions each topic has and who owns them
+func (this *Que) Partitions () *Partitions {
+	return this.partitions
+}
+
+// sets how many partitions each topic has, set before any connections are added
+func (this *Que) SetPartitions (partitions *Partitions) {
+	this.partitions = partitions
+}
+
+// keeps track of what goes out on each topic, set before any connections are added
+func (this *Que) SetHistory (history *History) {
+	this.history = history
+}
+
+// returns the next sequence number, messages get one as they're accepted by the server
+func (this *Que) NextSeq () uint64 {
+	return this.seq.Add(1)
 }
 
 // adds a new message to go to all connections
 // this is thread safe
 func (this *Que) NewMsg (msg []byte) {
-	this.messages <- &QueMessage {
+	this.Publish (&QueMessage {
 		Msg: msg,
+	})
+}
+
+// tells everyone we're going away, whatever they've subscribed to, so they stop sending us messages
+// this is thread safe
+func (this *Que) Shutdown () {
+	frame := (&Frame{ Type: FrameShutdown }).Marshal()
+
+	for _, conn := range this.conns() {
+		if conn.ctx.Err() != nil { continue }
+
+		data := frame
+		if conn.info.Proto < ProtocolVersion {
+			data = []byte(ShutdownMessage) // all they understand
+		}
+
+		if err := conn.Write (data); err != nil {
+			slog.Info ("QUE: unable to tell " + conn.id + " we're shutting down : " + err.Error())
+		}
 	}
 }
 
+// same as NewMsg but with the full message, returns ErrQueClosed if we're shutting down
+// this is thread safe
+func (this *Que) Publish (msg *QueMessage) error {
+	if err := this.enqueue (msg); err != nil { return err }
+
+	this.metrics.Published.Add(1)
+	return nil
+}
+
+// counters for the /metrics endpoint
+func (this *Que) Metrics () *Metrics {
+	return this.metrics
+}
+
   //-----------------------------------------------------------------------------------------------------------------------//
  //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
 //-----------------------------------------------------------------------------------------------------------------------//
 
+// reads the info a client connected with, labels without an = are ignored
+func ParseConnInfo (query url.Values) ConnInfo {
+	ret := ConnInfo{
+		Id: query.Get(ClientIdParam),
+		Pod: query.Get(PodParam),
+		Service: query.Get(ServiceParam),
+		Presence: query.Get(PresenceParam) == "1",
+		NoEcho: query.Get(NoEchoParam) == "1",
+	}
+	ret.Proto, _ = strconv.Atoi(query.Get(ProtocolParam))
+
+	for _, label := range query[LabelParam] {
+		key, value, ok := strings.Cut(label, "=")
+		if ok == false || len(key) == 0 { continue }
+
+		if ret.Labels == nil {
+			ret.Labels = make(map[string]string)
+		}
+		ret.Labels[key] = value
+	}
+	return ret
+}
+
 // creates a new que object to monitor for incoming connections
 // sending of messages to existing connections
 // and closing connections that are no longer open
 func NewQue (opts *OPTS) *Que {
 	ret := &Que{
 		opts: opts,
-		inConnection: make(chan *queConn, 10), // this doesn't need to be large, these should be getting pulled off real quick
-		messages: make(chan *QueMessage, 10), // again this should be happening real quick
+		inConnection: make(chan *QueConn, 10), // this doesn't need to be large, these should be getting pulled off real quick
+		messages: NewPriorityQueue (10, opts.PriorityStarve), // again this should be happening real quick, and each priority gets its own room
 		wg: new(sync.WaitGroup),
+		metrics: &Metrics{},
 	}
+	ret.partitions, _ = NewPartitions (nil, "") // every topic has just the one until we're told otherwise
 
 	go ret.monitorIn()  // monitor this channel
 	go ret.monitorMessages() // monitor this channel as well
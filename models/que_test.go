@@ -0,0 +1,43 @@
+package models 
+
+import (
+	"testing"
+)
+
+func TestQAConnInfo (t *testing.T) {
+	info := ConnInfo{ Proto: ProtocolVersion, Id: "worker-1", Pod: "worker-abc", Service: "worker", Labels: map[string]string{ "app": "worker", "tier": "back" }, Presence: true, NoEcho: true }
+
+	query := info.Query()
+	query.Add (LabelParam, "nothing") // bad labels are skipped
+
+	out := ParseConnInfo (query)
+	if out.Proto != info.Proto || out.Id != info.Id || out.Pod != info.Pod || out.Service != info.Service || out.Presence == false || out.NoEcho == false {
+		t.Fatalf("expected the info to survive the trip : %+v", out)
+	}
+	if len(out.Labels) != 2 || out.Labels["app"] != "worker" || out.Labels["tier"] != "back" {
+		t.Fatalf("unexpected labels : %v", out.Labels)
+	}
+
+	// old clients only send the protocol, if that
+	if out = ParseConnInfo (nil); out.Proto != 0 || len(out.Id) > 0 || out.Labels != nil {
+		t.Fatalf("expected empty info : %+v", out)
+	}
+}
+
+func TestQAEcho (t *testing.T) {
+	conn := &QueConn{ id: "a" }
+	msg := &QueMessage{}
+	msg.Sender = "a"
+
+	if conn.echo (msg) == false { t.Fatal("expected our own message back by default") }
+
+	msg.NoEcho = true
+	if conn.echo (msg) { t.Fatal("expected the message to ask for no echo") }
+
+	msg.NoEcho = false
+	conn.info.NoEcho = true
+	if conn.echo (msg) { t.Fatal("expected the connection to ask for no echo") }
+
+	msg.Sender = "b"
+	if conn.echo (msg) == false { t.Fatal("expected everyone else's messages") }
+}
@@ -0,0 +1,117 @@
+/** ****************************************************************************************************************** **
+	Retained messages, the last value published to each topic with retain set
+	New subscribers get it right away so they don't have to wait for the next one
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"fmt"
+	"os"
+	"sync"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type Retained struct {
+	path string // where we persist things, empty if we don't
+
+	lock sync.Mutex
+	topics map[string]*QueMessage
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// writes everything out, expects the lock to be held
+func (this *Retained) save () error {
+	if len(this.path) == 0 { return nil }
+
+	data, err := json.Marshal(this.topics)
+	if err != nil { return errors.WithStack(err) }
+
+	return errors.WithStack(WriteFileAtomic(this.path, data))
+}
+
+// loads anything we saved before, a missing file isn't an error
+func (this *Retained) load () error {
+	data, err := os.ReadFile(this.path)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return errors.WithStack(err) }
+
+	if err = json.Unmarshal(data, &this.topics); err != nil { return errors.WithStack(err) }
+
+	slog.Info(fmt.Sprintf("RETAINED: loaded %d retained messages", len(this.topics)))
+	return nil
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// keeps this as the last value for its topic, an empty message clears it instead
+// returns true if the message was kept
+func (this *Retained) Set (msg *QueMessage) bool {
+	topic := TopicName(msg.Topic)
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	kept := len(msg.Msg) > 0
+	if kept {
+		cp := *msg // our own copy, the original keeps going
+		cp.From, cp.Target, cp.Confirm = nil, nil, false
+		this.topics[topic] = &cp
+	} else {
+		if _, ok := this.topics[topic]; ok == false { return false } // nothing to clear
+		delete(this.topics, topic)
+	}
+
+	if err := this.save(); err != nil {
+		slog.Warn("RETAINED: failed to save : " + err.Error())
+	}
+	return kept
+}
+
+// the retained message for this topic, nil if there isn't one
+// this is a copy, so it's safe to change
+func (this *Retained) Get (topic string) *QueMessage {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	msg, ok := this.topics[TopicName(topic)]
+	if ok == false { return nil }
+
+	cp := *msg
+	return &cp
+}
+
+// number of topics with a retained message
+func (this *Retained) Len () int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return len(this.topics)
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// creates the retained messages, path is optional and where they're persisted
+func NewRetained (path string) (*Retained, error) {
+	ret := &Retained{
+		path: path,
+		topics: make(map[string]*QueMessage),
+	}
+
+	if len(path) > 0 {
+		if err := ret.load(); err != nil { return nil, err }
+	}
+
+	return ret, nil
+}
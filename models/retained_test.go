@@ -0,0 +1,35 @@
+package models 
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestQARetained (t *testing.T) {
+	path := filepath.Join (t.TempDir(), "retained.json")
+
+	retained, err := NewRetained (path)
+	TestingStackTrace (t, err)
+
+	msg := &QueMessage{ Msg: []byte("one"), Confirm: true }
+	msg.Topic = "config"
+	if retained.Set (msg) == false { t.Fatal("expected the message to be kept") }
+
+	msg = &QueMessage{ Msg: []byte("two") }
+	msg.Topic = "config"
+	retained.Set (msg)
+
+	if got := retained.Get ("config"); got == nil || string(got.Msg) != "two" || got.Confirm { t.Fatalf("expected the latest value : %+v", got) }
+	if retained.Get ("other") != nil { t.Fatal("nothing retained on this topic") }
+
+	// and it survives a restart
+	retained, err = NewRetained (path)
+	TestingStackTrace (t, err)
+	if got := retained.Get ("config"); got == nil || string(got.Msg) != "two" { t.Fatalf("expected the value to be loaded : %+v", got) }
+
+	// empty clears it
+	msg = &QueMessage{}
+	msg.Topic = "config"
+	if retained.Set (msg) { t.Fatal("empty messages aren't kept") }
+	if retained.Get ("config") != nil || retained.Len() != 0 { t.Fatal("expected the topic to be cleared") }
+}
@@ -0,0 +1,202 @@
+/** ****************************************************************************************************************** **
+	Retention limits for the log, so it doesn't fill up the volume
+	Whole segments are deleted, oldest first, once a topic is over any of its limits
+	The newest segment is never deleted, so a topic can go over by up to a segment's worth
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+const RetentionWarn = 0.9 // we warn once a topic is this close to a limit
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// limits for a topic in the log, 0 is no limit
+type Retention struct {
+	Age time.Duration `json:"age,omitempty"`
+	Bytes int64 `json:"bytes,omitempty"`
+	Count int `json:"count,omitempty"`
+}
+
+// what a topic is using in the log
+type TopicUsage struct {
+	Topic string `json:"topic"`
+	Segments int `json:"segments"`
+	Bytes int64 `json:"bytes"`
+	Count int `json:"count"`
+	First uint64 `json:"first,omitempty"` // oldest offset we still have
+	Last uint64 `json:"last,omitempty"`
+	Oldest int64 `json:"oldest,omitempty"` // unix milliseconds, when the oldest message we have was appended
+	Retention Retention `json:"retention"`
+}
+
+//----- Retention ---------------------------------------------------------------------------------------------------//
+
+// true if there aren't any limits
+func (this Retention) Unlimited () bool {
+	return this.Age <= 0 && this.Bytes <= 0 && this.Count <= 0
+}
+
+//----- TopicUsage --------------------------------------------------------------------------------------------------//
+
+// how close we are to the closest limit, 1 is at it
+func (this *TopicUsage) Used () float64 {
+	ret := 0.0
+	if this.Retention.Bytes > 0 {
+		ret = max(ret, float64(this.Bytes) / float64(this.Retention.Bytes))
+	}
+	if this.Retention.Count > 0 {
+		ret = max(ret, float64(this.Count) / float64(this.Retention.Count))
+	}
+	if this.Retention.Age > 0 && this.Oldest > 0 {
+		ret = max(ret, float64(time.Now().UnixMilli() - this.Oldest) / float64(this.Retention.Age.Milliseconds()))
+	}
+	return ret
+}
+
+//----- topicLog ----------------------------------------------------------------------------------------------------//
+
+// what this topic is using, expects the lock to be held
+func (this *topicLog) usage () TopicUsage {
+	ret := TopicUsage{ Segments: len(this.segments), Last: this.last }
+
+	for _, seg := range this.segments {
+		ret.Bytes += seg.bytes
+		ret.Count += seg.count
+
+		if seg.count > 0 && ret.Oldest == 0 {
+			ret.First, ret.Oldest = seg.first, seg.firstTime
+		}
+	}
+	return ret
+}
+
+// true if the oldest segment has to go for us to be within the limits, expects the lock to be held
+func (this *topicLog) over (seg *segment, r Retention, usage *TopicUsage) bool {
+	switch {
+	case r.Age > 0 && seg.lastTime < time.Now().Add(-r.Age).UnixMilli():
+		return true // everything in it is too old
+	case r.Bytes > 0 && usage.Bytes > r.Bytes:
+		return true
+	case r.Count > 0 && usage.Count > r.Count:
+		return true
+	}
+	return false
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// deletes the oldest segments of the topic until it's within the limits, returns how many messages were removed
+func (this *Log) Retain (topic string, r Retention) (int, error) {
+	if r.Unlimited() { return 0, nil }
+
+	t, _ := this.topic(topic, false)
+	if t == nil { return 0, nil }
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	usage := t.usage()
+	removed, dropped := 0, 0
+
+	for _, seg := range t.closed() {
+		if t.over(seg, r, &usage) == false { break }
+
+		if err := os.Remove(seg.path); err != nil && os.IsNotExist(err) == false {
+			t.segments = t.segments[dropped:]
+			return removed, errors.WithStack(err)
+		}
+
+		usage.Bytes -= seg.bytes
+		usage.Count -= seg.count
+		removed += seg.count
+		dropped++
+	}
+
+	t.segments = t.segments[dropped:]
+	return removed, nil
+}
+
+// what the topic is using in the log
+func (this *Log) Usage (topic string) TopicUsage {
+	t, _ := this.topic(topic, false)
+	if t == nil { return TopicUsage{ Topic: TopicName(topic) } }
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ret := t.usage()
+	ret.Topic = TopicName(topic)
+	return ret
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// parses the retention for a single topic, eg orders:age=24h,bytes=1073741824,count=100000
+func ParseRetention (str string) (string, Retention, error) {
+	ret := Retention{}
+
+	idx := strings.LastIndex(str, ":")
+	if idx <= 0 { return "", ret, errors.Errorf("retention %q is missing its topic", str) }
+
+	topic := TopicName(strings.TrimSpace(str[:idx]))
+
+	for _, part := range strings.Split(str[idx+1:], ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok == false { return "", ret, errors.Errorf("retention %q : expected key=value, got %q", str, part) }
+
+		var err error
+		switch strings.TrimSpace(key) {
+		case "age":
+			ret.Age, err = time.ParseDuration(strings.TrimSpace(value))
+		case "bytes":
+			ret.Bytes, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		case "count":
+			ret.Count, err = strconv.Atoi(strings.TrimSpace(value))
+		default:
+			return "", ret, errors.Errorf("retention %q : unknown limit %q", str, key)
+		}
+		if err != nil { return "", ret, errors.Wrapf(err, "retention %q", str) }
+	}
+
+	return topic, ret, nil
+}
+
+// writes the usage of each topic as prometheus gauges
+func WriteUsageMetrics (w io.Writer, list []TopicUsage) {
+	if len(list) == 0 { return }
+
+	for _, metric := range []struct {
+		name, help string
+		value func(*TopicUsage) any
+	}{
+		{ "k8mq_log_bytes", "Bytes the topic is using in the log", func(u *TopicUsage) any { return u.Bytes } },
+		{ "k8mq_log_messages", "Messages the topic has in the log", func(u *TopicUsage) any { return u.Count } },
+		{ "k8mq_log_segments", "Segment files the topic has in the log", func(u *TopicUsage) any { return u.Segments } },
+		{ "k8mq_log_retention_used", "How close the topic is to its closest retention limit, 1 is at it", func(u *TopicUsage) any { return u.Used() } },
+	} {
+		fmt.Fprintf (w, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		for i := range list {
+			fmt.Fprintf (w, "%s{topic=%q} %v\n", metric.name, list[i].Topic, metric.value(&list[i]))
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQARetention (t *testing.T) {
+	topic, r, err := ParseRetention ("orders/eu:age=24h, bytes=1000,count=5")
+	TestingStackTrace (t, err)
+	if topic != "orders/eu" || r.Age != time.Hour * 24 || r.Bytes != 1000 || r.Count != 5 { t.Fatalf("unexpected retention : %s : %+v", topic, r) }
+
+	for _, str := range []string{ "age=1h", "orders:size=1", "orders:count=x" } {
+		if _, _, err := ParseRetention (str); err == nil { t.Fatalf("expected %q to fail", str) }
+	}
+
+	log, err := NewLog (t.TempDir(), 1) // every message gets its own segment
+	TestingStackTrace (t, err)
+	defer log.Close()
+
+	old := time.Now().Add(-time.Hour).UnixMilli()
+	for i := 1; i <= 10; i++ {
+		tm := time.Now().UnixMilli()
+		if i <= 3 {
+			tm = old
+		}
+
+		msg := &QueMessage{ Msg: []byte(fmt.Sprintf("msg-%d", i)) }
+		msg.Topic = "orders"
+		TestingStackTrace (t, log.Append (msg, tm))
+	}
+
+	// by age
+	removed, err := log.Retain ("orders", Retention{ Age: time.Minute })
+	TestingStackTrace (t, err)
+	if removed != 3 { t.Fatalf("expected 3 removed by age, got %d", removed) }
+
+	// by count
+	removed, err = log.Retain ("orders", Retention{ Count: 5 })
+	TestingStackTrace (t, err)
+	if removed != 2 { t.Fatalf("expected 2 removed by count, got %d", removed) }
+
+	usage := log.Usage ("orders")
+	if usage.Count != 5 || usage.Segments != 5 || usage.First != 6 || usage.Last != 10 { t.Fatalf("unexpected usage : %+v", usage) }
+
+	// by bytes, the newest segment is always kept
+	removed, err = log.Retain ("orders", Retention{ Bytes: 1 })
+	TestingStackTrace (t, err)
+	if removed != 4 { t.Fatalf("expected 4 removed by bytes, got %d", removed) }
+
+	usage = log.Usage ("orders")
+	usage.Retention = Retention{ Count: 1 }
+	if usage.Count != 1 || usage.First != 10 || usage.Used() < 1 { t.Fatalf("unexpected usage : %+v", usage) }
+
+	list, err := log.Read ("orders", 1, 100)
+	TestingStackTrace (t, err)
+	if len(list) != 1 || string(list[0].Msg) != "msg-10" { t.Fatalf("unexpected read : %d", len(list)) }
+
+	msg := &QueMessage{ Msg: []byte("msg-11") }
+	msg.Topic = "orders"
+	TestingStackTrace (t, log.Append (msg, time.Now().UnixMilli()))
+	if msg.Offset != 11 { t.Fatalf("expected offset 11, got %d", msg.Offset) }
+}
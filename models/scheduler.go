@@ -0,0 +1,244 @@
+/** ****************************************************************************************************************** **
+	Holds on to messages that shouldn't go out until later
+	Kept in a heap ordered by when they're due, with a single timer for whatever is next
+	Every change is saved before it's acted on, so a message we've accepted survives a crash and one we've sent doesn't come back
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"container/heap"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+	"encoding/json"
+	"log/slog"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// implements heap.Interface, soonest first
+type scheduleHeap []*QueMessage
+
+func (this scheduleHeap) Len () int { return len(this) }
+func (this scheduleHeap) Less (i, j int) bool { return this[i].DeliverAt < this[j].DeliverAt }
+func (this scheduleHeap) Swap (i, j int) { this[i], this[j] = this[j], this[i] }
+func (this *scheduleHeap) Push (x any) { *this = append(*this, x.(*QueMessage)) }
+func (this *scheduleHeap) Pop () any {
+	old := *this
+	n := len(old)
+	ret := old[n - 1]
+	*this = old[:n - 1]
+	return ret
+}
+
+type Scheduler struct {
+	deliver func(*QueMessage) // called with each message once it's due
+	path string // where we persist things, empty if we don't
+
+	lock sync.Mutex
+	pending scheduleHeap
+	dirty bool // changed since we last saved
+	saveLock sync.Mutex // so an older copy can't be written over a newer one
+
+	wake chan bool
+	done chan bool
+	wg sync.WaitGroup
+}
+
+//----- PRIVATE -----------------------------------------------------------------------------------------------------//
+
+// lets the run loop know the next due time may have changed, never blocks
+func (this *Scheduler) poke () {
+	select {
+	case this.wake <- true:
+	default:
+	}
+}
+
+// pulls off everything that's due, returns how long until the next one
+func (this *Scheduler) due () ([]*QueMessage, time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	ret := make([]*QueMessage, 0)
+	now := time.Now().UnixMilli()
+
+	for len(this.pending) > 0 && this.pending[0].DeliverAt <= now {
+		ret = append(ret, heap.Pop(&this.pending).(*QueMessage))
+		this.dirty = true
+	}
+
+	if len(this.pending) == 0 { return ret, time.Hour } // nothing waiting, we'll get poked when there is
+	return ret, time.Duration(this.pending[0].DeliverAt - now) * time.Millisecond
+}
+
+func (this *Scheduler) run () {
+	defer this.wg.Done()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+
+		case <-this.wake:
+		case <-timer.C:
+		}
+
+		list, next := this.due()
+		if len(list) > 0 {
+			// they're off our list before they go out, so a restart doesn't send them again
+			if err := this.save(); err != nil {
+				slog.Warn("SCHEDULER: failed to save : " + err.Error())
+			}
+		}
+
+		for _, msg := range list {
+			this.deliver(msg)
+		}
+
+		timer.Reset(next)
+	}
+}
+
+// writes out the pending messages if anything changed
+func (this *Scheduler) save () error {
+	if len(this.path) == 0 { return nil }
+
+	this.saveLock.Lock()
+	defer this.saveLock.Unlock()
+
+	this.lock.Lock()
+	if this.dirty == false {
+		this.lock.Unlock()
+		return nil
+	}
+
+	data, err := json.Marshal(this.pending)
+	this.dirty = false
+	this.lock.Unlock()
+
+	if err == nil {
+		err = WriteFileAtomic(this.path, data)
+	}
+
+	if err != nil {
+		this.lock.Lock()
+		this.dirty = true // so the next save tries again
+		this.lock.Unlock()
+	}
+	return errors.WithStack(err)
+}
+
+// loads anything we saved before, a missing file isn't an error
+func (this *Scheduler) load () error {
+	data, err := os.ReadFile(this.path)
+	if os.IsNotExist(err) { return nil }
+	if err != nil { return errors.WithStack(err) }
+
+	if err = json.Unmarshal(data, &this.pending); err != nil { return errors.WithStack(err) }
+
+	heap.Init(&this.pending)
+	slog.Info(fmt.Sprintf("SCHEDULER: loaded %d scheduled messages", len(this.pending)))
+	return nil
+}
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+// holds on to the message until its DeliverAt time
+// it's saved before we return, if that fails it isn't scheduled and we return the error
+func (this *Scheduler) Add (msg *QueMessage) error {
+	this.lock.Lock()
+	heap.Push(&this.pending, msg)
+	this.dirty = true
+	this.lock.Unlock()
+
+	if err := this.save(); err != nil {
+		this.lock.Lock()
+		for i := range this.pending {
+			if this.pending[i] == msg {
+				heap.Remove(&this.pending, i)
+				break
+			}
+		}
+		this.lock.Unlock()
+		return err
+	}
+
+	this.poke()
+	return nil
+}
+
+// removes any scheduled messages with this id, returns false if there weren't any
+func (this *Scheduler) Cancel (id string) bool {
+	this.lock.Lock()
+	found := false
+	for i := len(this.pending) - 1; i >= 0; i-- {
+		if this.pending[i].Id == id {
+			heap.Remove(&this.pending, i)
+			found = true
+		}
+	}
+
+	if found {
+		this.dirty = true
+	}
+	this.lock.Unlock()
+
+	if err := this.save(); err != nil {
+		slog.Warn("SCHEDULER: failed to save : " + err.Error())
+	}
+	return found
+}
+
+// copy of everything still waiting, soonest first
+func (this *Scheduler) List () []*QueMessage {
+	this.lock.Lock()
+	ret := append([]*QueMessage(nil), this.pending...)
+	this.lock.Unlock()
+
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].DeliverAt < ret[j].DeliverAt })
+	return ret
+}
+
+// stops delivering and saves what's left
+func (this *Scheduler) Close () error {
+	close(this.done)
+	this.wg.Wait()
+
+	return this.save()
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// creates the scheduler and starts its timer, path is optional and where the pending messages are persisted
+func NewScheduler (path string, deliver func(*QueMessage)) (*Scheduler, error) {
+	ret := &Scheduler{
+		deliver: deliver,
+		path: path,
+		pending: make(scheduleHeap, 0),
+		wake: make(chan bool, 1),
+		done: make(chan bool),
+	}
+
+	if len(path) > 0 {
+		if err := ret.load(); err != nil { return nil, err }
+	}
+
+	ret.wg.Add(1)
+	go ret.run()
+
+	return ret, nil
+}
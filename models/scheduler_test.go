@@ -0,0 +1,58 @@
+
+package models 
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQAScheduler (t *testing.T) {
+	path := filepath.Join (t.TempDir(), "scheduled.json")
+
+	var lock sync.Mutex
+	delivered := make([]string, 0)
+	deliver := func(msg *QueMessage) {
+		lock.Lock()
+		delivered = append (delivered, msg.Id)
+		lock.Unlock()
+	}
+
+	sched, err := NewScheduler (path, deliver)
+	TestingStackTrace (t, err)
+
+	now := time.Now()
+	for id, delay := range map[string]time.Duration{ "second": time.Millisecond * 100, "first": time.Millisecond * 50, "cancelled": time.Millisecond * 75, "later": time.Hour } {
+		msg := &QueMessage{}
+		msg.Id = id
+		msg.DeliverAt = now.Add(delay).UnixMilli()
+		TestingStackTrace (t, sched.Add (msg))
+	}
+
+	if sched.Cancel ("cancelled") == false { t.Fatal("expected to cancel the message") }
+	if sched.Cancel ("missing") { t.Fatal("nothing to cancel") }
+
+	time.Sleep (time.Millisecond * 200)
+
+	lock.Lock()
+	if len(delivered) != 2 || delivered[0] != "first" || delivered[1] != "second" { t.Fatalf("unexpected delivery : %v", delivered) }
+	lock.Unlock()
+
+	// what's on disk already matches, without a clean close
+	crashed, err := NewScheduler (path, func(*QueMessage) { t.Fatal("nothing should be due") })
+	TestingStackTrace (t, err)
+	list := crashed.List()
+	if len(list) != 1 || list[0].Id != "later" { t.Fatalf("expected only the later message to be saved : %v", list) }
+	TestingStackTrace (t, crashed.Close())
+
+	TestingStackTrace (t, sched.Close())
+
+	// the one for later should survive a restart
+	sched, err = NewScheduler (path, deliver)
+	TestingStackTrace (t, err)
+
+	list = sched.List()
+	if len(list) != 1 || list[0].Id != "later" { t.Fatalf("expected the later message to still be scheduled : %v", list) }
+	TestingStackTrace (t, sched.Close())
+}
@@ -0,0 +1,190 @@
+/** ****************************************************************************************************************** **
+	Kubernetes style label selectors, for publishing to just the clients with matching labels
+
+	Requirements are comma separated and all have to match
+		app=billing, app==billing, app!=billing
+		zone in (a,b), zone notin (a,b)
+		canary, !canary
+
+** ****************************************************************************************************************** **/
+
+package models
+
+import (
+	"github.com/pkg/errors"
+
+	"strings"
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- CONSTS ----------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type selectorOp int
+
+const (
+	selectorEquals selectorOp = iota
+	selectorNotEquals
+	selectorIn
+	selectorNotIn
+	selectorExists
+	selectorNotExists
+)
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- STRUCTS ---------------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+type requirement struct {
+	key string
+	op selectorOp
+	values []string
+}
+
+// true if the labels meet this requirement
+func (this *requirement) matches (labels map[string]string) bool {
+	value, ok := labels[this.key]
+
+	switch this.op {
+	case selectorExists:
+		return ok
+	case selectorNotExists:
+		return ok == false
+	case selectorNotEquals:
+		return ok == false || value != this.values[0] // same as k8, a missing label isn't equal
+	case selectorNotIn:
+		return ok == false || this.has(value) == false
+	}
+
+	return ok && this.has(value) // equals and in
+}
+
+func (this *requirement) has (value string) bool {
+	for _, v := range this.values {
+		if v == value { return true }
+	}
+	return false
+}
+
+// every requirement has to match, an empty selector matches everything
+type Selector []*requirement
+
+//----- PUBLIC -----------------------------------------------------------------------------------------------------//
+
+func (this Selector) Matches (labels map[string]string) bool {
+	for _, req := range this {
+		if req.matches(labels) == false { return false }
+	}
+	return true
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PRIVATE FUNCTIONS -----------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// splits on the commas that aren't inside of a set
+func splitSelector (selector string) ([]string, error) {
+	ret := make([]string, 0)
+	depth, start := 0, 0
+
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 { return nil, errors.Errorf("unexpected ) in selector : %s", selector) }
+		case ',':
+			if depth == 0 {
+				ret = append(ret, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	if depth != 0 { return nil, errors.Errorf("missing ) in selector : %s", selector) }
+	return append(ret, selector[start:]), nil
+}
+
+// parses the values of a set, eg (a, b)
+func parseSet (set string) ([]string, error) {
+	set = strings.TrimSpace(set)
+	if strings.HasPrefix(set, "(") == false || strings.HasSuffix(set, ")") == false { return nil, errors.Errorf("expected a set like (a,b) : %s", set) }
+
+	ret := make([]string, 0)
+	for _, value := range strings.Split(set[1:len(set) - 1], ",") {
+		if value = strings.TrimSpace(value); len(value) > 0 {
+			ret = append(ret, value)
+		}
+	}
+
+	if len(ret) == 0 { return nil, errors.Errorf("empty set : %s", set) }
+	return ret, nil
+}
+
+func parseRequirement (part string) (*requirement, error) {
+	// order matters here, != and == have to be checked before =
+	for _, eq := range []struct{ token string; op selectorOp }{ { "!=", selectorNotEquals }, { "==", selectorEquals }, { "=", selectorEquals } } {
+		key, value, ok := strings.Cut(part, eq.token)
+		if ok == false { continue }
+
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if len(key) == 0 { return nil, errors.Errorf("missing key : %s", part) }
+		return &requirement{ key: key, op: eq.op, values: []string{ value } }, nil
+	}
+
+	fields := strings.Fields(part)
+	if len(fields) == 1 {
+		key, op := fields[0], selectorExists
+		if strings.HasPrefix(key, "!") {
+			key, op = strings.TrimSpace(key[1:]), selectorNotExists
+		}
+		if len(key) == 0 { return nil, errors.Errorf("missing key : %s", part) }
+		return &requirement{ key: key, op: op }, nil
+	}
+
+	if len(fields) < 3 { return nil, errors.Errorf("invalid requirement : %s", part) }
+
+	op := selectorIn
+	switch fields[1] {
+	case "in":
+	case "notin":
+		op = selectorNotIn
+	default:
+		return nil, errors.Errorf("unknown operator %s : %s", fields[1], part)
+	}
+
+	// the set is everything after the operator, it can have spaces in it
+	start := strings.Index(part, "(")
+	if start < 0 { return nil, errors.Errorf("expected a set like (a,b) : %s", part) }
+
+	values, err := parseSet(part[start:])
+	if err != nil { return nil, err }
+
+	return &requirement{ key: fields[0], op: op, values: values }, nil
+}
+
+  //-----------------------------------------------------------------------------------------------------------------------//
+ //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
+//-----------------------------------------------------------------------------------------------------------------------//
+
+// parses a selector like "app=billing,zone in (a,b),!canary"
+func ParseSelector (selector string) (Selector, error) {
+	ret := make(Selector, 0)
+	if len(strings.TrimSpace(selector)) == 0 { return ret, nil }
+
+	parts, err := splitSelector(selector)
+	if err != nil { return nil, err }
+
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 { return nil, errors.Errorf("empty requirement in selector : %s", selector) }
+
+		req, err := parseRequirement(part)
+		if err != nil { return nil, err }
+
+		ret = append(ret, req)
+	}
+
+	return ret, nil
+}
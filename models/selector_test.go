@@ -0,0 +1,34 @@
+package models 
+
+import (
+	"testing"
+)
+
+func TestQASelector (t *testing.T) {
+	labels := map[string]string{ "app": "billing", "zone": "a" }
+
+	for selector, expected := range map[string]bool{
+		"": true,
+		"app=billing": true,
+		"app==billing,zone=a": true,
+		"app=billing, zone=b": false,
+		"app!=billing": false,
+		"tier!=back": true, // missing labels aren't equal
+		"zone in (a, b)": true,
+		"zone in (b,c)": false,
+		"zone notin (b,c)": true,
+		"tier notin (back)": true,
+		"app": true,
+		"!app": false,
+		"!canary,app in (billing),zone": true,
+	} {
+		sel, err := ParseSelector (selector)
+		TestingStackTrace (t, err)
+
+		if sel.Matches (labels) != expected { t.Fatalf("expected %v for %q", expected, selector) }
+	}
+
+	for _, selector := range []string{ "=a", "app=a,,zone=b", "zone in (a", "zone in a", "zone maybe (a)", "zone in ()", "!", "a b" } {
+		if _, err := ParseSelector (selector); err == nil { t.Fatalf("expected %q to fail", selector) }
+	}
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"github.com/NathanRThomas/k8mq/client"
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// connects a client to the test server and waits until we've added it, it's closed once the test is done
+func newTestClient (t *testing.T, svr *Server, addr string, opts *client.Options) *client.Client {
+	t.Helper()
+	host, port, err := net.SplitHostPort (addr)
+	models.TestingStackTrace (t, err)
+	p, _ := strconv.Atoi (port)
+
+	if opts == nil { opts = &client.Options{} }
+	if len(opts.ClientId) == 0 {
+		opts.ClientId = fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	}
+
+	c, err := client.NewClientWithOptions (host, p, nil, opts)
+	models.TestingStackTrace (t, err)
+	t.Cleanup (func() { c.Close (time.Second) })
+
+	waitFor (t, "the client to connect", func() bool { return svr.que.Conn (opts.ClientId) != nil })
+	return c
+}
+
+// polls until the check passes, failing the test if it takes too long
+func waitFor (t *testing.T, what string, check func() bool) {
+	t.Helper()
+	for end := time.Now().Add(time.Second * 3); time.Now().Before(end); time.Sleep (time.Millisecond * 10) {
+		if check() { return }
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+// collects the bodies a client's handler sees
+type testReceiver struct {
+	lock sync.Mutex
+	got []string
+}
+
+func (this *testReceiver) handler (ctx context.Context, msg *models.Message) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.got = append(this.got, string(msg.Body))
+	return nil
+}
+
+func (this *testReceiver) list () []string {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return append([]string(nil), this.got...)
+}
+
+func TestQAClientPublish (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{})
+
+	recv := &testReceiver{}
+	newTestClient (t, svr, addr, &client.Options{ Handler: recv.handler })
+	pub := newTestClient (t, svr, addr, nil)
+
+	ctx, cancel := context.WithTimeout (context.Background(), time.Second * 3)
+	defer cancel()
+
+	seq, err := pub.PublishSync (ctx, []byte("hello"))
+	models.TestingStackTrace (t, err)
+	if seq == 0 { t.Fatal("expected a sequence number") }
+
+	_, err = pub.PublishSync (ctx, []byte("delayed"), client.WithDelay (time.Millisecond * 200))
+	models.TestingStackTrace (t, err)
+
+	_, err = pub.PublishSync (ctx, []byte("cancelled"), client.WithDelay (time.Millisecond * 200), client.WithId ("x1"))
+	models.TestingStackTrace (t, err)
+	models.TestingStackTrace (t, pub.Cancel (ctx, "x1"))
+	if err := pub.Cancel (ctx, "x1"); err == nil { t.Fatal("expected nothing left to cancel") }
+
+	_, err = pub.PublishSync (ctx, []byte("expired"), client.WithTTL (time.Millisecond), client.WithDelay (time.Millisecond * 100))
+	models.TestingStackTrace (t, err)
+
+	waitFor (t, "the delayed message", func() bool { return len(recv.list()) == 2 })
+	time.Sleep (time.Millisecond * 300) // give anything that shouldn't come through the chance to
+
+	if got := recv.list(); len(got) != 2 || got[0] != "hello" || got[1] != "delayed" { t.Fatalf("unexpected messages : %v", got) }
+}
+
+func TestQAClientRedeliver (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{ RedeliveryDelay: time.Millisecond * 10, MaxRedeliveries: 2 })
+
+	var calls atomic.Int32
+	newTestClient (t, svr, addr, &client.Options{ Handler: func(ctx context.Context, msg *models.Message) error {
+		calls.Add(1)
+		return errors.New("nope")
+	}})
+	pub := newTestClient (t, svr, addr, nil)
+
+	models.TestingStackTrace (t, pub.Publish (context.Background(), []byte("hello"), client.WithTopic ("jobs")))
+
+	waitFor (t, "the dead letter", func() bool { return len(svr.deadLetters.List ("jobs")) == 1 })
+	if calls.Load() != 3 { t.Fatalf("expected the first try and 2 redeliveries, got %d", calls.Load()) }
+}
+
+func TestQAClientPresence (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{})
+
+	events := make(chan string, 10)
+	a := newTestClient (t, svr, addr, &client.Options{ ClientId: "a", OnPresence: func(e *models.PresenceEvent) { events <- e.Event + ":" + e.Member.Id } })
+	b := newTestClient (t, svr, addr, &client.Options{ ClientId: "b", Service: "svc" })
+
+	members, err := a.Members (context.Background())
+	models.TestingStackTrace (t, err)
+	if len(members) != 2 { t.Fatalf("expected both members : %+v", members) }
+
+	models.TestingStackTrace (t, b.Close (time.Second))
+
+	for _, expected := range []string{ "join:b", "leave:b" } {
+		select {
+		case got := <-events:
+			if got != expected { t.Fatalf("expected %s, got %s", expected, got) }
+		case <-time.After (time.Second * 2):
+			t.Fatalf("no %s event", expected)
+		}
+	}
+}
+
+func TestQAClientReplay (t *testing.T) {
+	opts := models.OPTS{ DataDir: t.TempDir(), Durable: true }
+
+	// this one we close ourselves
+	port := freeTestPort (t)
+	svr, err := NewServerWithOpts (port, nil, opts)
+	models.TestingStackTrace (t, err)
+
+	pub, err := client.NewClient ("localhost", port, nil)
+	models.TestingStackTrace (t, err)
+	ctx := context.Background()
+	for i := 1; i <= 5; i++ {
+		_, err := pub.PublishSync (ctx, []byte(fmt.Sprintf("m%d", i)), client.WithTopic ("t"))
+		models.TestingStackTrace (t, err)
+	}
+	models.TestingStackTrace (t, pub.Close (time.Second))
+	models.TestingStackTrace (t, svr.Close (time.Second))
+
+	// what's on disk is there after a restart
+	svr, addr := newTestServer (t, opts)
+
+	recv := &testReceiver{}
+	sub := newTestClient (t, svr, addr, &client.Options{ Handler: recv.handler })
+	models.TestingStackTrace (t, sub.Subscribe (ctx, "t", client.WithReplayFrom (4)))
+
+	waitFor (t, "the replay", func() bool { return len(recv.list()) == 2 })
+	if got := recv.list(); got[0] != "m4" || got[1] != "m5" { t.Fatalf("unexpected replay : %v", got) }
+}
+
+func TestQAClientCredit (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{})
+
+	var handled atomic.Int32
+	sub := newTestClient (t, svr, addr, &client.Options{ Handler: func(ctx context.Context, msg *models.Message) error {
+		handled.Add(1)
+		return nil
+	}})
+	pub := newTestClient (t, svr, addr, nil)
+
+	ctx := context.Background()
+	models.TestingStackTrace (t, sub.Subscribe (ctx, "jobs"))
+
+	sub.Pause()
+	time.Sleep (time.Millisecond * 50) // let the server hear about it
+	for i := 0; i < 5; i++ {
+		_, err := pub.PublishSync (ctx, []byte(fmt.Sprint(i)), client.WithTopic ("jobs"))
+		models.TestingStackTrace (t, err)
+	}
+
+	time.Sleep (time.Millisecond * 100)
+	if handled.Load() != 0 { t.Fatalf("paused but handled %d", handled.Load()) }
+	if held := svr.que.Conn (sub.Id()).Held(); held != 5 { t.Fatalf("expected 5 held for us, got %d", held) }
+
+	sub.Resume()
+	waitFor (t, "the held messages", func() bool { return handled.Load() == 5 })
+}
+
+func TestQADeadLetterAdmin (t *testing.T) {
+	_, addr := newTestServer (t, models.OPTS{})
+
+	conn, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "a" })
+	models.TestingStackTrace (t, err)
+	defer conn.Close()
+
+	frame := &models.Frame{ Type: models.FrameDeadLetter, Confirm: true, Error: "boom", Body: []byte("payload") }
+	frame.Id, frame.Ref, frame.Topic, frame.Attempts = "abc", "dl", "orders", 3
+	writeTestFrame (t, conn, frame)
+	readTestFrame (t, conn, func(f *models.Frame) bool { return f.Ref == "dl" && f.Type == models.FrameAck })
+
+	call := func (method, path string) (int, string) {
+		req, err := http.NewRequest (method, "http://" + addr + path, nil)
+		models.TestingStackTrace (t, err)
+		resp, err := http.DefaultClient.Do (req)
+		models.TestingStackTrace (t, err)
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll (resp.Body)
+		return resp.StatusCode, strings.TrimSpace (string(body))
+	}
+
+	if code, body := call (http.MethodGet, "/admin/dlq"); code != http.StatusOK || body != `{"orders":1}` { t.Fatalf("unexpected topics : %d : %s", code, body) }
+
+	// republishing puts it back on its topic
+	if code, body := call (http.MethodPost, "/admin/dlq/orders/1/republish"); code != http.StatusOK || body != `{"republished":1}` { t.Fatalf("unexpected republish : %d : %s", code, body) }
+	msg := readTestFrame (t, conn, func(f *models.Frame) bool { return f.Type == models.FrameMessage && f.Id == "abc" })
+	if string(msg.Body) != "payload" || msg.Seq == 0 { t.Fatalf("unexpected message : %+v", msg) }
+
+	if code, _ := call (http.MethodDelete, "/admin/dlq/orders"); code != http.StatusNotFound { t.Fatalf("expected nothing left, got %d", code) }
+}
+
+func TestQAClientRequest (t *testing.T) {
+	svr, addr := newTestServerWithHandler (t, func(ctx context.Context, msg *models.Message) error {
+		return msg.Reply (ctx, append([]byte("re:"), msg.Body...))
+	}, models.OPTS{})
+
+	var others atomic.Int32
+	c := newTestClient (t, svr, addr, nil)
+	newTestClient (t, svr, addr, &client.Options{ Handler: func(ctx context.Context, msg *models.Message) error {
+		others.Add(1)
+		return nil
+	}})
+
+	ctx, cancel := context.WithTimeout (context.Background(), time.Second * 2)
+	defer cancel()
+
+	reply, err := c.Request (ctx, []byte("ping"))
+	models.TestingStackTrace (t, err)
+	if string(reply.Body) != "re:ping" || len(reply.ReplyTo) == 0 { t.Fatalf("unexpected reply : %+v", reply) }
+
+	time.Sleep (time.Millisecond * 100)
+	if others.Load() != 0 { t.Fatal("the reply went to someone else") }
+}
+
+func TestQAClientUnicast (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{})
+
+	got := make(chan string, 10)
+	newTestClient (t, svr, addr, &client.Options{ ClientId: "a", Handler: func(ctx context.Context, msg *models.Message) error {
+		got <- string(msg.Body) + " from " + msg.Sender
+		return msg.Reply (ctx, []byte("pong"))
+	}})
+
+	recv := &testReceiver{}
+	b := newTestClient (t, svr, addr, &client.Options{ ClientId: "b", Handler: recv.handler })
+
+	ctx, cancel := context.WithTimeout (context.Background(), time.Second * 2)
+	defer cancel()
+
+	reply, err := b.Request (ctx, []byte("ping"), client.WithTo ("a"))
+	models.TestingStackTrace (t, err)
+	if string(reply.Body) != "pong" || <-got != "ping from b" { t.Fatalf("unexpected reply : %+v", reply) }
+
+	// nobody by that name, which the server tells us right away rather than leaving us to time out
+	start := time.Now()
+	if _, err := b.PublishSync (ctx, []byte("x"), client.WithTo ("nobody")); err == nil || errors.Is (err, context.DeadlineExceeded) || time.Since(start) > time.Millisecond * 500 {
+		t.Fatalf("expected a quick error for a missing client, got %v after %s", err, time.Since(start))
+	}
+
+	// and from the server itself
+	models.TestingStackTrace (t, svr.SendTo ("b", []byte("direct")))
+	if err := svr.SendTo ("nobody", []byte("direct")); err == nil { t.Fatal("expected an error for a missing client") }
+
+	waitFor (t, "the direct message", func() bool { return len(recv.list()) == 1 })
+	if got := recv.list(); got[0] != "direct" { t.Fatalf("unexpected messages : %v", got) }
+}
+
+func TestQAClientEcho (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{})
+
+	var na, nb atomic.Int32
+	a := newTestClient (t, svr, addr, &client.Options{ Handler: func(ctx context.Context, msg *models.Message) error { na.Add(1); return nil } })
+	b := newTestClient (t, svr, addr, &client.Options{ NoEcho: true, Handler: func(ctx context.Context, msg *models.Message) error { nb.Add(1); return nil } })
+
+	ctx := context.Background()
+	models.TestingStackTrace (t, a.Publish (ctx, []byte("1")))
+	models.TestingStackTrace (t, a.Publish (ctx, []byte("2"), client.WithNoEcho()))
+	models.TestingStackTrace (t, b.Publish (ctx, []byte("3")))
+
+	// a sees its own first one and b's, b sees both of a's but not its own
+	waitFor (t, "the messages", func() bool { return na.Load() == 2 && nb.Load() == 2 })
+	time.Sleep (time.Millisecond * 100)
+	if na.Load() != 2 || nb.Load() != 2 { t.Fatalf("unexpected echo : %d : %d", na.Load(), nb.Load()) }
+}
+
+func TestQAClientShutdown (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{ DrainNotify: time.Millisecond * 50, DrainFlush: time.Millisecond * 50, DrainReady: time.Millisecond * 10 })
+
+	// subscribed to something else, they still hear we're going away
+	c := newTestClient (t, svr, addr, &client.Options{ Handler: (&testReceiver{}).handler })
+	ctx, cancel := context.WithTimeout (context.Background(), time.Second * 2)
+	defer cancel()
+	models.TestingStackTrace (t, c.Subscribe (ctx, "jobs"))
+
+	svr.Drain()
+
+	ctx, cancel = context.WithTimeout (context.Background(), time.Millisecond * 300)
+	defer cancel()
+	if _, err := c.PublishSync (ctx, []byte("late"), client.WithTopic ("jobs")); err == nil { t.Fatal("expected the client to stop publishing to a draining server") }
+}
+
+func TestQAClientShutdownBody (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{ History: 10 })
+
+	ctx, cancel := context.WithTimeout (context.Background(), time.Second * 2)
+	defer cancel()
+
+	// a message that just looks like the old shutdown notice doesn't stop a client that speaks frames
+	recv := &testReceiver{}
+	live := newTestClient (t, svr, addr, &client.Options{ Handler: recv.handler })
+	svr.NewMsg ([]byte(models.ShutdownMessage))
+	svr.NewMsg ([]byte("after"))
+	waitFor (t, "the messages", func() bool { return len(recv.list()) == 2 })
+
+	_, err := live.PublishSync (ctx, []byte("still here"))
+	models.TestingStackTrace (t, err)
+
+	// and the server's own notices aren't kept for later subscribers to replay
+	recv = &testReceiver{}
+	late := newTestClient (t, svr, addr, &client.Options{ Handler: recv.handler })
+	models.TestingStackTrace (t, late.Subscribe (ctx, "", client.WithReplayLast (10)))
+	waitFor (t, "the replay", func() bool { return len(recv.list()) >= 2 })
+
+	_, err = late.PublishSync (ctx, []byte("me too"))
+	models.TestingStackTrace (t, err)
+	if got := recv.list(); got[0] != "after" || got[1] != "still here" { t.Fatalf("unexpected replay : %v", got) }
+}
@@ -93,7 +93,7 @@ func (this *app) init() (models.Callback, error) {
 	this.Logger.Init()
 	
 	var err error
-	this.server, err = server.NewServer (opts.WSSPort, nil)
+	this.server, err = server.NewServerWithOpts (opts.WSSPort, nil, opts.OPTS)
 
 	return func() error {
 		// close these in order
@@ -110,6 +110,7 @@ func (this *app) monitorForKill(fn func()) {
 
 	go func() {
 		<-c // this sits until something comes into the channel, eg the notify interupts from above
+		this.drain() // k8 sends a SIGTERM when it wants us gone, so drain before we stop running
 		this.running = false
 		if fn != nil {
 			fn() // any callback function, like a timeout or shutdown
@@ -117,6 +118,13 @@ func (this *app) monitorForKill(fn func()) {
 	}()
 }
 
+// drains the k8mq server, this is safe to call from both the preStop hook and the SIGTERM
+func (this *app) drain () {
+	if this.server != nil {
+		this.server.Drain()
+	}
+}
+
 // create a default server handler based on our routes
 func (this *app) createServer (port int, wg *sync.WaitGroup, handler http.Handler) *http.Server {
 	svr := &http.Server {
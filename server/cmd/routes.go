@@ -37,7 +37,7 @@ func (this *app) liveCheck (next http.Handler) http.Handler {
 
 func (this *app) readyCheck (next http.Handler) http.Handler {
 	return http.HandlerFunc (func(w http.ResponseWriter, r *http.Request) {
-		if this.running {
+		if this.running && this.server.Ready() {
 			next.ServeHTTP(w, r)
 		} else {
 			//if we're here it's bad
@@ -51,6 +51,12 @@ func (this *app) thingsLookGood (w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Things look good")) //we're good
 }
 
+// designed for the k8 preStop hook, blocks until the server has finished draining
+func (this *app) drainHandle (w http.ResponseWriter, r *http.Request) {
+	this.drain()
+	w.Write([]byte("Drained"))
+}
+
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- ENTRY POINTS ------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
@@ -67,5 +73,8 @@ func (this *app) routes () *mux.Router {
 	mux.Handle("/status/live", liveCheck.ThenFunc(this.thingsLookGood)).Methods(http.MethodGet, http.MethodOptions)
 
 	mux.Handle("/status/ready", liveCheck.Append(this.readyCheck).ThenFunc(this.thingsLookGood)).Methods(http.MethodGet, http.MethodOptions)
+
+	// preStop hook, so we're drained before k8 sends the SIGTERM
+	mux.Handle("/status/drain", alice.New().ThenFunc(this.drainHandle)).Methods(http.MethodGet, http.MethodPost)
 	return mux
 }
@@ -0,0 +1,162 @@
+/** ****************************************************************************************************************** **
+	Admin endpoints for looking at, and poking, the state of the server
+	
+** ****************************************************************************************************************** **/
+
+package server 
+
+import (
+	"github.com/gorilla/mux"
+
+	"net/http"
+	"strconv"
+	"encoding/json"
+)
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- HELPERS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+// writes out the object as json
+func (this *Server) writeJson (w http.ResponseWriter, obj any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(obj)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- MEMBERS -----------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+// lists everyone connected, oldest connection first
+func (this *Server) membersList (w http.ResponseWriter, r *http.Request) {
+	this.writeJson (w, this.que.Members())
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- PARTITIONS --------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+// who owns each partition, for every consumer group with members
+func (this *Server) partitionsList (w http.ResponseWriter, r *http.Request) {
+	this.writeJson (w, this.que.Partitions().List())
+}
+
+// gives a topic its partitions, before any consumer group has started using it
+func (this *Server) partitionsDeclare (w http.ResponseWriter, r *http.Request) {
+	topic := mux.Vars(r)["topic"]
+	count, _ := strconv.Atoi (mux.Vars(r)["count"]) // the route only matches digits
+
+	if err := this.que.Partitions().Declare (topic, count); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	this.writeJson (w, map[string]int{ topic: count })
+}
+
+// what each consumer group has committed
+func (this *Server) groupsList (w http.ResponseWriter, r *http.Request) {
+	this.writeJson (w, this.offsets.List())
+}
+
+// how far behind each consumer group is, per partition
+func (this *Server) lagList (w http.ResponseWriter, r *http.Request) {
+	this.writeJson (w, this.history.Lag (this.offsets))
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- LOG ---------------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+// what each topic is using in the log, and its retention limits
+func (this *Server) logUsage (w http.ResponseWriter, r *http.Request) {
+	this.writeJson (w, this.history.Usages())
+}
+
+// what a single topic is using in the log
+func (this *Server) logTopicUsage (w http.ResponseWriter, r *http.Request) {
+	this.writeJson (w, this.history.Usage (mux.Vars(r)["topic"]))
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- SCHEDULED ---------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+// lists the messages waiting to go out, soonest first
+func (this *Server) scheduledList (w http.ResponseWriter, r *http.Request) {
+	this.writeJson (w, this.scheduler.List())
+}
+
+// cancels the scheduled messages with this id
+func (this *Server) scheduledCancel (w http.ResponseWriter, r *http.Request) {
+	if this.scheduler.Cancel (mux.Vars(r)["id"]) == false {
+		http.Error(w, "No scheduled messages with that id", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+  //-------------------------------------------------------------------------------------------------------------------------//
+ //----- DEAD LETTERS ------------------------------------------------------------------------------------------------------//
+//-------------------------------------------------------------------------------------------------------------------------//
+
+// the dead letter id from the url, 0 if there isn't one which means all of them
+func (this *Server) deadLetterId (r *http.Request) (uint64, error) {
+	id, ok := mux.Vars(r)["id"]
+	if ok == false { return 0, nil }
+
+	return strconv.ParseUint(id, 10, 64)
+}
+
+// source topics with dead letters, and how many they have
+func (this *Server) deadLetterTopics (w http.ResponseWriter, r *http.Request) {
+	this.writeJson (w, this.deadLetters.Topics())
+}
+
+// dead letters for the source topic, oldest first
+func (this *Server) deadLetterList (w http.ResponseWriter, r *http.Request) {
+	this.writeJson (w, this.deadLetters.List (mux.Vars(r)["topic"]))
+}
+
+// removes one dead letter, or all of them for the topic
+func (this *Server) deadLetterPurge (w http.ResponseWriter, r *http.Request) {
+	id, err := this.deadLetterId (r)
+	if err != nil {
+		http.Error(w, "Invalid dead letter id", http.StatusBadRequest)
+		return
+	}
+
+	list := this.deadLetters.Remove (mux.Vars(r)["topic"], id)
+	if len(list) == 0 {
+		http.Error(w, "No dead letters found", http.StatusNotFound)
+		return
+	}
+
+	this.writeJson (w, map[string]int{ "purged": len(list) })
+}
+
+// removes one dead letter, or all of them for the topic, and publishes them back onto their original topic
+func (this *Server) deadLetterRepublish (w http.ResponseWriter, r *http.Request) {
+	id, err := this.deadLetterId (r)
+	if err != nil {
+		http.Error(w, "Invalid dead letter id", http.StatusBadRequest)
+		return
+	}
+
+	list := this.deadLetters.Remove (mux.Vars(r)["topic"], id)
+	if len(list) == 0 {
+		http.Error(w, "No dead letters found", http.StatusNotFound)
+		return
+	}
+
+	for _, dl := range list {
+		msg := dl.Message
+		msg.Seq = 0 // it gets a new one as it goes back out
+		msg.Attempts = 0 // and a fresh start
+		msg.From = nil
+		this.deliver (msg)
+	}
+
+	this.writeJson (w, map[string]int{ "republished": len(list) })
+}
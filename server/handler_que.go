@@ -9,9 +9,17 @@ package server
 import (
 	"github.com/gorilla/websocket"
 
+	"github.com/NathanRThomas/k8mq/models"
+
+	"github.com/pkg/errors"
+
+	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
+	"encoding/json"
 	"log/slog"
 )
 
@@ -42,9 +50,364 @@ func (this *Server) wssErr (err error) {
 	slog.Warn("k8mq wss error :" + err.Error())
 }
 
+// the frame if the connection said it speaks them when it connected, everything from older clients is a raw message
+func (this *Server) parseFrame (conn *models.QueConn, data []byte) (*models.Frame, bool) {
+	if conn.Info().Proto < models.ProtocolVersion { return nil, false }
+	return models.ParseFrame (data)
+}
+
+// handles a single message read from a connection
+func (this *Server) wssMessage (conn *models.QueConn, data []byte) {
+	conn.Touch() // for presence
+	msg := &models.QueMessage{ Msg: data, From: conn }
+
+	if frame, ok := this.parseFrame (conn, data); ok {
+		msg.Msg = frame.Body
+		msg.Envelope = frame.Envelope
+		msg.Confirm = frame.Confirm
+
+		switch frame.Type {
+		case models.FramePublish:
+			msg.Attempts = 0 // that's for us to count
+
+		case models.FrameNack:
+			msg.Attempts = this.attempts.Fail (msg) // we keep count, so a client can't keep it going forever
+			msg.From = nil // the publisher already heard back from us, sender is left alone as it's who originally published it
+			this.redeliver (msg, frame.Error, conn)
+			return
+
+		case models.FrameDeadLetter:
+			this.deadLetter (msg, frame.Error)
+			conn.Ack (msg)
+			return
+
+		case models.FrameSubscribe:
+			this.subscribe (conn, msg)
+			return
+
+		case models.FrameUnsubscribe: // in order with the messages, as it can move the group's partitions around
+			err := this.que.Do (func() {
+				this.que.Unsubscribe (conn, msg.Topic)
+				conn.Ack (msg)
+			})
+			if err != nil {
+				conn.Nack (msg, err)
+			}
+			return
+
+		case models.FrameCommit:
+			this.commit (conn, msg)
+			return
+
+		case models.FramePresence:
+			this.answer (conn, msg, models.PresenceTopic, this.que.Members())
+			return
+
+		case models.FrameLag:
+			this.answer (conn, msg, models.LagTopic, this.history.Lag (this.offsets))
+			return
+
+		case models.FrameCredit:
+			if err := this.que.Grant (conn, msg.Credit); err != nil {
+				conn.Nack (msg, err)
+			}
+			return
+
+		case models.FramePause:
+			conn.Pause()
+			return
+
+		case models.FrameCancel: // the body is the id to cancel, the frame has its own id for the ack
+			if this.scheduler.Cancel (string(msg.Msg)) {
+				conn.Ack (msg)
+			} else {
+				conn.Nack (msg, errors.Errorf("no scheduled messages with id %s", msg.Msg))
+			}
+			return
+
+		default:
+			slog.Warn(fmt.Sprintf("k8mq wss unexpected frame type : %s", frame.Type))
+			conn.WriteFrame (&models.Frame{ Type: models.FrameError, Envelope: frame.Envelope, Error: "unsupported frame type " + string(frame.Type) })
+			return
+		}
+	} else {
+		msg.Id = models.IdHash (data) // raw messages can still be deduped if they have one
+	}
+
+	if _, err := models.ParseSelector (msg.Selector); err != nil {
+		slog.Info(fmt.Sprintf("k8mq rejected message %s : %s", msg.Id, err.Error()))
+		conn.Nack (msg, err)
+		return
+	}
+
+	msg.Sender = conn.Id() // we set this so a client can't pretend to be someone else
+	if msg.Published == 0 {
+		msg.Published = time.Now().UnixMilli()
+	}
+
+	if msg.Expired() {
+		this.que.Metrics().Expired.Add(1)
+		conn.Nack (msg, models.ErrExpired)
+		return
+	}
+
+	// replies often carry the request's IdHash in their body, so they'd look like a repeat of it
+	if len(msg.ReplyTo) == 0 && this.dedup.Seen (msg.Id) {
+		this.que.Metrics().Duplicates.Add(1)
+		slog.Info("k8mq dropped duplicate message : " + msg.Id)
+		conn.Ack (msg) // they got it to us once already, so as far as they're concerned it's accepted
+		return
+	}
+
+	if msg.Scheduled() {
+		msg.Seq = this.que.NextSeq()
+
+		scheduled := *msg // the scheduler could send it before we've acked this
+		scheduled.From = nil // so we don't ack it again when it goes out
+		if err := this.scheduler.Add (&scheduled); err != nil {
+			slog.Warn(fmt.Sprintf("k8mq failed to schedule message %s : %s", msg.Id, err.Error()))
+			this.refuse (msg, err)
+			return
+		}
+
+		conn.Ack (msg) // it's safe with us
+		return
+	}
+
+	this.deliver (msg)
+}
+
+// subscribes the connection to the topic, sending them any history they asked for before the live messages
+// if they didn't ask for any history they get the retained message, if there is one
+func (this *Server) subscribe (conn *models.QueConn, msg *models.QueMessage) {
+	if msg.Partitions > 0 {
+		if err := this.que.Partitions().Declare (msg.Topic, msg.Partitions); err != nil {
+			conn.Nack (msg, err)
+			return
+		}
+	}
+
+	err := this.que.Do (func() {
+		this.que.Subscribe (conn, msg.Topic, msg.Group)
+
+		list := this.history.Replay (msg.Topic, msg.Replay)
+		if msg.Replay == nil {
+			if retained := this.retained.Get (msg.Topic); retained != nil {
+				list = append (list, retained)
+			}
+		}
+
+		if err := conn.Replay (list); err != nil {
+			slog.Info("k8mq unable to replay : " + err.Error())
+		}
+		conn.Ack (msg) // after the replay, so they know it's all there
+	})
+
+	if err != nil {
+		conn.Nack (msg, err)
+	}
+}
+
+// records the offset a consumer group has handled up to, older offsets are ignored
+func (this *Server) commit (conn *models.QueConn, msg *models.QueMessage) {
+	if len(msg.Group) == 0 || msg.Offset == 0 {
+		conn.Nack (msg, errors.Errorf("a commit needs a group and an offset"))
+		return
+	}
+
+	// only the member that owns the partition gets to move the group along
+	if this.que.Partitions().Owner (msg.Topic, msg.Group, msg.Partition) != conn {
+		conn.Nack (msg, errors.Errorf("not the owner of partition %d of %s in group %s", msg.Partition, msg.Topic, msg.Group))
+		return
+	}
+
+	this.offsets.Commit (msg.Group, msg.Topic, msg.Partition, msg.Offset)
+	conn.Ack (msg)
+}
+
+// replies to a client asking about the server, eg the current members
+func (this *Server) answer (conn *models.QueConn, msg *models.QueMessage, topic string, obj any) {
+	data, err := json.Marshal (obj)
+	if err != nil {
+		conn.Nack (msg, err)
+		return
+	}
+
+	frame := &models.Frame{ Type: models.FrameMessage, Envelope: models.Envelope{ Id: models.MessageId (nil), Topic: topic, ReplyTo: msg.Id }, Body: data }
+	if err = conn.WriteFrame (frame); err != nil {
+		slog.Info("k8mq unable to write the answer for " + topic + " : " + err.Error())
+	}
+}
+
+// moves the message to its dead letter topic
+func (this *Server) deadLetter (msg *models.QueMessage, reason string) {
+	this.attempts.Done (msg)
+
+	dead := *msg // it can be republished from the admin while we're still using this
+	dead.From, dead.Target = nil, nil
+	this.deadLetters.Add (&dead, reason, msg.Attempts, msg.PublishedAt())
+	this.que.Metrics().DeadLettered.Add(1)
+}
+
+// a handler failed the message, so try again after backing off, or dead letter it once it's out of attempts
+// target is the connection that failed it, nil if it was our own handler
+// the publisher, if it's still waiting, only hears back once it's accepted or dead lettered
+func (this *Server) redeliver (msg *models.QueMessage, reason string, target *models.QueConn) {
+	if target == nil {
+		msg.Attempts++ // our own handler, so this is our count
+	}
+
+	if msg.Attempts > this.opts.MaxRedeliveries {
+		this.deadLetter (msg, reason)
+		if msg.From != nil {
+			msg.From.Nack (msg, errors.New (reason))
+		}
+		return
+	}
+
+	if target != nil {
+		if len(msg.To) == 0 {
+			msg.Group = target.Group (msg.Topic) // so whoever has the partition by then can take it instead
+		}
+		msg.To = target.Id() // nobody else needs to see this again, and it survives a restart
+	}
+	msg.DeliverAt = time.Now().Add(this.opts.RedeliveryDelay * time.Duration(msg.Attempts)).UnixMilli()
+	this.que.Metrics().Redelivered.Add(1)
+
+	// the scheduler holds it until then, so it's saved and isn't lost if we're closing
+	if err := this.scheduler.Add (msg); err != nil {
+		this.deadLetter (msg, "unable to schedule redelivery : " + err.Error())
+		if msg.From != nil {
+			msg.From.Nack (msg, err)
+		}
+	}
+}
+
+// sends the body back to just the connection that published the message, errors if they've gone away
+func (this *Server) reply (ctx context.Context, msg *models.QueMessage, body []byte) error {
+	if err := ctx.Err(); err != nil { return errors.WithStack(err) }
+
+	out := &models.QueMessage{ Msg: body }
+	out.Topic = msg.Topic
+	out.ReplyTo = msg.Id
+
+	return this.sendTo (msg.Sender, out)
+}
+
+// sends the message to just the client with this id
+func (this *Server) sendTo (id string, msg *models.QueMessage) error {
+	msg.To = id
+	msg.Target = this.que.Conn (id)
+	if msg.Target == nil { return errors.Wrap (models.ErrNotConnected, id) }
+
+	if len(msg.Id) == 0 {
+		msg.Id = models.MessageId (msg.Msg)
+	}
+	msg.Published = time.Now().UnixMilli()
+
+	return this.que.Publish (msg)
+}
+
+// lets the publisher know who they were sending to isn't connected
+// this goes back whether they asked for confirms or not, otherwise the message would just disappear
+func (this *Server) unreachable (msg *models.QueMessage) {
+	slog.Info(fmt.Sprintf("k8mq target not connected : %s : %s", msg.To, msg.Id))
+	if msg.From == nil { return }
+	this.dedup.Forget (msg.Id) // they can try again once the target's back
+
+	frame := &models.Frame{ Type: models.FrameError, Envelope: models.Envelope{ Id: msg.Id, Ref: msg.Ref, To: msg.To }, Error: errors.Wrap (models.ErrNotConnected, msg.To).Error() }
+	if err := msg.From.WriteFrame (frame); err != nil {
+		slog.Warn("k8mq unable to write error frame : " + err.Error())
+	}
+}
+
+// tells the publisher we didn't take the message, forgetting its id so a retry isn't dropped as a duplicate
+func (this *Server) refuse (msg *models.QueMessage, err error) {
+	if len(msg.ReplyTo) == 0 {
+		this.dedup.Forget (msg.Id)
+	}
+	msg.From.Nack (msg, err)
+}
+
+// reply handle for the message, nil if it didn't come from a connection
+func (this *Server) replier (msg *models.QueMessage) models.ReplyFunc {
+	if len(msg.Sender) == 0 { return nil }
+
+	return func(ctx context.Context, body []byte) error {
+		return this.reply (ctx, msg, body)
+	}
+}
+
+// hands the message to our handler if we have one, otherwise it goes out to everyone
+// messages for a specific client, or with a selector, only go to them
+func (this *Server) deliver (msg *models.QueMessage) {
+	if msg.Retain && msg.Target == nil && len(msg.To) == 0 { // redeliveries and unicasts don't change what's retained
+		this.retained.Set (msg)
+
+		if len(msg.Msg) == 0 { // this was just to clear what's retained, there's nothing to deliver
+			if msg.From != nil {
+				msg.From.Ack (msg)
+			}
+			return
+		}
+	}
+
+	if len(msg.To) > 0 {
+		msg.Target = this.que.Conn (msg.To) // they may have re-connected since we last looked
+		if msg.Target == nil && len(msg.Group) > 0 {
+			// a redelivery for a group goes to whoever owns the partition now
+			if msg.Target = this.que.Partitions().Owner (msg.Topic, msg.Group, msg.Partition); msg.Target != nil {
+				msg.To = msg.Target.Id()
+			}
+		}
+
+		if msg.Target == nil {
+			if msg.Attempts > 0 { // a redelivery with nobody left to take it, so keep it rather than lose it
+				this.deadLetter (msg, "consumer " + msg.To + " went away before the redelivery")
+				return
+			}
+			this.unreachable (msg)
+			return
+		}
+	}
+
+	if this.handler != nil && msg.Target == nil && len(msg.Selector) == 0 { // messages for specific clients skip the handler
+		if msg.Expired() {
+			this.que.Metrics().Expired.Add(1) // scheduled messages could have expired while they waited
+			return
+		}
+
+		if msg.Seq == 0 {
+			msg.Seq = this.que.NextSeq()
+			this.que.Metrics().Published.Add(1)
+		}
+
+		// we have a specific handler, so do use that instead
+		if err := this.handler (this.ctx, &models.Message{ Envelope: msg.Envelope, Body: msg.Msg, Replier: this.replier (msg) }); err != nil {
+			slog.Warn(fmt.Sprintf("k8mq handler failed message %s : %s", msg.Id, err.Error()))
+			this.redeliver (msg, err.Error(), nil)
+			return
+		}
+
+		if msg.From != nil {
+			msg.From.Ack (msg) // the handler has it, so that's as accepted as it gets
+		}
+		return
+	}
+
+	// repeat this to everyone
+	if err := this.que.Publish (msg); err != nil {
+		if msg.From != nil {
+			this.refuse (msg, err)
+		} else {
+			slog.Warn(fmt.Sprintf("k8mq unable to deliver message %s : %s", msg.Id, err.Error()))
+		}
+	}
+}
+
 // websocket entry point
 func (this *Server) wssHandle (w http.ResponseWriter, r *http.Request) {
-	if this.closing { return } // bail on new connections while we're closing down
+	if this.closing.Load() { return } // bail on new connections while we're closing down
 	
 	ctx := r.Context() // pass to the connect to test context to see if it's bad?
 	var upgrader = websocket.Upgrader{
@@ -53,7 +416,8 @@ func (this *Server) wssHandle (w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	c, err := upgrader.Upgrade(w, r, nil)
+	// let the client know we speak frames, so it only sends them if we do
+	c, err := upgrader.Upgrade(w, r, http.Header{ models.ProtocolHeader: []string{ strconv.Itoa(models.ProtocolVersion) } })
 	if err != nil {
 		slog.Warn("k8mq wss upgrade error :" + err.Error())
 		return
@@ -62,7 +426,8 @@ func (this *Server) wssHandle (w http.ResponseWriter, r *http.Request) {
 	defer c.Close() // close it eventually
 
 	// add this to our flow of users
-	this.que.AddConnection (ctx, c)
+	conn := this.que.NewConnection (ctx, c, models.ParseConnInfo (r.URL.Query()))
+	defer this.que.RemoveConnection (conn) // so everyone hears they left right away
 
 	// listener
 	for {
@@ -76,10 +441,6 @@ func (this *Server) wssHandle (w http.ResponseWriter, r *http.Request) {
 
 		if mType != 1 { continue } // only passing along 1 types right now, utf8
 
-		if this.reader != nil {
-			this.reader (msg) // we have a specific reader, so do use that instead
-		} else {
-			this.que.NewMsg (msg) // repeat this to everyone
-		}
+		this.wssMessage (conn, msg)
 	}
 }
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/NathanRThomas/k8mq/models"
+
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQAConfirms (t *testing.T) {
+	_, addr := newTestServer (t, models.OPTS{})
+
+	// we tell clients we speak frames as they connect
+	info := models.ConnInfo{ Proto: models.ProtocolVersion, Id: "pub" }
+	conn, resp, err := websocket.DefaultDialer.Dial (fmt.Sprintf("ws://%s/que?%s", addr, info.Query().Encode()), nil)
+	models.TestingStackTrace (t, err)
+	defer conn.Close()
+	if resp.Header.Get (models.ProtocolHeader) != fmt.Sprint(models.ProtocolVersion) { t.Fatalf("expected the protocol header : %v", resp.Header) }
+
+	publish := func (ref, selector string) *models.Frame {
+		frame := &models.Frame{ Type: models.FramePublish, Confirm: true, Body: []byte("hello") }
+		frame.Id, frame.Ref, frame.Selector = "same-id", ref, selector
+		writeTestFrame (t, conn, frame)
+		return readTestFrame (t, conn, func(f *models.Frame) bool { return f.Ref == ref })
+	}
+
+	// the ack comes back with our ref and the sequence number it was given
+	ack := publish ("one", "")
+	if ack.Type != models.FrameAck || ack.Id != "same-id" || ack.Seq == 0 { t.Fatalf("unexpected ack : %+v", ack) }
+
+	// the same id again is a duplicate, but this publish still hears back under its own ref
+	if ack = publish ("two", ""); ack.Type != models.FrameAck { t.Fatalf("expected the duplicate to be acked : %+v", ack) }
+
+	// and a bad one is rejected
+	if nack := publish ("three", "app in ("); nack.Type != models.FrameError || len(nack.Error) == 0 { t.Fatalf("expected an error frame : %+v", nack) }
+}
+
+func TestQARawClients (t *testing.T) {
+	_, addr := newTestServer (t, models.OPTS{})
+
+	// older clients don't send a protocol, so everything they send is a raw message, even if it looks like a frame
+	sub, err := dialTestServer (addr, models.ConnInfo{})
+	models.TestingStackTrace (t, err)
+	defer sub.Close()
+
+	pub, err := dialTestServer (addr, models.ConnInfo{})
+	models.TestingStackTrace (t, err)
+	defer pub.Close()
+
+	time.Sleep (time.Millisecond * 50) // let them both get added
+	body := []byte(`{"k8mq":"pub","body":"aGVsbG8="}`)
+	models.TestingStackTrace (t, pub.WriteMessage (websocket.TextMessage, body))
+
+	sub.SetReadDeadline (time.Now().Add(time.Second * 2))
+	_, data, err := sub.ReadMessage()
+	models.TestingStackTrace (t, err)
+	if string(data) != string(body) { t.Fatalf("expected the raw message as it was sent, got %s", data) }
+}
+
+func TestQACancel (t *testing.T) {
+	_, addr := newTestServer (t, models.OPTS{})
+
+	conn, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "pub" })
+	models.TestingStackTrace (t, err)
+	defer conn.Close()
+
+	frame := &models.Frame{ Type: models.FramePublish, Confirm: true, Body: []byte("later") }
+	frame.Id, frame.Ref, frame.DeliverAt = "scheduled", "one", time.Now().Add(time.Hour).UnixMilli()
+	writeTestFrame (t, conn, frame)
+	if ack := readTestFrame (t, conn, func(f *models.Frame) bool { return f.Ref == "one" }); ack.Type != models.FrameAck { t.Fatalf("expected it to be scheduled : %+v", ack) }
+
+	// the cancel has its own id, so its ack can't be mistaken for the scheduled message's
+	cancel := func (ref string) *models.Frame {
+		frame := &models.Frame{ Type: models.FrameCancel, Confirm: true, Body: []byte("scheduled") }
+		frame.Id, frame.Ref = "cancel-" + ref, ref
+		writeTestFrame (t, conn, frame)
+		return readTestFrame (t, conn, func(f *models.Frame) bool { return f.Ref == ref })
+	}
+
+	if ack := cancel ("two"); ack.Type != models.FrameAck || ack.Id != "cancel-two" { t.Fatalf("unexpected ack : %+v", ack) }
+	if nack := cancel ("three"); nack.Type != models.FrameError { t.Fatalf("expected nothing left to cancel : %+v", nack) }
+}
+
+func TestQARedeliver (t *testing.T) {
+	// our handler fails everything the first couple of times
+	failures := make(map[string]int)
+	var lock sync.Mutex
+	handler := func (ctx context.Context, msg *models.Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+
+		failures[msg.Id]++
+		if failures[msg.Id] <= 2 { return errors.New("not yet") }
+		if msg.Id == "never" { return errors.New("never") }
+		return nil
+	}
+
+	svr, addr := newTestServerWithHandler (t, handler, models.OPTS{ MaxRedeliveries: 3, RedeliveryDelay: time.Millisecond * 10 })
+
+	conn, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "pub" })
+	models.TestingStackTrace (t, err)
+	defer conn.Close()
+
+	publish := func (id string) *models.Frame {
+		frame := &models.Frame{ Type: models.FramePublish, Confirm: true, Body: []byte("hello") }
+		frame.Id, frame.Ref = id, id
+		frame.Attempts = 100 // not for them to say
+		writeTestFrame (t, conn, frame)
+
+		// the first thing we hear back is the final answer, not each failure
+		return readTestFrame (t, conn, func(f *models.Frame) bool { return f.Ref == id })
+	}
+
+	if ack := publish ("works"); ack.Type != models.FrameAck { t.Fatalf("expected an ack once the handler took it : %+v", ack) }
+	if nack := publish ("never"); nack.Type != models.FrameError { t.Fatalf("expected an error once it was dead lettered : %+v", nack) }
+
+	if list := svr.deadLetters.List (""); len(list) != 1 || list[0].Message.Id != "never" || list[0].Attempts != 4 { t.Fatalf("unexpected dead letters : %+v", list) }
+}
+
+func TestQANackAttempts (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{ MaxRedeliveries: 2, RedeliveryDelay: time.Millisecond * 10 })
+
+	sub, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "sub" })
+	models.TestingStackTrace (t, err)
+	defer sub.Close()
+
+	pub, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "pub" })
+	models.TestingStackTrace (t, err)
+	defer pub.Close()
+
+	time.Sleep (time.Millisecond * 50) // let them both get added
+	frame := &models.Frame{ Type: models.FramePublish, Body: []byte("hello") }
+	frame.Id = "fails"
+	writeTestFrame (t, pub, frame)
+
+	// the subscriber keeps nacking it, always claiming it's the first attempt
+	for i := 0; i < 3; i++ {
+		msg := readTestFrame (t, sub, func(f *models.Frame) bool { return f.Id == "fails" })
+		msg.Type, msg.Error, msg.Attempts = models.FrameNack, "nope", 0
+		writeTestFrame (t, sub, msg)
+	}
+
+	// but we kept count, so it's dead lettered
+	time.Sleep (time.Millisecond * 50)
+	if list := svr.deadLetters.List (""); len(list) != 1 || list[0].Attempts != 3 { t.Fatalf("unexpected dead letters : %+v", list) }
+}
+
+func TestQASubscribeWindow (t *testing.T) {
+	_, addr := newTestServer (t, models.OPTS{ History: 100 })
+
+	pub, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "pub" })
+	models.TestingStackTrace (t, err)
+	defer pub.Close()
+
+	publish := func (body string) {
+		frame := &models.Frame{ Type: models.FramePublish, Confirm: true, Body: []byte(body) }
+		frame.Id, frame.Ref, frame.Topic = body, body, "t"
+		writeTestFrame (t, pub, frame)
+		readTestFrame (t, pub, func(f *models.Frame) bool { return f.Ref == body })
+	}
+
+	publish ("m1") // before they connect, so they only get it from the replay
+
+	sub, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "sub" })
+	models.TestingStackTrace (t, err)
+	defer sub.Close()
+	time.Sleep (time.Millisecond * 50) // let them get added
+
+	// they get everything live until they've subscribed
+	publish ("m2")
+	publish ("m3")
+
+	frame := &models.Frame{ Type: models.FrameSubscribe, Confirm: true }
+	frame.Id, frame.Ref, frame.Topic, frame.Replay = "sub", "sub", "t", &models.Replay{ Last: 10 }
+	writeTestFrame (t, sub, frame)
+
+	got := make([]string, 0)
+	readTestFrame (t, sub, func(f *models.Frame) bool {
+		if f.Type == models.FrameMessage { got = append(got, string(f.Body)) }
+		return f.Ref == "sub" // acked once the replay's gone out
+	})
+
+	publish ("m4")
+	msg := readTestFrame (t, sub, func(f *models.Frame) bool { return f.Type == models.FrameMessage })
+	got = append(got, string(msg.Body))
+
+	// the replay skips what they already got live, so nothing comes twice
+	if strings.Join (got, " ") != "m2 m3 m1 m4" { t.Fatalf("unexpected messages : %v", got) }
+}
+
+func TestQADeclarePartitions (t *testing.T) {
+	_, addr := newTestServer (t, models.OPTS{})
+
+	conn, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "a" })
+	models.TestingStackTrace (t, err)
+	defer conn.Close()
+
+	subscribe := func (ref, topic string, partitions int) *models.Frame {
+		frame := &models.Frame{ Type: models.FrameSubscribe, Confirm: true }
+		frame.Id, frame.Ref, frame.Topic, frame.Group, frame.Partitions = ref, ref, topic, "workers", partitions
+		writeTestFrame (t, conn, frame)
+		return readTestFrame (t, conn, func(f *models.Frame) bool { return f.Ref == ref })
+	}
+
+	// the first subscribe declares them
+	if ack := subscribe ("one", "jobs", 4); ack.Type != models.FrameAck { t.Fatalf("expected the subscribe to work : %+v", ack) }
+	if nack := subscribe ("two", "jobs", 2); nack.Type != models.FrameError { t.Fatalf("expected a count conflict : %+v", nack) }
+
+	declare := func (path string) int {
+		req, err := http.NewRequest (http.MethodPut, "http://" + addr + path, nil)
+		models.TestingStackTrace (t, err)
+		resp, err := http.DefaultClient.Do (req)
+		models.TestingStackTrace (t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// or an admin can
+	if code := declare ("/admin/partitions/orders/6"); code != http.StatusOK { t.Fatalf("expected to declare them, got %d", code) }
+	if code := declare ("/admin/partitions/jobs/8"); code != http.StatusConflict { t.Fatalf("expected a conflict, got %d", code) }
+	if ack := subscribe ("three", "orders", 6); ack.Type != models.FrameAck { t.Fatalf("expected the matching count to work : %+v", ack) }
+
+	// every partition has an owner
+	req, err := http.Get ("http://" + addr + "/admin/partitions")
+	models.TestingStackTrace (t, err)
+	defer req.Body.Close()
+	owners := make([]models.PartitionOwner, 0)
+	models.TestingStackTrace (t, json.NewDecoder (req.Body).Decode (&owners))
+	if len(owners) != 10 { t.Fatalf("expected 10 partitions owned, got %d", len(owners)) }
+}
+
+func TestQACommitOwner (t *testing.T) {
+	_, addr := newTestServer (t, models.OPTS{})
+
+	dial := func (id string) *websocket.Conn {
+		conn, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: id })
+		models.TestingStackTrace (t, err)
+		t.Cleanup (func() { conn.Close() })
+		return conn
+	}
+	owner, other := dial ("owner"), dial ("other")
+
+	send := func (conn *websocket.Conn, ref string, typ models.FrameType, group string) *models.Frame {
+		frame := &models.Frame{ Type: typ, Confirm: true }
+		frame.Id, frame.Ref, frame.Topic, frame.Group, frame.Offset = ref, ref, "jobs", group, 5
+		writeTestFrame (t, conn, frame)
+		return readTestFrame (t, conn, func(f *models.Frame) bool { return f.Ref == ref })
+	}
+
+	if ack := send (owner, "sub", models.FrameSubscribe, "workers"); ack.Type != models.FrameAck { t.Fatalf("expected the subscribe to work : %+v", ack) }
+
+	// someone outside the group can't move it along
+	if nack := send (other, "one", models.FrameCommit, "workers"); nack.Type != models.FrameError { t.Fatalf("expected a non member's commit to fail : %+v", nack) }
+	if nack := send (owner, "two", models.FrameCommit, "others"); nack.Type != models.FrameError { t.Fatalf("expected a commit for another group to fail : %+v", nack) }
+	if ack := send (owner, "three", models.FrameCommit, "workers"); ack.Type != models.FrameAck { t.Fatalf("expected the owner's commit to work : %+v", ack) }
+
+	// once they've left the group the partition isn't theirs anymore
+	if ack := send (owner, "four", models.FrameUnsubscribe, "workers"); ack.Type != models.FrameAck { t.Fatalf("expected the unsubscribe to work : %+v", ack) }
+	if nack := send (owner, "five", models.FrameCommit, "workers"); nack.Type != models.FrameError { t.Fatalf("expected a commit after leaving to fail : %+v", nack) }
+}
+
+func TestQADedupRefused (t *testing.T) {
+	_, addr := newTestServer (t, models.OPTS{ DedupWindow: time.Minute })
+
+	pub, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "pub" })
+	models.TestingStackTrace (t, err)
+	defer pub.Close()
+
+	publish := func (ref string) *models.Frame {
+		frame := &models.Frame{ Type: models.FramePublish, Confirm: true, Body: []byte("hello") }
+		frame.Id, frame.Ref, frame.To = "once", ref, "later"
+		writeTestFrame (t, pub, frame)
+		return readTestFrame (t, pub, func(f *models.Frame) bool { return f.Id == "once" && (f.Type == models.FrameAck || f.Type == models.FrameError) })
+	}
+
+	// nobody took it, so it isn't a duplicate when they try again
+	if nack := publish ("one"); nack.Type != models.FrameError { t.Fatalf("expected the target to be unreachable : %+v", nack) }
+
+	later, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "later" })
+	models.TestingStackTrace (t, err)
+	defer later.Close()
+	time.Sleep (time.Millisecond * 50) // let the que pick them up
+
+	if ack := publish ("two"); ack.Type != models.FrameAck { t.Fatalf("expected the retry to be accepted : %+v", ack) }
+	readTestFrame (t, later, func(f *models.Frame) bool { return string(f.Body) == "hello" })
+}
+
+func TestQARedeliverGone (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{ MaxRedeliveries: 3, RedeliveryDelay: time.Millisecond * 200 })
+
+	dial := func (id string) *websocket.Conn {
+		conn, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: id })
+		models.TestingStackTrace (t, err)
+		t.Cleanup (func() { conn.Close() })
+		return conn
+	}
+	subscribe := func (conn *websocket.Conn, ref, group string) {
+		frame := &models.Frame{ Type: models.FrameSubscribe, Confirm: true }
+		frame.Id, frame.Ref, frame.Topic, frame.Group = ref, ref, "jobs", group
+		writeTestFrame (t, conn, frame)
+		readTestFrame (t, conn, func(f *models.Frame) bool { return f.Ref == ref })
+	}
+	nackAndLeave := func (conn *websocket.Conn, id string) {
+		msg := readTestFrame (t, conn, func(f *models.Frame) bool { return f.Id == id })
+		msg.Type, msg.Error = models.FrameNack, "nope"
+		writeTestFrame (t, conn, msg)
+		time.Sleep (time.Millisecond * 50) // let the nack land before we go
+		conn.Close()
+	}
+
+	first, second, pub := dial ("first"), dial ("second"), dial ("pub")
+	subscribe (first, "one", "workers")
+	subscribe (second, "two", "workers")
+
+	// the member that failed it is gone, so whoever has the partition now gets it
+	frame := &models.Frame{ Type: models.FramePublish, Body: []byte("hello") }
+	frame.Id, frame.Topic = "grouped", "jobs"
+	writeTestFrame (t, pub, frame)
+
+	owner, other := first, second
+	if svr.que.Partitions().Owner ("jobs", "workers", 0) != svr.que.Conn ("first") {
+		owner, other = second, first
+	}
+	nackAndLeave (owner, "grouped")
+	readTestFrame (t, other, func(f *models.Frame) bool { return f.Id == "grouped" })
+
+	// without a group there's nobody else to give it to, so it's dead lettered rather than lost
+	solo := dial ("solo")
+	time.Sleep (time.Millisecond * 50) // let them get added
+	frame.Id, frame.Topic = "single", "solo"
+	writeTestFrame (t, pub, frame)
+	nackAndLeave (solo, "single")
+
+	for end := time.Now().Add(time.Second * 2); len(svr.deadLetters.List ("solo")) == 0 && time.Now().Before(end); {
+		time.Sleep (time.Millisecond * 20)
+	}
+	if list := svr.deadLetters.List ("solo"); len(list) != 1 || list[0].Message.Id != "single" { t.Fatalf("unexpected dead letters : %+v", list) }
+}
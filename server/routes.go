@@ -8,12 +8,23 @@ package server
 import (
 	"github.com/justinas/alice"
 	"github.com/gorilla/mux"
+
+	"github.com/NathanRThomas/k8mq/models"
+
+	"net/http"
 )
 
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- MIDDLEWARE --------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
 
+func (this *Server) metricsHandle (w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	this.que.Metrics().Write(w)
+	models.WriteUsageMetrics(w, this.history.Usages())
+	models.WriteLagMetrics(w, this.history.Lag(this.offsets))
+}
+
   //-------------------------------------------------------------------------------------------------------------------------//
  //----- ENTRY POINTS ------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------------//
@@ -23,5 +34,29 @@ func (this *Server) routes () *mux.Router {
 	
 	// queue - websockets
 	mux.Handle ("/que", alice.New().ThenFunc(this.wssHandle))
+
+	// prometheus scraping
+	mux.Handle ("/metrics", alice.New().ThenFunc(this.metricsHandle)).Methods(http.MethodGet)
+
+	// admin
+	mux.Handle ("/admin/members", alice.New().ThenFunc(this.membersList)).Methods(http.MethodGet)
+
+	mux.Handle ("/admin/partitions", alice.New().ThenFunc(this.partitionsList)).Methods(http.MethodGet)
+	mux.Handle ("/admin/partitions/{topic}/{count:[0-9]+}", alice.New().ThenFunc(this.partitionsDeclare)).Methods(http.MethodPut)
+	mux.Handle ("/admin/groups", alice.New().ThenFunc(this.groupsList)).Methods(http.MethodGet)
+	mux.Handle ("/admin/lag", alice.New().ThenFunc(this.lagList)).Methods(http.MethodGet)
+
+	mux.Handle ("/admin/log", alice.New().ThenFunc(this.logUsage)).Methods(http.MethodGet)
+	mux.Handle ("/admin/log/{topic}", alice.New().ThenFunc(this.logTopicUsage)).Methods(http.MethodGet)
+
+	mux.Handle ("/admin/scheduled", alice.New().ThenFunc(this.scheduledList)).Methods(http.MethodGet)
+	mux.Handle ("/admin/scheduled/{id}", alice.New().ThenFunc(this.scheduledCancel)).Methods(http.MethodDelete)
+
+	mux.Handle ("/admin/dlq", alice.New().ThenFunc(this.deadLetterTopics)).Methods(http.MethodGet)
+	mux.Handle ("/admin/dlq/{topic}", alice.New().ThenFunc(this.deadLetterList)).Methods(http.MethodGet)
+	mux.Handle ("/admin/dlq/{topic}", alice.New().ThenFunc(this.deadLetterPurge)).Methods(http.MethodDelete)
+	mux.Handle ("/admin/dlq/{topic}/{id:[0-9]+}", alice.New().ThenFunc(this.deadLetterPurge)).Methods(http.MethodDelete)
+	mux.Handle ("/admin/dlq/{topic}/republish", alice.New().ThenFunc(this.deadLetterRepublish)).Methods(http.MethodPost)
+	mux.Handle ("/admin/dlq/{topic}/{id:[0-9]+}/republish", alice.New().ThenFunc(this.deadLetterRepublish)).Methods(http.MethodPost)
     return mux
 }
@@ -20,8 +20,12 @@ import (
 	
 	"fmt"
 	"context"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 	"log/slog"
 )
@@ -30,6 +34,14 @@ import (
  //----- CONSTS ------------------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------//
 
+const dedupFile		= "dedup.json"
+const scheduledFile	= "scheduled.json"
+const deadLetterFile	= "deadletters.json"
+const retainedFile		= "retained.json"
+const logDir			= "log"
+const offsetsFile		= "offsets.json" // in the log dir when durable, otherwise in the data dir
+const partitionsFile	= "partitions.json" // declared partition counts, next to the offsets
+
   //-------------------------------------------------------------------------------------------------------------------//
  //----- PRIVATE FUNCTIONS -------------------------------------------------------------------------------------------//
 //-------------------------------------------------------------------------------------------------------------------//
@@ -40,29 +52,77 @@ import (
 //-----------------------------------------------------------------------------------------------------------------------//
 
 type Server struct {
-	opts models.OPTS // used for logging
+	opts models.OPTS // config, eg how long each drain phase takes
 	port int 
-	reader models.ReadCallback
-	closing bool // indicates the server is shutting down and shouldn't accept new connections
+	handler models.Handler
+	ctx context.Context // passed to the handler, done once we start closing
+	ctxCancel context.CancelFunc
+	closing atomic.Bool // indicates the server is shutting down and shouldn't accept new connections
+	ready atomic.Bool // false once we've drained and k8 should stop sending us traffic
+	drainOnce sync.Once
 	
 	svr *http.Server
 
 	que *models.Que 
+	dedup *models.Dedup // nil when disabled
+	scheduler *models.Scheduler
+	deadLetters *models.DeadLetters
+	retained *models.Retained
+	history *models.History
+	offsets *models.Offsets
+	attempts *models.Attempts // times clients have nacked each message
 	wg *sync.WaitGroup
 }
 
+// path to a file in our data dir, empty if we're not persisting things
+func (this *Server) dataFile (name string) string {
+	if len(this.opts.DataDir) == 0 { return "" }
+	return filepath.Join(this.opts.DataDir, name)
+}
+
 // actually handles the closing of things in a background process
 func (this *Server) closeAndWait (ctx context.Context, done chan bool) {
+	this.ctxCancel() // let any handlers know we're going away
+
 	if this.svr != nil {
 		// this shutsdown the server and returns once there's no more active connections.
 		// but we should only have k8 connections anyway, so this should be pretty quick
 		this.svr.Shutdown(ctx)
 	}
 
+	if this.scheduler != nil {
+		if err := this.scheduler.Close(); err != nil {
+			slog.Warn("K8MQ failed to save the scheduled messages : " + err.Error())
+		}
+	}
+
 	if this.que != nil {
 		this.que.Close(time.Second * 20)
 	}
 
+	if this.history != nil {
+		if err := this.history.Close(); err != nil {
+			slog.Warn("K8MQ failed to close the log : " + err.Error())
+		}
+	}
+
+	if this.deadLetters != nil {
+		if err := this.deadLetters.Close(); err != nil {
+			slog.Warn("K8MQ failed to save the dead letters : " + err.Error())
+		}
+	}
+
+	if this.offsets != nil {
+		if err := this.offsets.Close(); err != nil {
+			slog.Warn("K8MQ failed to save the consumer group offsets : " + err.Error())
+		}
+	}
+
+	// save anything we want to survive the restart
+	if err := this.dedup.Close(); err != nil {
+		slog.Warn("K8MQ failed to save the dedup cache : " + err.Error())
+	}
+
 	if this.wg != nil {
 		this.wg.Wait() // wait for the server to shut down
 	}
@@ -70,27 +130,92 @@ func (this *Server) closeAndWait (ctx context.Context, done chan bool) {
 	done <- true // we're done
 }
 
-// designed to be run in its own go thread
-func (this *Server) launchServer (port int) {
-	// launch our server
-	this.wg.Add(1)  // this gets 
-	this.closing = false // we're not shutting down if we're launching
+// binds to the port, so once this returns we're ready for connections
+func (this *Server) listen (port int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil { return nil, errors.WithStack(err) }
 
 	this.svr = &http.Server {
-		Addr: fmt.Sprintf(":%d", port),
 		Handler: this.routes(), 
 		ReadTimeout: time.Second * 30,
 	}
 
+	this.wg.Add(1) // done once the server stops
+	this.closing.Store(false) // we're not shutting down if we're launching
+	this.ready.Store(true)
+
 	slog.Info(fmt.Sprintf("K8MQ Server Started on port %d", port))
+	return listener, nil
+}
 
-	if err := this.svr.ListenAndServe(); err != http.ErrServerClosed && err != nil {            // Error starting or closing listener:
+// designed to be run in its own go thread
+func (this *Server) launchServer (listener net.Listener) {
+	if err := this.svr.Serve(listener); err != http.ErrServerClosed && err != nil {            // Error starting or closing listener:
 		slog.Warn("K8MQ Server closed with an error : " + err.Error())
 	}
 	
 	this.wg.Done() // we're done, the server isn't running anymore
 }
 
+// waits for the que to finish writing out anything it has buffered, up to the deadline
+func (this *Server) waitForFlush (deadline time.Duration) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+
+	for this.que.Pending() > 0 {
+		select {
+		case <-ctx.Done():
+			return false // we ran out of time
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+
+	return true
+}
+
+// walks through each of the drain phases, logging how long each one took
+func (this *Server) drain () {
+	start := time.Now()
+	phase := func (name string, tm time.Time) {
+		slog.Info(fmt.Sprintf("K8MQ drain: %s : %s", name, time.Since(tm)))
+	}
+
+	// 1. stop accepting new connections
+	tm := time.Now()
+	this.closing.Store(true)
+	phase("stopped accepting connections", tm)
+
+	// 2. tell the clients we're going away so they stop sending to us
+	tm = time.Now()
+	this.shutdown()
+	time.Sleep(this.opts.DrainNotify) // give a little time to clients process this
+	phase("notified clients", tm)
+
+	// 3. let anything we've already accepted get written out
+	tm = time.Now()
+	if this.waitForFlush (this.opts.DrainFlush) {
+		phase("flushed outbound messages", tm)
+	} else {
+		slog.Warn(fmt.Sprintf("K8MQ drain: timed out flushing outbound messages : %d still pending", this.que.Pending()))
+	}
+
+	// anything still held for a paused client isn't going out before we do, so it goes to the dead letters
+	if held := this.que.ReleaseHeld(); len(held) > 0 {
+		for _, msg := range held {
+			this.deadLetter (msg, "held for a connection out of credit while draining")
+		}
+		slog.Warn(fmt.Sprintf("K8MQ drain: dead lettered %d messages held for connections out of credit", len(held)))
+	}
+
+	// 4. fail readiness and give k8 time to pull us from the service endpoints
+	tm = time.Now()
+	this.ready.Store(false)
+	time.Sleep(this.opts.DrainReady)
+	phase("failed readiness", tm)
+
+	phase("drain complete", start)
+}
+
   //-----------------------------------------------------------------------------------------------------------------------//
  //----- PUBLIC FUNCTIONS ------------------------------------------------------------------------------------------------//
 //-----------------------------------------------------------------------------------------------------------------------//
@@ -116,6 +241,13 @@ func (this *Server) Close (tm time.Duration) error {
 	return nil // we're good
 }
 
+// tells every connection we're going away, it's not a message so it doesn't depend on what they've subscribed to
+func (this *Server) shutdown () {
+	if this.que != nil {
+		this.que.Shutdown()
+	}
+}
+
 // in case we want to fire out a new message to all connected listeners
 func (this *Server) NewMsg (msg []byte) {
 	if this.que != nil {
@@ -123,26 +255,128 @@ func (this *Server) NewMsg (msg []byte) {
 	}
 }
 
+// sends the message to just the client with this id, returns models.ErrNotConnected if they aren't
+func (this *Server) SendTo (id string, msg []byte) error {
+	if this.que == nil { return errors.WithStack (models.ErrQueClosed) }
+	return this.sendTo (id, &models.QueMessage{ Msg: msg })
+}
+
+// sends the message to just the clients with labels matching the selector, eg app=billing,zone in (a,b)
+func (this *Server) SendToSelector (selector string, msg []byte) error {
+	if _, err := models.ParseSelector (selector); err != nil { return err }
+	if this.que == nil { return errors.WithStack (models.ErrQueClosed) }
+
+	out := &models.QueMessage{ Msg: msg }
+	out.Id = models.MessageId (msg)
+	out.Selector = selector
+	out.Published = time.Now().UnixMilli()
+	return this.que.Publish (out)
+}
+
+// everyone connected to us right now
+func (this *Server) Members () []models.Member {
+	if this.que == nil { return nil }
+	return this.que.Members()
+}
+
 // this should be fired as soon as k8 knows it's shutting down the k8mq service
 func (this *Server) SendShutdown () {
-	this.closing = true // don't accept new connections
-	this.NewMsg ([]byte(models.ShutdownMessage))
-	time.Sleep(time.Millisecond * 300) // give a little time to clients process this
+	this.closing.Store(true) // don't accept new connections
+	this.shutdown()
+	time.Sleep(this.opts.DrainNotify) // give a little time to clients process this
+}
+
+// gracefully drains the server, designed to be called from a k8 preStop hook and/or on SIGTERM
+// safe to call more than once, any later calls block until the first drain has finished
+func (this *Server) Drain () {
+	this.drainOnce.Do(this.drain)
+}
+
+// false once the server has drained, or before it's started
+func (this *Server) Ready () bool {
+	return this.ready.Load()
 }
 
 // setting a reader changes the behavior so instead of re-broadcasting each message it returns each message to the reader instead
 func NewServer (port int, reader models.ReadCallback) (*Server, error) {
+	return NewServerWithOpts (port, reader, models.OPTS{})
+}
+
+// same as NewServer but lets the caller configure things, eg the drain phases
+func NewServerWithOpts (port int, reader models.ReadCallback, opts models.OPTS) (*Server, error) {
+	return NewServerWithHandler (port, models.ReadCallbackHandler (reader), opts)
+}
+
+// same as NewServerWithOpts but with the newer handler, which sees everything about the message and can fail it
+func NewServerWithHandler (port int, handler models.Handler, opts models.OPTS) (*Server, error) {
 	if port == 0 { port = models.DefaultPort } // default port
 
+	opts.Defaults() // fill in anything that wasn't set
+
 	ret := &Server{
+		opts: opts,
 		wg: new(sync.WaitGroup),
-		reader: reader, // could be null
+		handler: handler, // could be null
+		attempts: models.NewAttempts(opts.RedeliveryDelay * time.Duration(opts.MaxRedeliveries + 1) + time.Minute), // outlasts the longest backoff
+	}
+
+	ret.ctx, ret.ctxCancel = context.WithCancel(context.Background())
+
+	// anything we started before failing gets closed again
+	started := false
+	defer func() {
+		if started == false {
+			ret.Close(time.Second)
+		}
+	}()
+
+	if len(opts.DataDir) > 0 {
+		if err := os.MkdirAll(opts.DataDir, 0700); err != nil { return nil, errors.WithStack(err) }
+	}
+
+	var err error
+	ret.dedup, err = models.NewDedup(opts.DedupWindow, opts.DedupMax, ret.dataFile(dedupFile))
+	if err != nil { return nil, err }
+	ret.deadLetters, err = models.NewDeadLetters(opts.DeadLetterMax, ret.dataFile(deadLetterFile))
+	if err != nil { return nil, err }
+
+	ret.retained, err = models.NewRetained(ret.dataFile(retainedFile))
+	if err != nil { return nil, err }
+
+	ret.history, err = models.NewHistory(&ret.opts, ret.dataFile(logDir))
+	if err != nil { return nil, err }
+
+	// the groups' offsets, and the partition counts they depend on, go with the log when there is one
+	groupFile := ret.dataFile
+	if ret.opts.Durable {
+		groupFile = func(name string) string { return filepath.Join(ret.dataFile(logDir), name) }
+	}
+
+	partitions, err := models.NewPartitions(ret.opts.Partitions, groupFile(partitionsFile))
+	if err != nil { return nil, err }
+
+	ret.offsets, err = models.NewOffsets(groupFile(offsetsFile))
+	if err != nil { return nil, err }
+
+	// without the log the offsets start over, so pick up after what the groups committed
+	for _, g := range ret.offsets.List() {
+		ret.history.Seed (g.Topic, g.Offset)
 	}
 
 	ret.que = models.NewQue(&ret.opts)
+	ret.que.SetHistory(ret.history)
+	ret.que.SetPartitions(partitions)
+	ret.que.SetOffsets(ret.offsets)
+
+	ret.scheduler, err = models.NewScheduler(ret.dataFile(scheduledFile), ret.deliver)
+	if err != nil { return nil, err }
+
+	// bind now, so we're ready as soon as we return
+	listener, err := ret.listen (port)
+	if err != nil { return nil, err }
 
-	// launch our server
-	go ret.launchServer (port)
+	go ret.launchServer (listener)
 
+	started = true
 	return ret, nil // we're good
 }
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+
+	"github.com/NathanRThomas/k8mq/models"
+
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// starts a server on a free port, it's closed once the test is done
+func newTestServer (t *testing.T, opts models.OPTS) (*Server, string) {
+	return newTestServerWithHandler (t, nil, opts)
+}
+
+// same as newTestServer but messages go to the handler
+func newTestServerWithHandler (t *testing.T, handler models.Handler, opts models.OPTS) (*Server, string) {
+	port := freeTestPort (t)
+	svr, err := NewServerWithHandler (port, handler, opts)
+	models.TestingStackTrace (t, err)
+	t.Cleanup (func() { svr.Close (time.Second * 5) })
+
+	return svr, fmt.Sprintf("localhost:%d", port)
+}
+
+// a port nothing's listening on
+func freeTestPort (t *testing.T) int {
+	l, err := net.Listen ("tcp", "localhost:0")
+	models.TestingStackTrace (t, err)
+	defer l.Close()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// connects to the server as a client with this info, set the Proto for one that speaks frames
+func dialTestServer (addr string, info models.ConnInfo) (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial (fmt.Sprintf("ws://%s/que?%s", addr, info.Query().Encode()), nil)
+	return conn, err
+}
+
+// sends the frame, failing the test if we can't
+func writeTestFrame (t *testing.T, conn *websocket.Conn, frame *models.Frame) {
+	t.Helper()
+	models.TestingStackTrace (t, conn.WriteMessage (websocket.TextMessage, frame.Marshal()))
+}
+
+// reads frames until one passes the check, or we run out of time
+func readTestFrame (t *testing.T, conn *websocket.Conn, check func(*models.Frame) bool) *models.Frame {
+	t.Helper()
+	conn.SetReadDeadline (time.Now().Add(time.Second * 2))
+	defer conn.SetReadDeadline (time.Time{})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil { t.Fatalf("no matching frame : %v", err) }
+
+		if frame, ok := models.ParseFrame (data); ok && check (frame) { return frame }
+	}
+}
+
+func TestServerDrain (t *testing.T) {
+	svr, addr := newTestServer (t, models.OPTS{ DrainNotify: time.Millisecond * 10, DrainFlush: time.Millisecond * 200, DrainReady: time.Millisecond * 10 })
+	if svr.Ready() == false { t.Fatal("expected to be ready as soon as we're started") }
+
+	conn, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "a" })
+	models.TestingStackTrace (t, err)
+	defer conn.Close()
+
+	svr.Drain()
+	if svr.Ready() { t.Fatal("expected readiness to fail once we've drained") }
+
+	// the connected client was told we're going away
+	readTestFrame (t, conn, func(f *models.Frame) bool { return f.Type == models.FrameShutdown })
+
+	// and nobody new can connect
+	if _, err := dialTestServer (addr, models.ConnInfo{ Proto: models.ProtocolVersion, Id: "b" }); err == nil { t.Fatal("expected new connections to be refused while draining") }
+
+	svr.Drain() // safe to call again
+}
+
+func TestQANewServerCleanup (t *testing.T) {
+	dir := t.TempDir()
+	models.TestingStackTrace (t, os.WriteFile (filepath.Join (dir, offsetsFile), []byte("not json"), 0600))
+
+	// the offsets can't be loaded, so we fail after the dedup cache and dead letters have started
+	before := runtime.NumGoroutine()
+	_, err := NewServerWithOpts (freeTestPort (t), nil, models.OPTS{ DataDir: dir, DedupWindow: time.Minute })
+	if err == nil { t.Fatal("expected the server to fail to load the offsets") }
+
+	// and it's all been closed again
+	for end := time.Now().Add(time.Second * 2); runtime.NumGoroutine() > before; time.Sleep (time.Millisecond * 10) {
+		if time.Now().After(end) { t.Fatalf("expected what was started to be closed, %d goroutines left from %d", runtime.NumGoroutine(), before) }
+	}
+}